@@ -1,6 +1,9 @@
 package main
 
 import (
+	"awesomeProject11/internal/api"
+	"awesomeProject11/internal/config"
+	"awesomeProject11/internal/repo"
 	"log"
 	"net/http"
 	"os"
@@ -11,6 +14,39 @@ func main() {
 	if apiPort == "" {
 		apiPort = "8081"
 	}
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	repo.SetCacheTTL(cfg.Cache.TTL)
+
+	pgDB, err := repo.ConnectPostgres(cfg.Postgres.DSN, cfg.Postgres.MaxOpenConns, cfg.Postgres.MaxIdleConns, cfg.Postgres.ConnMaxLifetime)
+	if err != nil {
+		log.Fatalf("PosgreSQL connection error: %v", err)
+	}
+	defer func() {
+		err := pgDB.Close()
+		if err != nil {
+			log.Printf("Failed to close PosgreSQL db: %v", err)
+		}
+	}()
+
+	redisClient, err := repo.CreateRedisCache(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB, cfg.Redis.PoolSize)
+	if err != nil {
+		log.Fatalf("Failed to create cache: %v", err)
+	}
+
+	// The API manages users, passwords and lockouts, so running it open
+	// has to be asked for explicitly.
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		if os.Getenv("ADMIN_INSECURE") != "1" {
+			log.Fatal("ADMIN_TOKEN is not set; set it, or ADMIN_INSECURE=1 to run the admin API unauthenticated")
+		}
+		log.Println("WARNING: ADMIN_TOKEN is not set, admin API is unauthenticated")
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -20,6 +56,13 @@ func main() {
 		}
 	})
 
+	adminAPI := &api.Server{
+		Users: repo.NewUserStore(pgDB, redisClient),
+		Usage: repo.NewUsageStore(pgDB, redisClient),
+		Token: adminToken,
+	}
+	adminAPI.Register(mux)
+
 	log.Printf("API Server is starting on port :%s", apiPort)
 	if err := http.ListenAndServe(":"+apiPort, mux); err != nil {
 		log.Fatalf("API server crashed: %v", err)
@@ -6,6 +6,20 @@ CREATE TABLE IF NOT EXISTS users (
                                      max_connections INTEGER DEFAULT 10
 );
 
+ALTER TABLE users ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Bandwidth limits in bytes per second, 0 means unlimited. rate_burst_bytes
+-- is the token bucket size, 0 means one second of traffic.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS upload_rate_bytes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS download_rate_bytes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS rate_burst_bytes BIGINT NOT NULL DEFAULT 0;
+
+-- billing_period is one of none, daily, weekly, monthly. Weekly and monthly
+-- periods start on the weekday / day of month of billing_anchor (signup day).
+ALTER TABLE users ADD COLUMN IF NOT EXISTS billing_period TEXT NOT NULL DEFAULT 'none'
+    CHECK (billing_period IN ('none', 'daily', 'weekly', 'monthly'));
+ALTER TABLE users ADD COLUMN IF NOT EXISTS billing_anchor DATE NOT NULL DEFAULT CURRENT_DATE;
+
 CREATE TABLE IF NOT EXISTS traffic_logs (
                                             id BIGSERIAL PRIMARY KEY,
                                             username TEXT REFERENCES users(username),
@@ -13,4 +27,127 @@ CREATE TABLE IF NOT EXISTS traffic_logs (
     timestamp TIMESTAMPTZ DEFAULT NOW()
     );
 
-INSERT INTO users (username, password) VALUES ('user', 'pass') ON CONFLICT DO NOTHING;
\ No newline at end of file
+-- Ids of pending_db_logs batches already written to traffic_logs, so a
+-- batch retried after a crash is not counted twice. Rows older than a week
+-- are pruned by the proxy.
+CREATE TABLE IF NOT EXISTS traffic_log_batches (
+    batch_id TEXT PRIMARY KEY,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS traffic_log_batches_processed_idx ON traffic_log_batches (processed_at);
+
+CREATE TABLE IF NOT EXISTS usage_periods (
+    username TEXT REFERENCES users(username),
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    bytes_used BIGINT NOT NULL,
+    PRIMARY KEY (username, period_start)
+);
+
+-- One row per tunnel, SOCKS5 session or plain HTTP request. status_code is
+-- the HTTP status, or the SOCKS5 reply code for SOCKS5 and SOCKS5_UDP rows.
+CREATE TABLE IF NOT EXISTS connection_logs (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT NOT NULL,
+    client_ip TEXT NOT NULL,
+    method TEXT NOT NULL,
+    target TEXT NOT NULL,
+    status_code INTEGER NOT NULL,
+    bytes_up BIGINT NOT NULL,
+    bytes_down BIGINT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    duration_ms BIGINT NOT NULL,
+    close_reason TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS connection_logs_user_started_idx ON connection_logs (username, started_at);
+
+-- Destination access rules, evaluated in position order. Rows without a
+-- username are global; a user's own rules are checked before them.
+CREATE TABLE IF NOT EXISTS acl_rules (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT REFERENCES users(username) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+    pattern TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS acl_rules_username_idx ON acl_rules (username, position);
+
+-- Keep customers out of loopback, private and link-local networks. The rules
+-- also apply to the addresses names resolve to. A per-user allow rule does
+-- not open these ranges on its own: the proxy's SSRF guard blocks them too
+-- unless they are listed in ssrf.allow.
+INSERT INTO acl_rules (username, position, action, pattern)
+SELECT NULL, p.position, 'deny', p.pattern
+FROM (VALUES
+    (0, 'localhost'),
+    (1, '127.0.0.0/8'),
+    (2, '10.0.0.0/8'),
+    (3, '172.16.0.0/12'),
+    (4, '192.168.0.0/16'),
+    (5, '169.254.0.0/16'),
+    (6, '0.0.0.0/8'),
+    (7, '::1/128'),
+    (8, 'fc00::/7'),
+    (9, 'fe80::/10')
+) AS p(position, pattern)
+WHERE NOT EXISTS (SELECT 1 FROM acl_rules WHERE username IS NULL);
+
+-- Outbound address pools. strategy is fixed (one address per user, picked by
+-- username), round_robin or random (per connection).
+CREATE TABLE IF NOT EXISTS egress_pools (
+    name TEXT PRIMARY KEY,
+    strategy TEXT NOT NULL DEFAULT 'round_robin' CHECK (strategy IN ('fixed', 'round_robin', 'random')),
+    addresses INET[] NOT NULL DEFAULT '{}'
+);
+
+-- A user leaves from egress_address, from an address of egress_pool, or from
+-- the host's default address when neither is set.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS egress_address INET;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS egress_pool TEXT REFERENCES egress_pools(name) ON DELETE SET NULL;
+
+-- Other pools the user may pick per connection with the pool username
+-- option (alice-pool-dc2).
+ALTER TABLE users ADD COLUMN IF NOT EXISTS allowed_egress_pools TEXT[] NOT NULL DEFAULT '{}';
+
+-- Ways a user may log in: basic (Proxy-Authorization password), mtls
+-- (client certificate on the TLS listener), token (API token) and ip
+-- (registered client address).
+ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_methods TEXT[] NOT NULL DEFAULT '{basic}';
+
+-- Client certificate names mapped to users. identity is uri:, dns: or
+-- email: followed by a SAN, or cn: followed by the subject common name.
+CREATE TABLE IF NOT EXISTS user_certificates (
+    identity TEXT PRIMARY KEY,
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS user_certificates_username_idx ON user_certificates (username);
+
+-- API tokens, sent as "Proxy-Authorization: Bearer <token>". Only the
+-- SHA-256 of a token is stored.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_username_idx ON api_tokens (username);
+
+-- Client networks that log in as a user without credentials. Networks of
+-- different users may not overlap; UserStore.SetAddresses checks that under
+-- a table lock.
+CREATE TABLE IF NOT EXISTS user_addresses (
+    network CIDR PRIMARY KEY,
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS user_addresses_username_idx ON user_addresses (username);
+
+-- users.password holds a bcrypt hash. Legacy plaintext rows are still accepted
+-- and are replaced with a hash on the user's first successful login.
+INSERT INTO users (username, password) VALUES ('user', '$2a$10$rz6EJTywlILkm1p5Q3ZG/.H2VIM0N4l50oSlKX4JtApAcBsWKcmVq') ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1,292 @@
+// Package acl decides which destinations a proxy user may reach.
+//
+// A rule is an action (allow or deny) and a pattern of the form
+// host[:ports]. The host part is one of
+//
+//	example.com      exactly that domain
+//	.example.com     the domain and all of its subdomains
+//	*.example.com    subdomains only
+//	api-*.corp       a wildcard, * matches any characters
+//	10.0.0.0/8       addresses in a CIDR range
+//	192.0.2.1        a single address
+//	*                any host
+//
+// and ports is a port, a range such as 8000-8999, or * (the default).
+// IPv6 addresses and ranges with a port are written in brackets:
+// [fd00::/8]:443. Domain patterns only match destinations given by name.
+// Address patterns match destinations given as an address, and through
+// CheckAddr the addresses a name resolved to.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Rule is one allow or deny entry as stored and shown to admins.
+type Rule struct {
+	Action  string `json:"action"`
+	Pattern string `json:"pattern"`
+}
+
+func (r Rule) String() string {
+	return r.Action + " " + r.Pattern
+}
+
+type hostKind int
+
+const (
+	hostAny hostKind = iota
+	hostExact
+	hostSuffix     // .example.com
+	hostSubdomains // *.example.com
+	hostWildcard
+	hostPrefix
+)
+
+type compiledRule struct {
+	Rule
+	kind   hostKind
+	name   string
+	prefix netip.Prefix
+	portLo int
+	portHi int
+}
+
+// List is an ordered list of rules, the first matching rule decides.
+type List struct {
+	rules []compiledRule
+}
+
+// Compile parses rules in order. It fails on the first invalid rule.
+func Compile(rules []Rule) (*List, error) {
+	l := &List{rules: make([]compiledRule, 0, len(rules))}
+	for i, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", i+1, r, err)
+		}
+		l.rules = append(l.rules, c)
+	}
+	return l, nil
+}
+
+// Validate reports whether r can be compiled.
+func Validate(r Rule) error {
+	_, err := compile(r)
+	return err
+}
+
+func compile(r Rule) (compiledRule, error) {
+	c := compiledRule{Rule: r, portLo: 1, portHi: 65535}
+	if r.Action != Allow && r.Action != Deny {
+		return c, fmt.Errorf("action must be %q or %q", Allow, Deny)
+	}
+
+	host, ports, err := splitPattern(strings.TrimSpace(r.Pattern))
+	if err != nil {
+		return c, err
+	}
+	if ports != "" && ports != "*" {
+		if c.portLo, c.portHi, err = parsePorts(ports); err != nil {
+			return c, err
+		}
+	}
+
+	host = normalizeHost(host)
+	switch {
+	case host == "" || host == "*":
+		c.kind = hostAny
+	case strings.Contains(host, "/"):
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return c, fmt.Errorf("invalid CIDR %q", host)
+		}
+		c.kind, c.prefix = hostPrefix, p.Masked()
+	case isAddr(host):
+		a, _ := netip.ParseAddr(host)
+		c.kind, c.prefix = hostPrefix, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+	case !validName(host):
+		return c, fmt.Errorf("invalid host %q", host)
+	case strings.HasPrefix(host, "*.") && !strings.Contains(host[2:], "*"):
+		c.kind, c.name = hostSubdomains, host[1:]
+	case strings.HasPrefix(host, "."):
+		c.kind, c.name = hostSuffix, host
+	case strings.Contains(host, "*"):
+		c.kind, c.name = hostWildcard, host
+	default:
+		c.kind, c.name = hostExact, host
+	}
+	return c, nil
+}
+
+// splitPattern separates the host from an optional port part.
+func splitPattern(p string) (string, string, error) {
+	if strings.HasPrefix(p, "[") {
+		end := strings.Index(p, "]")
+		if end < 0 {
+			return "", "", errors.New("missing ]")
+		}
+		rest := p[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			return "", "", errors.New("unexpected text after ]")
+		}
+		return p[1:end], strings.TrimPrefix(rest, ":"), nil
+	}
+	// Bare IPv6 addresses and ranges have several colons and no port.
+	if strings.Count(p, ":") == 1 {
+		host, ports, _ := strings.Cut(p, ":")
+		return host, ports, nil
+	}
+	return p, "", nil
+}
+
+func parsePorts(s string) (int, int, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(loStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(hiStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// validName allows the characters of domain names plus the * wildcard, so
+// path.Match never sees its other special characters.
+func validName(host string) bool {
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case r == '-', r == '.', r == '_', r == '*':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isAddr(host string) bool {
+	_, err := netip.ParseAddr(host)
+	return err == nil
+}
+
+// matches reports whether the rule covers host and port. addr is the
+// address the destination stands for, invalid when it is not known, and
+// isIP says whether host itself is that address.
+func (c compiledRule) matches(host string, addr netip.Addr, isIP bool, port int) bool {
+	if port < c.portLo || port > c.portHi {
+		return false
+	}
+	switch c.kind {
+	case hostAny:
+		return true
+	case hostPrefix:
+		return addr.IsValid() && c.prefix.Contains(addr)
+	}
+	if isIP {
+		return false
+	}
+	switch c.kind {
+	case hostExact:
+		return host == c.name
+	case hostSuffix:
+		return host == c.name[1:] || strings.HasSuffix(host, c.name)
+	case hostSubdomains:
+		return strings.HasSuffix(host, c.name)
+	case hostWildcard:
+		ok, _ := path.Match(c.name, host)
+		return ok
+	}
+	return false
+}
+
+// Match returns the first rule matching host and port.
+func (l *List) Match(host string, port int) (Rule, bool) {
+	return l.match(host, netip.Addr{}, port)
+}
+
+// match is Match for a host known to stand for addr. An invalid addr is
+// only known when host is an address itself.
+func (l *List) match(host string, addr netip.Addr, port int) (Rule, bool) {
+	if l == nil {
+		return Rule{}, false
+	}
+	host = normalizeHost(host)
+	literal, err := netip.ParseAddr(host)
+	isIP := err == nil
+	if isIP {
+		addr = literal
+	}
+	if addr.IsValid() {
+		// A zone only names the interface, it must not dodge address rules.
+		addr = addr.WithZone("").Unmap()
+	}
+	for _, r := range l.rules {
+		if r.matches(host, addr, isIP, port) {
+			return r.Rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Decision is the outcome of Check. Reason explains a denial.
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+// Check applies the user's rules first and the global rules after them, so
+// an admin can make exceptions for single users. A destination no rule
+// matches is allowed.
+func Check(user, global *List, target string) Decision {
+	return CheckAddr(user, global, target, netip.Addr{})
+}
+
+// CheckAddr is Check for a target that resolved to addr, so address rules
+// also apply to targets given by name. An invalid addr makes it Check.
+func CheckAddr(user, global *List, target string, addr netip.Addr) Decision {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return Decision{Reason: "invalid destination " + strconv.Quote(target)}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return Decision{Reason: "invalid port " + strconv.Quote(portStr)}
+	}
+
+	for _, scope := range []struct {
+		name string
+		list *List
+	}{{"user", user}, {"global", global}} {
+		if r, ok := scope.list.match(host, addr, port); ok {
+			if r.Action == Allow {
+				return Decision{Allowed: true}
+			}
+			return Decision{Reason: fmt.Sprintf("denied by %s rule %q", scope.name, r.String())}
+		}
+	}
+	return Decision{Allowed: true}
+}
@@ -0,0 +1,140 @@
+package acl
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func mustCompile(t *testing.T, rules ...Rule) *List {
+	t.Helper()
+	l, err := Compile(rules)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	return l
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		target  string
+		want    bool
+	}{
+		{"example.com", "example.com:443", true},
+		{"example.com", "www.example.com:443", false},
+		{"example.com", "EXAMPLE.com.:80", true},
+		{".example.com", "example.com:443", true},
+		{".example.com", "a.b.example.com:443", true},
+		{".example.com", "badexample.com:443", false},
+		{"*.example.com", "example.com:443", false},
+		{"*.example.com", "api.example.com:443", true},
+		{"api-*.corp", "api-eu.corp:80", true},
+		{"api-*.corp", "web.corp:80", false},
+		{"10.0.0.0/8", "10.1.2.3:22", true},
+		{"10.0.0.0/8", "11.1.2.3:22", false},
+		{"10.0.0.0/8", "10.example.com:22", false},
+		{"192.0.2.1", "192.0.2.1:80", true},
+		{"192.0.2.1", "[::ffff:192.0.2.1]:80", true},
+		{"fc00::/7", "[fd12::1]:443", true},
+		{"[fc00::/7]:443", "[fd12::1]:80", false},
+		{"fc00::/7", "[fd12::1%eth0]:443", true},
+		{"fe80::/10", "[fe80::1%eth0]:443", true},
+		{"::1/128", "[::1%lo]:80", true},
+		{"::1", "[::1%25lo]:80", true},
+		{"*:25", "mail.example.com:25", true},
+		{"*:25", "mail.example.com:587", false},
+		{"example.com:8000-8999", "example.com:8080", true},
+		{"example.com:8000-8999", "example.com:9000", false},
+		{"*", "anything.test:1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.target, func(t *testing.T) {
+			l := mustCompile(t, Rule{Action: Deny, Pattern: tt.pattern})
+			d := Check(nil, l, tt.target)
+			if got := !d.Allowed; got != tt.want {
+				t.Errorf("pattern %q on %s: matched=%v, want %v", tt.pattern, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRejectsInvalidRules(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: "block", Pattern: "example.com"},
+		{Action: Deny, Pattern: "10.0.0.0/33"},
+		{Action: Deny, Pattern: "example.com:0"},
+		{Action: Deny, Pattern: "example.com:90-80"},
+		{Action: Deny, Pattern: "example.com:http"},
+		{Action: Deny, Pattern: "[fc00::/7"},
+		{Action: Deny, Pattern: "a[.example.com"},
+	} {
+		if err := Validate(r); err == nil {
+			t.Errorf("expected %q to be rejected", r)
+		}
+	}
+}
+
+func TestUserRulesComeFirst(t *testing.T) {
+	global := mustCompile(t,
+		Rule{Action: Deny, Pattern: "10.0.0.0/8"},
+		Rule{Action: Deny, Pattern: ".blocked.test"},
+	)
+	user := mustCompile(t, Rule{Action: Allow, Pattern: "10.0.0.5"})
+
+	if d := Check(user, global, "10.0.0.5:443"); !d.Allowed {
+		t.Errorf("user allow rule should override the global deny: %s", d.Reason)
+	}
+	d := Check(user, global, "10.0.0.6:443")
+	if d.Allowed || !strings.Contains(d.Reason, `global rule "deny 10.0.0.0/8"`) {
+		t.Errorf("expected a denial by the global rule, got %+v", d)
+	}
+	if d := Check(user, global, "www.blocked.test:80"); d.Allowed {
+		t.Error("expected a denial for a blocked domain")
+	}
+	if d := Check(user, global, "example.com:80"); !d.Allowed {
+		t.Errorf("unmatched destinations should be allowed: %s", d.Reason)
+	}
+}
+
+func TestFirstMatchWins(t *testing.T) {
+	l := mustCompile(t,
+		Rule{Action: Allow, Pattern: "*:443"},
+		Rule{Action: Deny, Pattern: "*"},
+	)
+	if d := Check(l, nil, "example.com:443"); !d.Allowed {
+		t.Errorf("expected port 443 to be allowed: %s", d.Reason)
+	}
+	d := Check(l, nil, "example.com:80")
+	if d.Allowed || !strings.Contains(d.Reason, "user rule") {
+		t.Errorf("expected port 80 to be denied by the user rule, got %+v", d)
+	}
+}
+
+func TestCheckRejectsInvalidTarget(t *testing.T) {
+	if d := Check(nil, nil, "example.com"); d.Allowed {
+		t.Error("expected a target without a port to be refused")
+	}
+}
+
+func TestCheckAddrAppliesAddressRulesToNames(t *testing.T) {
+	global := mustCompile(t, Rule{Action: Deny, Pattern: "10.0.0.0/8"})
+	internal := netip.MustParseAddr("10.1.2.3")
+
+	if d := Check(nil, global, "intranet.example:443"); !d.Allowed {
+		t.Errorf("expected a name alone not to match an address rule: %s", d.Reason)
+	}
+	if d := CheckAddr(nil, global, "intranet.example:443", internal); d.Allowed {
+		t.Error("expected a name resolving to 10.1.2.3 to be denied")
+	}
+	if d := CheckAddr(nil, global, "intranet.example:443", netip.MustParseAddr("::ffff:10.1.2.3")); d.Allowed {
+		t.Error("expected an IPv4-mapped address to be denied")
+	}
+
+	// A user exception by name still comes first.
+	user := mustCompile(t, Rule{Action: Allow, Pattern: "intranet.example"})
+	if d := CheckAddr(user, global, "intranet.example:443", internal); !d.Allowed {
+		t.Errorf("expected the user's allow rule to win: %s", d.Reason)
+	}
+}
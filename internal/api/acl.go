@@ -0,0 +1,66 @@
+package api
+
+import (
+	"awesomeProject11/internal/acl"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const maxACLRules = 1000
+
+type aclRequest struct {
+	Rules []acl.Rule `json:"rules"`
+}
+
+func (s *Server) registerACL(mux *http.ServeMux) {
+	mux.Handle("GET /acl", s.admin(s.getACL))
+	mux.Handle("PUT /acl", s.admin(s.setACL))
+	mux.Handle("GET /users/{username}/acl", s.admin(s.getACL))
+	mux.Handle("PUT /users/{username}/acl", s.admin(s.setACL))
+}
+
+// getACL serves the global rules, or a user's rules on the per-user route.
+func (s *Server) getACL(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	rules, err := s.Users.ACLRules(username)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, aclRequest{Rules: rules})
+}
+
+// setACL replaces the whole rule list, rules are evaluated in order.
+func (s *Server) setACL(w http.ResponseWriter, r *http.Request) {
+	var req aclRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if len(req.Rules) > maxACLRules {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d rules are allowed", maxACLRules))
+		return
+	}
+	if req.Rules == nil {
+		req.Rules = []acl.Rule{}
+	}
+	for i, rule := range req.Rules {
+		if err := acl.Validate(rule); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("rule %d (%s): %v", i+1, rule, err))
+			return
+		}
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.SetACLRules(username, req.Rules); err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	scope := "global"
+	if username != "" {
+		scope = "user " + username
+	}
+	log.Printf("[API] Set %d access rules for %s", len(req.Rules), scope)
+	writeJSON(w, http.StatusOK, req)
+}
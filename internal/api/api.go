@@ -0,0 +1,329 @@
+package api
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/repo"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server is the admin HTTP API used to manage proxy users and read their
+// usage.
+type Server struct {
+	Users *repo.UserStore
+	Usage *repo.UsageStore
+	// Token is the bearer token required on every admin route. An empty
+	// token leaves the API unauthenticated.
+	Token string
+}
+
+// Register adds the admin routes to mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.Handle("GET /users", s.admin(s.listUsers))
+	mux.Handle("POST /users", s.admin(s.createUser))
+	mux.Handle("GET /users/{username}", s.admin(s.getUser))
+	mux.Handle("DELETE /users/{username}", s.admin(s.deleteUser))
+	mux.Handle("POST /users/{username}/disable", s.admin(s.disableUser))
+	mux.Handle("POST /users/{username}/enable", s.admin(s.enableUser))
+	mux.Handle("PUT /users/{username}/password", s.admin(s.changePassword))
+	mux.Handle("PUT /users/{username}/limits", s.admin(s.setLimits))
+	mux.Handle("PUT /users/{username}/billing", s.admin(s.setBilling))
+	s.registerUsage(mux)
+	s.registerACL(mux)
+	s.registerEgress(mux)
+	s.registerAuth(mux)
+}
+
+func (s *Server) admin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next(w, r)
+	})
+}
+
+type createUserRequest struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	BillingPeriod string `json:"billing_period"`
+	BillingAnchor string `json:"billing_anchor"`
+	limitsRequest
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type billingRequest struct {
+	BillingPeriod string `json:"billing_period"`
+	BillingAnchor string `json:"billing_anchor"`
+}
+
+type limitsRequest struct {
+	DataLimitBytes    *int64 `json:"data_limit_bytes"`
+	MaxConnections    *int64 `json:"max_connections"`
+	UploadRateBytes   *int64 `json:"upload_rate_bytes"`
+	DownloadRateBytes *int64 `json:"download_rate_bytes"`
+	RateBurstBytes    *int64 `json:"rate_burst_bytes"`
+}
+
+// apply overwrites the limits of u that are set in the request.
+func (req limitsRequest) apply(u *repo.UserInfo) {
+	for _, f := range []struct {
+		src *int64
+		dst *int64
+	}{
+		{req.DataLimitBytes, &u.DataLimitBytes},
+		{req.MaxConnections, &u.MaxConnections},
+		{req.UploadRateBytes, &u.UploadRateBytes},
+		{req.DownloadRateBytes, &u.DownloadRateBytes},
+		{req.RateBurstBytes, &u.RateBurstBytes},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+}
+
+// Defaults match the column defaults in db/init.sql.
+const (
+	defaultDataLimitBytes = 1073741824
+	defaultMaxConnections = 10
+)
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.Users.ListUsers()
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	user, err := s.Users.GetUser(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Username == "" || strings.Contains(req.Username, ":") {
+		writeError(w, http.StatusBadRequest, "username is required and must not contain ':'")
+		return
+	}
+	if auth.HasOptions(req.Username) {
+		writeError(w, http.StatusBadRequest, "username must not contain username options such as -session-")
+		return
+	}
+	if req.Password == "" {
+		writeError(w, http.StatusBadRequest, "password is required")
+		return
+	}
+
+	user := repo.UserInfo{
+		Username:       req.Username,
+		Enabled:        true,
+		DataLimitBytes: defaultDataLimitBytes,
+		MaxConnections: defaultMaxConnections,
+		BillingPeriod:  limits.PeriodNone,
+		BillingAnchor:  req.BillingAnchor,
+	}
+	if req.BillingPeriod != "" {
+		user.BillingPeriod = req.BillingPeriod
+	}
+	if !validBilling(w, user.BillingPeriod, user.BillingAnchor) {
+		return
+	}
+	req.limitsRequest.apply(&user)
+	if !validLimits(w, user) {
+		return
+	}
+
+	created, err := s.Users.CreateUser(user, req.Password)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Created user %s", created.Username)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if err := s.Users.DeleteUser(username); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Deleted user %s", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) disableUser(w http.ResponseWriter, r *http.Request) {
+	s.setEnabled(w, r, false)
+}
+
+func (s *Server) enableUser(w http.ResponseWriter, r *http.Request) {
+	s.setEnabled(w, r, true)
+}
+
+func (s *Server) setEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	username := r.PathValue("username")
+	if err := s.Users.SetEnabled(username, enabled); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] User %s enabled=%v", username, enabled)
+	s.getUser(w, r)
+}
+
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Password == "" {
+		writeError(w, http.StatusBadRequest, "password is required")
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.SetPassword(username, req.Password); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Changed password for user %s", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setLimits(w http.ResponseWriter, r *http.Request) {
+	var req limitsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	current, err := s.Users.GetUser(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	req.apply(&current)
+	if !validLimits(w, current) {
+		return
+	}
+
+	if err := s.Users.SetLimits(current); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set limits for user %s: data=%d connections=%d upload=%d/s download=%d/s burst=%d",
+		current.Username, current.DataLimitBytes, current.MaxConnections,
+		current.UploadRateBytes, current.DownloadRateBytes, current.RateBurstBytes)
+	writeJSON(w, http.StatusOK, current)
+}
+
+func (s *Server) setBilling(w http.ResponseWriter, r *http.Request) {
+	var req billingRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	current, err := s.Users.GetUser(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	if req.BillingPeriod != "" {
+		current.BillingPeriod = req.BillingPeriod
+	}
+	if req.BillingAnchor != "" {
+		current.BillingAnchor = req.BillingAnchor
+	}
+	if !validBilling(w, current.BillingPeriod, current.BillingAnchor) {
+		return
+	}
+
+	if err := s.Users.SetBilling(current.Username, current.BillingPeriod, current.BillingAnchor); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set billing period for user %s: %s from %s", current.Username, current.BillingPeriod, current.BillingAnchor)
+	writeJSON(w, http.StatusOK, current)
+}
+
+func validBilling(w http.ResponseWriter, period, anchor string) bool {
+	if !limits.ValidPeriod(period) {
+		writeError(w, http.StatusBadRequest, "billing_period must be one of none, daily, weekly, monthly")
+		return false
+	}
+	if anchor != "" {
+		if _, err := time.Parse(time.DateOnly, anchor); err != nil {
+			writeError(w, http.StatusBadRequest, "billing_anchor must be a YYYY-MM-DD date")
+			return false
+		}
+	}
+	return true
+}
+
+func validLimits(w http.ResponseWriter, u repo.UserInfo) bool {
+	if u.DataLimitBytes < 0 || u.MaxConnections < 0 || u.UploadRateBytes < 0 || u.DownloadRateBytes < 0 || u.RateBurstBytes < 0 {
+		writeError(w, http.StatusBadRequest, "limits must not be negative")
+		return false
+	}
+	return true
+}
+
+func (s *Server) storeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repo.ErrUserNotFound), errors.Is(err, repo.ErrPoolNotFound), errors.Is(err, repo.ErrTokenNotFound),
+		errors.Is(err, repo.ErrLockoutNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, repo.ErrUserExists), errors.Is(err, repo.ErrIdentityTaken),
+		errors.Is(err, repo.ErrAddressTaken):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, repo.ErrUserInUse):
+		writeError(w, http.StatusConflict, err.Error()+", disable it instead")
+	default:
+		log.Printf("[API] %v", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write data: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
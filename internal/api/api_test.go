@@ -0,0 +1,179 @@
+package api
+
+import (
+	"awesomeProject11/internal/repo"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+const testToken = "secret"
+
+// newTestAPI serves the admin API over a mocked Postgres and an in-memory
+// Redis.
+func newTestAPI(t *testing.T) (*httptest.Server, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+
+	mux := http.NewServeMux()
+	(&Server{Users: repo.NewUserStore(db, rdb), Usage: repo.NewUsageStore(db, rdb), Token: testToken}).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return srv, mock, mr
+}
+
+func call(t *testing.T, srv *httptest.Server, method, path, body string) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var decoded map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp.StatusCode, decoded
+}
+
+var userColumnNames = []string{"username", "enabled", "data_limit_bytes", "max_connections",
+	"upload_rate_bytes", "download_rate_bytes", "rate_burst_bytes", "billing_period", "billing_anchor",
+	"egress_address", "egress_pool", "allowed_egress_pools", "auth_methods"}
+
+func userRow(username string, dataLimit int64) *sqlmock.Rows {
+	return sqlmock.NewRows(userColumnNames).
+		AddRow(username, true, dataLimit, 10, 0, 0, 0, "none", "2026-01-01", "", "", "{}", "{basic}")
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	srv, _, _ := newTestAPI(t)
+
+	for _, header := range []string{"", "Bearer wrong", "Basic c2VjcmV0"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/users", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got %d, want %d", header, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestUserLifecycle(t *testing.T) {
+	srv, mock, mr := newTestAPI(t)
+	q := regexp.QuoteMeta
+
+	mock.ExpectQuery(q("INSERT INTO users")).
+		WithArgs("alice", sqlmock.AnyArg(), true, int64(defaultDataLimitBytes), int64(defaultMaxConnections),
+			int64(0), int64(0), int64(0), "none", "").
+		WillReturnRows(userRow("alice", defaultDataLimitBytes))
+	status, body := call(t, srv, "POST", "/users", `{"username": "alice", "password": "pw"}`)
+	if status != http.StatusCreated || body["username"] != "alice" {
+		t.Fatalf("create: got %d %v", status, body)
+	}
+
+	mock.ExpectQuery(q("FROM users WHERE username = $1")).WithArgs("alice").
+		WillReturnRows(userRow("alice", defaultDataLimitBytes))
+	if status, body := call(t, srv, "GET", "/users/alice", ""); status != http.StatusOK || body["username"] != "alice" {
+		t.Fatalf("get: got %d %v", status, body)
+	}
+
+	mr.Set("user_limits:alice", "cached")
+	mock.ExpectQuery(q("FROM users WHERE username = $1")).WithArgs("alice").
+		WillReturnRows(userRow("alice", defaultDataLimitBytes))
+	mock.ExpectExec(q("UPDATE users SET data_limit_bytes")).
+		WithArgs(int64(5000), int64(10), int64(0), int64(0), int64(0), "alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	status, body = call(t, srv, "PUT", "/users/alice/limits", `{"data_limit_bytes": 5000}`)
+	if status != http.StatusOK || body["data_limit_bytes"] != float64(5000) {
+		t.Fatalf("set limits: got %d %v", status, body)
+	}
+	if mr.Exists("user_limits:alice") {
+		t.Error("set limits: expected the cached limits to be dropped")
+	}
+
+	// Deleting first drops the cached logins, then the row.
+	noRows := func(column string) *sqlmock.Rows { return sqlmock.NewRows([]string{column}).AddRow(nil) }
+	mock.ExpectQuery(q("FROM user_certificates")).WithArgs("alice").WillReturnRows(noRows("identities"))
+	mock.ExpectQuery(q("FROM api_tokens")).WithArgs("alice").WillReturnRows(noRows("hashes"))
+	mock.ExpectQuery(q("FROM user_addresses")).WithArgs("alice").WillReturnRows(noRows("networks"))
+	mock.ExpectExec(q("DELETE FROM users")).WithArgs("alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	if status, _ := call(t, srv, "DELETE", "/users/alice", ""); status != http.StatusNoContent {
+		t.Fatalf("delete: got %d", status)
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	srv, _, _ := newTestAPI(t)
+
+	for _, body := range []string{
+		`{"username": "a:b", "password": "pw"}`,
+		`{"username": "alice-session-x", "password": "pw"}`,
+		`{"username": "alice"}`,
+		`{"username": "alice", "password": "pw", "billing_period": "yearly"}`,
+		`{"username": "alice", "password": "pw", "max_connections": -1}`,
+		`{"username": "alice", "password": "pw", "unknown": 1}`,
+	} {
+		if status, _ := call(t, srv, "POST", "/users", body); status != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestStoreErrorMapping(t *testing.T) {
+	srv, mock, _ := newTestAPI(t)
+	q := regexp.QuoteMeta
+
+	mock.ExpectQuery(q("FROM users WHERE username = $1")).WithArgs("ghost").WillReturnError(sql.ErrNoRows)
+	if status, _ := call(t, srv, "GET", "/users/ghost", ""); status != http.StatusNotFound {
+		t.Errorf("unknown user: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	mock.ExpectQuery(q("INSERT INTO users")).WillReturnError(&pq.Error{Code: "23505"})
+	if status, _ := call(t, srv, "POST", "/users", `{"username": "alice", "password": "pw"}`); status != http.StatusConflict {
+		t.Errorf("duplicate user: got %d, want %d", status, http.StatusConflict)
+	}
+
+	noRows := func(column string) *sqlmock.Rows { return sqlmock.NewRows([]string{column}).AddRow(nil) }
+	mock.ExpectQuery(q("FROM user_certificates")).WillReturnRows(noRows("identities"))
+	mock.ExpectQuery(q("FROM api_tokens")).WillReturnRows(noRows("hashes"))
+	mock.ExpectQuery(q("FROM user_addresses")).WillReturnRows(noRows("networks"))
+	mock.ExpectExec(q("DELETE FROM users")).WillReturnError(&pq.Error{Code: "23503"})
+	status, body := call(t, srv, "DELETE", "/users/alice", "")
+	if status != http.StatusConflict || !strings.Contains(body["error"].(string), "disable it instead") {
+		t.Errorf("user in use: got %d %v", status, body)
+	}
+
+	mock.ExpectQuery(q("FROM users")).WillReturnError(errors.New("connection reset"))
+	status, body = call(t, srv, "GET", "/users", "")
+	if status != http.StatusInternalServerError || body["error"] != "internal error" {
+		t.Errorf("database error: got %d %v, want a 500 that hides the cause", status, body)
+	}
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/netguard"
+	"awesomeProject11/internal/repo"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+type authMethodsRequest struct {
+	AuthMethods []string `json:"auth_methods"`
+}
+
+type certificatesRequest struct {
+	Identities []string `json:"identities"`
+}
+
+type addressesRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+type createTokenRequest struct {
+	Name string `json:"name"`
+}
+
+// createTokenResponse is the only time the token itself is shown.
+type createTokenResponse struct {
+	repo.APIToken
+	Token string `json:"token"`
+}
+
+func (s *Server) registerAuth(mux *http.ServeMux) {
+	mux.Handle("PUT /users/{username}/auth-methods", s.admin(s.setAuthMethods))
+	mux.Handle("GET /users/{username}/certificates", s.admin(s.getCertificates))
+	mux.Handle("PUT /users/{username}/certificates", s.admin(s.setCertificates))
+	mux.Handle("GET /users/{username}/addresses", s.admin(s.getAddresses))
+	mux.Handle("PUT /users/{username}/addresses", s.admin(s.setAddresses))
+	mux.Handle("GET /users/{username}/tokens", s.admin(s.listTokens))
+	mux.Handle("POST /users/{username}/tokens", s.admin(s.createToken))
+	mux.Handle("DELETE /users/{username}/tokens/{id}", s.admin(s.deleteToken))
+	mux.Handle("GET /lockouts", s.admin(s.listLockouts))
+	mux.Handle("DELETE /lockouts/{kind}/{key}", s.admin(s.clearLockout))
+}
+
+func (s *Server) setAuthMethods(w http.ResponseWriter, r *http.Request) {
+	var req authMethodsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var methods []string
+	for _, m := range req.AuthMethods {
+		if !auth.ValidMethod(m) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown auth method %q", m))
+			return
+		}
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	if len(methods) == 0 {
+		writeError(w, http.StatusBadRequest, "auth_methods must not be empty, disable the user instead")
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.SetAuthMethods(username, methods); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set auth methods for user %s: %v", username, methods)
+	s.getUser(w, r)
+}
+
+func (s *Server) getCertificates(w http.ResponseWriter, r *http.Request) {
+	ids, err := s.Users.Certificates(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, certificatesRequest{Identities: ids})
+}
+
+func (s *Server) setCertificates(w http.ResponseWriter, r *http.Request) {
+	var req certificatesRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ids := []string{}
+	for _, id := range req.Identities {
+		normalized, err := auth.NormalizeIdentity(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !slices.Contains(ids, normalized) {
+			ids = append(ids, normalized)
+		}
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.SetCertificates(username, ids); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set certificate identities for user %s: %v", username, ids)
+	writeJSON(w, http.StatusOK, certificatesRequest{Identities: ids})
+}
+
+func (s *Server) getAddresses(w http.ResponseWriter, r *http.Request) {
+	addrs, err := s.Users.Addresses(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, addressesRequest{Addresses: addrs})
+}
+
+func (s *Server) setAddresses(w http.ResponseWriter, r *http.Request) {
+	var req addressesRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	parsed, err := netguard.ParsePrefixes(req.Addresses)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var networks []netip.Prefix
+	addrs := []string{}
+	for _, n := range parsed {
+		if n.Bits() == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("address range %s covers every client", n))
+			return
+		}
+		if !slices.Contains(networks, n) {
+			networks = append(networks, n)
+			addrs = append(addrs, n.String())
+		}
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.SetAddresses(username, networks); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set client addresses for user %s: %v", username, addrs)
+	writeJSON(w, http.StatusOK, addressesRequest{Addresses: addrs})
+}
+
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.Users.Tokens(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	var req createTokenRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	username := r.PathValue("username")
+	token, created, err := s.Users.CreateToken(username, req.Name)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Created API token %d (%s) for user %s", created.ID, created.Name, username)
+	writeJSON(w, http.StatusCreated, createTokenResponse{APIToken: created, Token: token})
+}
+
+func (s *Server) deleteToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token id")
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.DeleteToken(username, id); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Deleted API token %d of user %s", id, username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := s.Users.Lockouts()
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lockouts)
+}
+
+func (s *Server) clearLockout(w http.ResponseWriter, r *http.Request) {
+	kind, key := r.PathValue("kind"), r.PathValue("key")
+	if kind != repo.LockoutUser && kind != repo.LockoutIP {
+		writeError(w, http.StatusBadRequest, "kind must be user or ip")
+		return
+	}
+	if kind == repo.LockoutIP {
+		addr, err := netip.ParseAddr(key)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid address %q", key))
+			return
+		}
+		key = addr.Unmap().String()
+	}
+
+	if err := s.Users.ClearLockout(kind, key); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Cleared lockout of %s %s", kind, key)
+	w.WriteHeader(http.StatusNoContent)
+}
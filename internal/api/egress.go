@@ -0,0 +1,126 @@
+package api
+
+import (
+	"awesomeProject11/internal/egress"
+	"awesomeProject11/internal/repo"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type egressPoolRequest struct {
+	Strategy  string   `json:"strategy"`
+	Addresses []string `json:"addresses"`
+}
+
+type userEgressRequest struct {
+	Address      string   `json:"address"`
+	Pool         string   `json:"pool"`
+	AllowedPools []string `json:"allowed_pools"`
+}
+
+// Pool names appear in usernames (alice-pool-dc1), so they are limited to
+// characters auth.ParseUsername accepts there.
+var poolName = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+
+func (s *Server) registerEgress(mux *http.ServeMux) {
+	mux.Handle("GET /egress/pools", s.admin(s.listEgressPools))
+	mux.Handle("PUT /egress/pools/{name}", s.admin(s.setEgressPool))
+	mux.Handle("DELETE /egress/pools/{name}", s.admin(s.deleteEgressPool))
+	mux.Handle("PUT /users/{username}/egress", s.admin(s.setUserEgress))
+}
+
+func (s *Server) listEgressPools(w http.ResponseWriter, r *http.Request) {
+	pools, err := s.Users.ListEgressPools()
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+func (s *Server) setEgressPool(w http.ResponseWriter, r *http.Request) {
+	var req egressPoolRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if !poolName.MatchString(r.PathValue("name")) {
+		writeError(w, http.StatusBadRequest, "pool name may only contain letters, digits and '_'")
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = string(egress.RoundRobin)
+	}
+	if !egress.ValidStrategy(egress.Strategy(req.Strategy)) {
+		writeError(w, http.StatusBadRequest, "strategy must be one of fixed, round_robin, random")
+		return
+	}
+	addrs, err := egress.ParseAddresses(req.Addresses)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(addrs) == 0 {
+		writeError(w, http.StatusBadRequest, "addresses must not be empty")
+		return
+	}
+
+	pool := repo.EgressPool{Name: r.PathValue("name"), Strategy: req.Strategy}
+	for _, addr := range addrs {
+		pool.Addresses = append(pool.Addresses, addr.String())
+	}
+	if err := s.Users.SetEgressPool(pool); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set egress pool %s: %s %s", pool.Name, pool.Strategy, strings.Join(pool.Addresses, ","))
+	writeJSON(w, http.StatusOK, pool)
+}
+
+func (s *Server) deleteEgressPool(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.Users.DeleteEgressPool(name); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Deleted egress pool %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setUserEgress assigns an address or a pool. An empty body field pair
+// returns the user to the host's default address.
+func (s *Server) setUserEgress(w http.ResponseWriter, r *http.Request) {
+	var req userEgressRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Address != "" && req.Pool != "" {
+		writeError(w, http.StatusBadRequest, "set either address or pool, not both")
+		return
+	}
+	if req.Address != "" {
+		addrs, err := egress.ParseAddresses([]string{req.Address})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Address = addrs[0].String()
+	}
+
+	for _, name := range req.AllowedPools {
+		if !poolName.MatchString(name) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid pool name %q", name))
+			return
+		}
+	}
+
+	username := r.PathValue("username")
+	if err := s.Users.SetEgress(username, req.Address, req.Pool, req.AllowedPools); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	log.Printf("[API] Set egress for user %s: address=%q pool=%q allowed=%v", username, req.Address, req.Pool, req.AllowedPools)
+	s.getUser(w, r)
+}
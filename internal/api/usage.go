@@ -0,0 +1,192 @@
+package api
+
+import (
+	"awesomeProject11/internal/repo"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultUsageRange = 30 * 24 * time.Hour
+	defaultTopUsers   = 10
+	maxTopUsers       = 1000
+)
+
+func (s *Server) registerUsage(mux *http.ServeMux) {
+	mux.Handle("GET /users/{username}/usage", s.admin(s.userUsage))
+	mux.Handle("GET /users/{username}/usage/live", s.admin(s.liveUsage))
+	mux.Handle("GET /users/{username}/usage/periods", s.admin(s.usagePeriods))
+	mux.Handle("GET /usage/top", s.admin(s.topUsers))
+}
+
+// userUsage serves ?from=&to=&interval=hour|day|month&format=json|csv.
+func (s *Server) userUsage(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseRange(w, r)
+	if !ok {
+		return
+	}
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if !repo.UsageIntervals[interval] {
+		writeError(w, http.StatusBadRequest, "interval must be one of hour, day, month")
+		return
+	}
+
+	username := r.PathValue("username")
+	buckets, err := s.Usage.UsageByInterval(username, interval, from, to)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		records := [][]string{{"username", "period_start", "bytes_used"}}
+		for _, b := range buckets {
+			records = append(records, []string{username, b.Start.Format(time.RFC3339), strconv.FormatInt(b.BytesUsed, 10)})
+		}
+		writeCSV(w, fmt.Sprintf("usage-%s-%s.csv", username, interval), records)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"username": username,
+		"interval": interval,
+		"from":     from,
+		"to":       to,
+		"usage":    buckets,
+	})
+}
+
+func (s *Server) liveUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.Usage.LiveUsage(r.PathValue("username"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		writeCSV(w, "usage-live-"+usage.Username+".csv", [][]string{
+			{"username", "data_used_bytes", "data_limit_bytes"},
+			{usage.Username, strconv.FormatInt(usage.DataUsedBytes, 10), strconv.FormatInt(usage.DataLimitBytes, 10)},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// usagePeriods lists closed billing periods.
+func (s *Server) usagePeriods(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	periods, err := s.Usage.Periods(username)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		records := [][]string{{"username", "period_start", "period_end", "bytes_used"}}
+		for _, p := range periods {
+			records = append(records, []string{username, p.Start.Format(time.RFC3339), p.End.Format(time.RFC3339), strconv.FormatInt(p.BytesUsed, 10)})
+		}
+		writeCSV(w, "usage-periods-"+username+".csv", records)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"username": username,
+		"periods":  periods,
+	})
+}
+
+// topUsers serves ?from=&to=&limit=N&format=json|csv.
+func (s *Server) topUsers(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseRange(w, r)
+	if !ok {
+		return
+	}
+	n := defaultTopUsers
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxTopUsers {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxTopUsers))
+			return
+		}
+		n = parsed
+	}
+
+	users, err := s.Usage.TopUsers(from, to, n)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		records := [][]string{{"rank", "username", "bytes_used"}}
+		for i, u := range users {
+			records = append(records, []string{strconv.Itoa(i + 1), u.Username, strconv.FormatInt(u.BytesUsed, 10)})
+		}
+		writeCSV(w, "usage-top.csv", records)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"from":  from,
+		"to":    to,
+		"users": users,
+	})
+}
+
+// parseRange reads RFC 3339 or YYYY-MM-DD from and to parameters. The range
+// defaults to the last 30 days.
+func parseRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	to := time.Now().UTC()
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return time.Time{}, time.Time{}, false
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultUsageRange)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return time.Time{}, time.Time{}, false
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv"
+}
+
+func writeCSV(w http.ResponseWriter, filename string, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(records); err != nil {
+		log.Printf("failed to write data: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantOK   bool
+		wantFrom string
+		wantTo   string
+	}{
+		{"from=2026-01-01&to=2026-02-01", true, "2026-01-01T00:00:00Z", "2026-02-01T00:00:00Z"},
+		{"from=2026-01-01T10:00:00%2B02:00&to=2026-01-02", true, "2026-01-01T08:00:00Z", "2026-01-02T00:00:00Z"},
+		{"to=2026-03-31", true, "2026-03-01T00:00:00Z", "2026-03-31T00:00:00Z"},
+		{"from=2026-02-01&to=2026-01-01", false, "", ""},
+		{"from=2026-01-01&to=2026-01-01", false, "", ""},
+		{"from=yesterday", false, "", ""},
+		{"to=2026-13-01", false, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		from, to, ok := parseRange(w, httptest.NewRequest("GET", "/usage/top?"+tt.query, nil))
+		if ok != tt.wantOK {
+			t.Errorf("%s: ok = %v, want %v (%d %s)", tt.query, ok, tt.wantOK, w.Code, w.Body)
+			continue
+		}
+		if !ok {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: status %d, want %d", tt.query, w.Code, http.StatusBadRequest)
+			}
+			continue
+		}
+		if got := from.Format(time.RFC3339); got != tt.wantFrom {
+			t.Errorf("%s: from = %s, want %s", tt.query, got, tt.wantFrom)
+		}
+		if got := to.Format(time.RFC3339); got != tt.wantTo {
+			t.Errorf("%s: to = %s, want %s", tt.query, got, tt.wantTo)
+		}
+	}
+}
+
+func TestParseRangeDefaultsToLast30Days(t *testing.T) {
+	from, to, ok := parseRange(httptest.NewRecorder(), httptest.NewRequest("GET", "/usage/top", nil))
+	if !ok || to.Sub(from) != defaultUsageRange || time.Since(to) > time.Minute {
+		t.Errorf("parseRange() = %s, %s, %v, want the 30 days up to now", from, to, ok)
+	}
+}
+
+func TestUsageQueryValidation(t *testing.T) {
+	srv, _, _ := newTestAPI(t)
+
+	for _, path := range []string{
+		"/users/alice/usage?interval=week",
+		"/users/alice/usage?from=2026-02-01&to=2026-01-01",
+		"/usage/top?limit=0",
+		"/usage/top?limit=1001",
+		"/usage/top?limit=ten",
+	} {
+		if status, _ := call(t, srv, "GET", path, ""); status != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", path, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUserUsageGrouping(t *testing.T) {
+	srv, mock, _ := newTestAPI(t)
+
+	from, _ := time.Parse(time.DateOnly, "2026-01-01")
+	to, _ := time.Parse(time.DateOnly, "2026-01-03")
+	mock.ExpectQuery(regexp.QuoteMeta("date_trunc($1")).
+		WithArgs("hour", "alice", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"bucket", "sum"}).
+			AddRow(from, int64(100)).
+			AddRow(from.Add(time.Hour), int64(250)))
+
+	req, _ := http.NewRequest("GET", srv.URL+"/users/alice/usage?interval=hour&from=2026-01-01&to=2026-01-03&format=csv", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+
+	want := "username,period_start,bytes_used\n" +
+		"alice,2026-01-01T00:00:00Z,100\n" +
+		"alice,2026-01-01T01:00:00Z,250\n"
+	if resp.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("got %d %q, want %q", resp.StatusCode, body, want)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "usage-alice-hour.csv") {
+		t.Errorf("Content-Disposition = %q", resp.Header.Get("Content-Disposition"))
+	}
+}
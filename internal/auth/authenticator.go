@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Request is what the proxy knows about a client when it authenticates it.
+// Front ends fill in what their protocol carries.
+type Request struct {
+	// Username and Password are Basic or SOCKS5 credentials, HasPassword
+	// tells whether any were sent.
+	Username    string
+	Password    string
+	HasPassword bool
+	// Token is a bearer token from Proxy-Authorization.
+	Token string
+	// RemoteAddr is the client's address.
+	RemoteAddr netip.Addr
+	// Certificate is the client certificate the TLS listener verified.
+	Certificate *x509.Certificate
+}
+
+// FromHTTP collects the credentials of a proxy request.
+func FromHTTP(r *http.Request) *Request {
+	req := &Request{RemoteAddr: ClientAddr(r.RemoteAddr), Token: ExtractToken(r)}
+	req.Username, req.Password, req.HasPassword = ExtractCredentials(r)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		req.Certificate = r.TLS.VerifiedChains[0][0]
+	}
+	return req
+}
+
+// ExtractToken returns the bearer token in Proxy-Authorization.
+func ExtractToken(r *http.Request) string {
+	token, found := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// ClientAddr parses the address of a client from its host:port, the zero
+// Addr when it is not an IP address.
+func ClientAddr(hostport string) netip.Addr {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// Authenticator is one way of logging in.
+type Authenticator interface {
+	// Method is the name users.auth_methods allows it by.
+	Method() string
+	// Authenticate returns the login r carries. It reports false when r
+	// has no credentials of this kind or they are not valid.
+	Authenticate(r *Request) (Username, bool)
+}
+
+// Chain tries its authenticators in order, the first login wins.
+type Chain []Authenticator
+
+// Authenticate returns the first login and the method that accepted it.
+func (c Chain) Authenticate(r *Request) (login Username, method string, ok bool) {
+	for _, a := range c {
+		if login, ok := a.Authenticate(r); ok {
+			return login, a.Method(), true
+		}
+	}
+	return Username{}, "", false
+}
+
+// PasswordUsers checks passwords. Only users allowed MethodBasic pass.
+type PasswordUsers interface {
+	ValidateUser(username, password string) bool
+}
+
+// TokenUsers finds the user an API token belongs to. Only users allowed
+// MethodToken are returned.
+type TokenUsers interface {
+	UserByToken(token string) (username string, ok bool)
+}
+
+// AddressUsers finds the user a client address is registered to. Only
+// users allowed MethodIP are returned.
+type AddressUsers interface {
+	UserByAddress(addr netip.Addr) (username string, ok bool)
+}
+
+// CertificateUsers finds the user one of the identities of a client
+// certificate, most specific first, is registered to. Only users allowed
+// MethodMTLS are returned.
+type CertificateUsers interface {
+	UserByCertificate(identities []string) (username string, ok bool)
+}
+
+// Basic logs in with a username and password. The username may carry
+// options, see ParseUsername.
+type Basic struct {
+	Users PasswordUsers
+}
+
+func (b *Basic) Method() string { return MethodBasic }
+
+func (b *Basic) Authenticate(r *Request) (Username, bool) {
+	if !r.HasPassword {
+		return Username{}, false
+	}
+	login, err := ParseUsername(r.Username)
+	if err != nil || !b.Users.ValidateUser(login.Account, r.Password) {
+		return Username{}, false
+	}
+	return login, true
+}
+
+// Token logs in with an API token sent as "Proxy-Authorization: Bearer".
+type Token struct {
+	Users TokenUsers
+}
+
+func (t *Token) Method() string { return MethodToken }
+
+func (t *Token) Authenticate(r *Request) (Username, bool) {
+	if r.Token == "" {
+		return Username{}, false
+	}
+	username, ok := t.Users.UserByToken(r.Token)
+	return Username{Account: username}, ok
+}
+
+// ClientIP logs in clients connecting from an address registered to a
+// user, without credentials.
+type ClientIP struct {
+	Users AddressUsers
+}
+
+func (c *ClientIP) Method() string { return MethodIP }
+
+func (c *ClientIP) Authenticate(r *Request) (Username, bool) {
+	if !r.RemoteAddr.IsValid() {
+		return Username{}, false
+	}
+	username, ok := c.Users.UserByAddress(r.RemoteAddr)
+	return Username{Account: username}, ok
+}
+
+// MTLS logs in with a verified client certificate.
+type MTLS struct {
+	Users CertificateUsers
+}
+
+func (m *MTLS) Method() string { return MethodMTLS }
+
+func (m *MTLS) Authenticate(r *Request) (Username, bool) {
+	if r.Certificate == nil {
+		return Username{}, false
+	}
+	username, ok := m.Users.UserByCertificate(CertificateIdentities(r.Certificate))
+	return Username{Account: username}, ok
+}
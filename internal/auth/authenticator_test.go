@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+type fakeUsers struct{}
+
+func (fakeUsers) ValidateUser(username, password string) bool {
+	return username == "jonas" && password == "slaptas"
+}
+
+func (fakeUsers) UserByToken(token string) (string, bool) {
+	return "tokenas", token == "pxt_geras"
+}
+
+func (fakeUsers) UserByAddress(addr netip.Addr) (string, bool) {
+	return "adresas", addr == netip.MustParseAddr("10.0.0.7")
+}
+
+func TestFromHTTP(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.RemoteAddr = "[::ffff:10.0.0.7]:5000"
+	req.Header.Set("Proxy-Authorization", "Bearer pxt_geras")
+
+	got := FromHTTP(req)
+	if got.Token != "pxt_geras" || got.HasPassword {
+		t.Errorf("FromHTTP() = %+v, norėjome tik tokeno", got)
+	}
+	if got.RemoteAddr != netip.MustParseAddr("10.0.0.7") {
+		t.Errorf("RemoteAddr = %v, norėjome 10.0.0.7", got.RemoteAddr)
+	}
+}
+
+func TestChain(t *testing.T) {
+	users := fakeUsers{}
+	chain := Chain{&Token{Users: users}, &ClientIP{Users: users}, &Basic{Users: users}}
+	from := netip.MustParseAddr("10.0.0.7")
+
+	tests := []struct {
+		name       string
+		req        Request
+		wantUser   string
+		wantMethod string
+		wantOK     bool
+	}{
+		{"Tokenas", Request{Token: "pxt_geras", RemoteAddr: from}, "tokenas", MethodToken, true},
+		{"Adresas", Request{RemoteAddr: from}, "adresas", MethodIP, true},
+		{"Slaptažodis", Request{Username: "jonas-session-a1", Password: "slaptas", HasPassword: true}, "jonas", MethodBasic, true},
+		{"Blogas tokenas", Request{Token: "pxt_blogas"}, "", "", false},
+		{"Blogas slaptažodis", Request{Username: "jonas", Password: "x", HasPassword: true}, "", "", false},
+		{"Nieko", Request{}, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, method, ok := chain.Authenticate(&tt.req)
+			if ok != tt.wantOK || login.Account != tt.wantUser || method != tt.wantMethod {
+				t.Errorf("Authenticate() = %q, %q, %v, norėjome %q, %q, %v",
+					login.Account, method, ok, tt.wantUser, tt.wantMethod, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	token, err := NewToken()
+	if err != nil {
+		t.Fatalf("NewToken() klaida: %v", err)
+	}
+	other, _ := NewToken()
+	if token == other {
+		t.Error("NewToken() grąžino tą patį tokeną du kartus")
+	}
+	if HashToken(token) != HashToken(token) || HashToken(token) == HashToken(other) {
+		t.Error("HashToken() turėjo būti deterministinis ir skirtingas skirtingiems tokenams")
+	}
+}
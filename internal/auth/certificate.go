@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Authentication methods a user can be allowed in users.auth_methods.
+const (
+	MethodBasic = "basic"
+	MethodMTLS  = "mtls"
+	MethodToken = "token"
+	MethodIP    = "ip"
+)
+
+// ValidMethod reports whether m is a known authentication method.
+func ValidMethod(m string) bool {
+	switch m {
+	case MethodBasic, MethodMTLS, MethodToken, MethodIP:
+		return true
+	}
+	return false
+}
+
+// Identity prefixes of the names a client certificate is registered under.
+var identityKinds = []string{"uri:", "dns:", "email:", "cn:"}
+
+// CertificateIdentities lists the names cert can be registered under, most
+// specific first: SAN URIs (e.g. SPIFFE IDs), SAN DNS names, SAN emails and
+// finally the subject common name.
+func CertificateIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, "uri:"+u.String())
+	}
+	for _, name := range cert.DNSNames {
+		ids = append(ids, "dns:"+strings.ToLower(name))
+	}
+	for _, email := range cert.EmailAddresses {
+		ids = append(ids, "email:"+email)
+	}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, "cn:"+cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// NormalizeIdentity checks an identity given by an admin and returns it in
+// the form CertificateIdentities produces.
+func NormalizeIdentity(id string) (string, error) {
+	for _, kind := range identityKinds {
+		value, ok := strings.CutPrefix(id, kind)
+		if !ok {
+			continue
+		}
+		if strings.TrimSpace(value) == "" {
+			return "", fmt.Errorf("identity %q has no value", id)
+		}
+		if kind == "dns:" {
+			value = strings.ToLower(value)
+		}
+		return kind + value, nil
+	}
+	return "", fmt.Errorf("identity %q must start with uri:, dns:, email: or cn:", id)
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestCertificateIdentities(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://corp/billing")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing"},
+		URIs:           []*url.URL{spiffe},
+		DNSNames:       []string{"Billing.Internal"},
+		EmailAddresses: []string{"billing@corp.example"},
+	}
+
+	got := CertificateIdentities(cert)
+	want := []string{"uri:spiffe://corp/billing", "dns:billing.internal", "email:billing@corp.example", "cn:billing"}
+	if !slices.Equal(got, want) {
+		t.Errorf("CertificateIdentities() = %v, norėjome %v", got, want)
+	}
+}
+
+func TestNormalizeIdentity(t *testing.T) {
+	got, err := NormalizeIdentity("dns:Billing.Internal")
+	if err != nil || got != "dns:billing.internal" {
+		t.Errorf("NormalizeIdentity() = %q, %v, norėjome dns:billing.internal", got, err)
+	}
+	for _, id := range []string{"billing", "cn:", "ip:10.0.0.1"} {
+		if _, err := NormalizeIdentity(id); err == nil {
+			t.Errorf("NormalizeIdentity(%q) turėjo grąžinti klaidą", id)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns the bcrypt hash stored in the users.password column.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsPasswordHash reports whether stored is a bcrypt hash rather than a
+// legacy plaintext password.
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// VerifyPassword checks password against a stored bcrypt hash or, for rows
+// that have not been migrated yet, a legacy plaintext password. Both
+// comparisons run in constant time.
+func VerifyPassword(stored, password string) bool {
+	if IsPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
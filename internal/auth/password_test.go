@@ -0,0 +1,52 @@
+package auth
+
+import "testing"
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("HashPassword() klaida: %v", err)
+	}
+	if !IsPasswordHash(hash) {
+		t.Fatalf("IsPasswordHash(%q) = false, norėjome true", hash)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{
+			name:     "Teisingas slaptažodis",
+			stored:   hash,
+			password: "secret",
+			want:     true,
+		},
+		{
+			name:     "Blogas slaptažodis",
+			stored:   hash,
+			password: "wrong",
+			want:     false,
+		},
+		{
+			name:     "Senas nešifruotas slaptažodis",
+			stored:   "secret",
+			password: "secret",
+			want:     true,
+		},
+		{
+			name:     "Senas nešifruotas blogas slaptažodis",
+			stored:   "secret",
+			password: "secre",
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPassword(tt.stored, tt.password); got != tt.want {
+				t.Errorf("VerifyPassword() = %v, norėjome %v", got, tt.want)
+			}
+		})
+	}
+}
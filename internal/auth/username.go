@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSessionTTL applies to a sticky session without a ttl option.
+	DefaultSessionTTL = 10 * time.Minute
+	// MaxSessionTTL caps the ttl option.
+	MaxSessionTTL = 24 * time.Hour
+
+	maxSessionID = 64
+)
+
+// Username is a login name split into the account and the options clients
+// may append to it, e.g. alice-session-abc123-ttl-600-pool-dc1-ipv-6.
+type Username struct {
+	Account string
+	// Session pins the outbound address of every connection using the same
+	// ID for SessionTTL.
+	Session    string
+	SessionTTL time.Duration
+	// Pool selects one of the account's egress pools.
+	Pool string
+	// IPVersion is 4 or 6 to only reach destinations over that protocol,
+	// 0 for either.
+	IPVersion int
+}
+
+var errOptionValue = errors.New("invalid value")
+
+// ParseUsername splits raw into the account and its options. Options
+// follow the account as -key-value pairs; a name that does not end in
+// valid pairs is taken as a plain account name.
+func ParseUsername(raw string) (Username, error) {
+	parts := strings.Split(raw, "-")
+
+	for i := 1; i < len(parts); i++ {
+		if !isOption(parts[i]) || (len(parts)-i)%2 != 0 {
+			continue
+		}
+		u := Username{Account: strings.Join(parts[:i], "-")}
+		if err := u.setOptions(parts[i:]); err != nil {
+			return Username{}, err
+		}
+		return u, nil
+	}
+	return Username{Account: raw}, nil
+}
+
+// HasOptions reports whether name would be read as an account with
+// options, which makes it unusable as an account name.
+func HasOptions(name string) bool {
+	u, err := ParseUsername(name)
+	return err != nil || u.Account != name
+}
+
+func isOption(key string) bool {
+	switch key {
+	case "session", "ttl", "pool", "ipv":
+		return true
+	}
+	return false
+}
+
+func (u *Username) setOptions(pairs []string) error {
+	seen := make(map[string]bool)
+	for i := 0; i < len(pairs); i += 2 {
+		key, value := pairs[i], pairs[i+1]
+		if !isOption(key) {
+			return fmt.Errorf("unknown username option %q", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("username option %q given twice", key)
+		}
+		seen[key] = true
+
+		if err := u.setOption(key, value); err != nil {
+			return fmt.Errorf("username option %s: %v", key, err)
+		}
+	}
+
+	if u.SessionTTL != 0 && u.Session == "" {
+		return errors.New("username option ttl needs a session")
+	}
+	if u.Session != "" && u.SessionTTL == 0 {
+		u.SessionTTL = DefaultSessionTTL
+	}
+	return nil
+}
+
+func (u *Username) setOption(key, value string) error {
+	switch key {
+	case "session":
+		if len(value) > maxSessionID || !isIdentifier(value) {
+			return errOptionValue
+		}
+		u.Session = value
+	case "ttl":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return errOptionValue
+		}
+		u.SessionTTL = min(time.Duration(seconds)*time.Second, MaxSessionTTL)
+	case "pool":
+		if !isIdentifier(value) {
+			return errOptionValue
+		}
+		u.Pool = value
+	case "ipv":
+		switch value {
+		case "4":
+			u.IPVersion = 4
+		case "6":
+			u.IPVersion = 6
+		default:
+			return errOptionValue
+		}
+	}
+	return nil
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want Username
+	}{
+		{
+			name: "Paprastas vardas",
+			raw:  "alice",
+			want: Username{Account: "alice"},
+		},
+		{
+			name: "Vardas su brūkšneliu",
+			raw:  "my-shop",
+			want: Username{Account: "my-shop"},
+		},
+		{
+			name: "Sesija be ttl",
+			raw:  "alice-session-abc123",
+			want: Username{Account: "alice", Session: "abc123", SessionTTL: DefaultSessionTTL},
+		},
+		{
+			name: "Visi parametrai",
+			raw:  "my-shop-session-x1-ttl-600-pool-dc1-ipv-6",
+			want: Username{Account: "my-shop", Session: "x1", SessionTTL: 600 * time.Second, Pool: "dc1", IPVersion: 6},
+		},
+		{
+			name: "Per ilgas ttl",
+			raw:  "alice-session-a-ttl-999999",
+			want: Username{Account: "alice", Session: "a", SessionTTL: MaxSessionTTL},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUsername(tt.raw)
+			if err != nil {
+				t.Fatalf("ParseUsername(%q) klaida: %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseUsername(%q) = %+v, norėjome %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUsernameKlaidos(t *testing.T) {
+	for _, raw := range []string{
+		"alice-ttl-600",
+		"alice-ipv-5",
+		"alice-session-a-session-b",
+		"alice-session-a.b",
+		"alice-session-a-ttl-0",
+		"alice-session-a-color-red",
+	} {
+		if _, err := ParseUsername(raw); err == nil {
+			t.Errorf("ParseUsername(%q) turėjo grąžinti klaidą", raw)
+		}
+	}
+}
+
+func TestHasOptions(t *testing.T) {
+	if HasOptions("my-shop") {
+		t.Error("HasOptions(\"my-shop\") = true, norėjome false")
+	}
+	if !HasOptions("shop-pool-dc1") {
+		t.Error("HasOptions(\"shop-pool-dc1\") = false, norėjome true")
+	}
+}
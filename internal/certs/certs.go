@@ -0,0 +1,225 @@
+// Package certs serves TLS certificates loaded from PEM files. Certificates
+// are picked by the SNI name the client asks for and reloaded when their
+// files change, so a renewed certificate is used without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pair is a certificate chain and its private key.
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+type loaded struct {
+	cert    *tls.Certificate
+	version string
+}
+
+// Store holds the certificates of a TLS listener.
+type Store struct {
+	pairs    []Pair
+	interval time.Duration
+
+	// reloadMu keeps the ticker and SIGHUP from reloading at once.
+	reloadMu sync.Mutex
+
+	mu     sync.RWMutex
+	loaded []loaded
+	names  map[string]*tls.Certificate
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewStore loads pairs. The first pair is served to clients that send no
+// SNI name or one no certificate covers. Start checks the files every
+// interval.
+func NewStore(pairs []Pair, interval time.Duration) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+	s := &Store{
+		pairs:    pairs,
+		interval: interval,
+		loaded:   make([]loaded, len(pairs)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for i, p := range pairs {
+		l, err := load(p)
+		if err != nil {
+			return nil, err
+		}
+		s.loaded[i] = l
+	}
+	s.index()
+	return s, nil
+}
+
+// TLSConfig returns a server configuration using the store. HTTP/2 is not
+// offered because CONNECT tunnels need the raw connection.
+func (s *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: s.GetCertificate,
+	}
+}
+
+// GetCertificate picks the certificate for the SNI name in hello.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := s.names[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.loaded[0].cert, nil
+}
+
+// Reload loads the pairs whose files changed. A pair that fails to load
+// keeps its previous certificate.
+func (s *Store) Reload() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	changed := false
+	for i, p := range s.pairs {
+		s.mu.RLock()
+		current := s.loaded[i].version
+		s.mu.RUnlock()
+
+		if v, err := version(p); err != nil || v == current {
+			continue
+		}
+		l, err := load(p)
+		if err != nil {
+			log.Printf("Failed to reload certificate %s, keeping the current one: %v", p.CertFile, err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.loaded[i] = l
+		s.mu.Unlock()
+		changed = true
+		log.Printf("Reloaded certificate %s (%s, expires %s)", p.CertFile, describe(l.cert.Leaf), l.cert.Leaf.NotAfter.Format(time.DateOnly))
+	}
+	if changed {
+		s.index()
+	}
+}
+
+// Start checks the certificate files every interval until Stop is called.
+func (s *Store) Start() {
+	defer close(s.done)
+	if s.interval <= 0 {
+		<-s.stop
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.Reload()
+		}
+	}
+}
+
+// Stop ends the file checks and waits for Start to return.
+func (s *Store) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+// index maps every name the certificates cover to its certificate. Earlier
+// pairs win when names overlap.
+func (s *Store) index() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make(map[string]*tls.Certificate)
+	for _, l := range s.loaded {
+		for _, name := range l.cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok {
+				names[name] = l.cert
+			}
+		}
+	}
+	s.names = names
+}
+
+func load(p Pair) (loaded, error) {
+	v, err := version(p)
+	if err != nil {
+		return loaded{}, err
+	}
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return loaded{}, fmt.Errorf("failed to load %s: %v", p.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return loaded{}, fmt.Errorf("failed to parse %s: %v", p.CertFile, err)
+		}
+	}
+	return loaded{cert: &cert, version: v}, nil
+}
+
+// version identifies the current contents of a pair's files.
+func version(p Pair) (string, error) {
+	var parts []string
+	for _, name := range []string{p.CertFile, p.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// LoadCAs reads a PEM file of CA certificates.
+func LoadCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+func describe(leaf *x509.Certificate) string {
+	if len(leaf.DNSNames) > 0 {
+		return strings.Join(leaf.DNSNames, ", ")
+	}
+	return leaf.Subject.CommonName
+}
@@ -0,0 +1,133 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for names to dir.
+func writePair(t *testing.T, dir, file string, names ...string) Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	p := Pair{CertFile: filepath.Join(dir, file+".crt"), KeyFile: filepath.Join(dir, file+".key")}
+	if err := os.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return p
+}
+
+func servedName(t *testing.T, s *Store, sni string) string {
+	t.Helper()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q) failed: %v", sni, err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestSNISelection(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore([]Pair{
+		writePair(t, dir, "default", "proxy.example.com"),
+		writePair(t, dir, "eu", "eu.proxy.example.net"),
+		writePair(t, dir, "wildcard", "*.example.org"),
+	}, 0)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+
+	tests := []struct {
+		sni  string
+		want string
+	}{
+		{"proxy.example.com", "proxy.example.com"},
+		{"EU.proxy.example.net.", "eu.proxy.example.net"},
+		{"us.example.org", "*.example.org"},
+		{"a.b.example.org", "proxy.example.com"},
+		{"", "proxy.example.com"},
+		{"unknown.test", "proxy.example.com"},
+	}
+	for _, tt := range tests {
+		if got := servedName(t, s, tt.sni); got != tt.want {
+			t.Errorf("SNI %q served %s, want %s", tt.sni, got, tt.want)
+		}
+	}
+}
+
+func TestReloadOnRotation(t *testing.T) {
+	dir := t.TempDir()
+	p := writePair(t, dir, "proxy", "old.example.com")
+	s, err := NewStore([]Pair{p}, 0)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+
+	writePair(t, dir, "proxy", "new.example.com")
+	// Make sure the change is visible even on coarse file system clocks.
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(p.CertFile, later, later)
+	s.Reload()
+
+	if got := servedName(t, s, "new.example.com"); got != "new.example.com" {
+		t.Errorf("expected the rotated certificate, got %s", got)
+	}
+}
+
+func TestReloadKeepsCertificateOnError(t *testing.T) {
+	dir := t.TempDir()
+	p := writePair(t, dir, "proxy", "proxy.example.com")
+	s, err := NewStore([]Pair{p}, 0)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+
+	// Half way through a rotation: the key no longer matches.
+	if err := os.WriteFile(p.KeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	s.Reload()
+
+	if got := servedName(t, s, "proxy.example.com"); got != "proxy.example.com" {
+		t.Errorf("expected the previous certificate to stay, got %s", got)
+	}
+}
+
+func TestNewStoreRejectsMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewStore([]Pair{{CertFile: filepath.Join(dir, "a.crt"), KeyFile: filepath.Join(dir, "a.key")}}, 0); err == nil {
+		t.Error("expected an error for missing files")
+	}
+}
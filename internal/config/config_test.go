@@ -0,0 +1,122 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadFileOverDefaults(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  http: ":9000"
+redis:
+  password: secret
+limits:
+  tunnel_timeout: 10m
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Listen.HTTP != ":9000" || cfg.Listen.SOCKS5 != ":1080" {
+		t.Errorf("unexpected listen config: %+v", cfg.Listen)
+	}
+	if cfg.Redis.Password != "secret" {
+		t.Errorf("expected redis password from file, got %q", cfg.Redis.Password)
+	}
+	if cfg.Limits.TunnelTimeout != 10*time.Minute {
+		t.Errorf("expected tunnel timeout 10m, got %s", cfg.Limits.TunnelTimeout)
+	}
+	if cfg.Cache.TTL != time.Hour {
+		t.Errorf("expected default cache ttl, got %s", cfg.Cache.TTL)
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  socks5: ":1081"
+shutdown_timeout: 5s
+`)
+	t.Setenv("SOCKS5_PORT", "2080")
+	t.Setenv("SHUTDOWN_TIMEOUT", "1m")
+	t.Setenv("REDIS_PASSWORD", "fromenv")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Listen.SOCKS5 != ":2080" {
+		t.Errorf("expected SOCKS5_PORT override, got %q", cfg.Listen.SOCKS5)
+	}
+	if cfg.ShutdownTimeout != time.Minute {
+		t.Errorf("expected SHUTDOWN_TIMEOUT override, got %s", cfg.ShutdownTimeout)
+	}
+	if cfg.Redis.Password != "fromenv" {
+		t.Errorf("expected REDIS_PASSWORD override, got %q", cfg.Redis.Password)
+	}
+}
+
+func TestLoadRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Unknown duration", "cache:\n  ttl: soon\n", "failed to parse"},
+		{"Zero tunnel timeout", "limits:\n  tunnel_timeout: 0s\n", "limits.tunnel_timeout"},
+		{"Idle above open", "postgres:\n  max_open_conns: 5\n  max_idle_conns: 10\n", "postgres.max_idle_conns"},
+		{"Fast logger", "logger:\n  flush_interval: 10ms\n", "logger.flush_interval"},
+		{"Bad SSRF range", "ssrf:\n  allow: [\"10.0.0.0/40\"]\n", "ssrf.allow"},
+		{"HTTPS without certificates", "listen:\n  https: \":8443\"\n", "tls.certificates"},
+		{"Upstream without port", "upstream:\n  proxies:\n    - url: http://10.0.0.5\n", "upstream.proxies[0]"},
+		{"Lockout delays reversed", "lockout:\n  base_delay: 1m\n  max_delay: 10s\n", "lockout.max_delay"},
+		{"Unknown auth method", "auth:\n  methods: [basic, kerberos]\n", "auth.methods[1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected an error for an explicitly given missing file")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.Limits.TunnelTimeout = time.Minute
+	next.Cache.TTL = time.Minute
+
+	if changed := current.RestartRequired(next); len(changed) != 0 {
+		t.Errorf("reloadable changes should not need a restart, got %v", changed)
+	}
+
+	next.Listen.HTTP = ":9999"
+	next.Redis.Addr = "other:6379"
+	changed := current.RestartRequired(next)
+	if strings.Join(changed, ",") != "listen,redis" {
+		t.Errorf("expected listen and redis to need a restart, got %v", changed)
+	}
+}
@@ -1,5 +1,12 @@
 package domain
 
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
 type User interface {
 	AddData(n int64)
 	IsOverDataLimit(limit int64) bool
@@ -12,3 +19,94 @@ type Repository interface {
 	ValidateUser(username, password string) bool
 	GetUserLimits(username string) (dataLimit int64, maxConnections int64)
 }
+
+// LoginLimiter slows down password guessing by locking out usernames and
+// client addresses after repeated failed logins. Empty values are not
+// tracked.
+type LoginLimiter interface {
+	// LoginLockedOut returns how long logins as username or from clientIP
+	// are still refused, 0 when they are not.
+	LoginLockedOut(username, clientIP string) (retryAfter time.Duration)
+	LoginFailed(username, clientIP string)
+	// LoginSucceeded forgets the failures of username.
+	LoginSucceeded(username string)
+}
+
+// RateLimiter paces a byte stream. WaitN blocks until n more bytes may pass
+// or ctx is done. AllowN takes n bytes only if they may pass right away, for
+// callers that drop traffic rather than wait for it.
+type RateLimiter interface {
+	WaitN(ctx context.Context, n int) error
+	AllowN(n int) bool
+}
+
+// Throttler hands out the bandwidth limiters of a user. A nil limiter means
+// the direction is not limited. Limiters of the same user share one budget
+// across all of the user's connections.
+type Throttler interface {
+	RateLimiters(username string) (upload RateLimiter, download RateLimiter)
+}
+
+// ConnectionRecord describes one tunnel, SOCKS5 session or plain HTTP
+// request after it has finished.
+type ConnectionRecord struct {
+	Username    string
+	ClientIP    string
+	Method      string
+	Target      string
+	StatusCode  int
+	BytesUp     int64
+	BytesDown   int64
+	Start       time.Time
+	Duration    time.Duration
+	CloseReason string
+}
+
+// AuditLog stores connection records. Record must not block the caller.
+type AuditLog interface {
+	Record(rec ConnectionRecord)
+}
+
+// AccessPolicy decides whether a user may reach target (host:port). reason
+// explains a denial. CheckAddress decides again for an address target
+// resolved to, so address rules also cover targets given by name.
+type AccessPolicy interface {
+	CheckDestination(username, target string) (allowed bool, reason string)
+	CheckAddress(username, target string, addr netip.Addr) (allowed bool, reason string)
+}
+
+// EgressSource picks the local address a connection to remote leaves from.
+// ok is false when it has no address of remote's family. Sources with the
+// same Key pick the same way, so they may share pooled connections.
+type EgressSource interface {
+	Key() string
+	LocalAddr(remote netip.Addr) (local netip.Addr, ok bool)
+}
+
+// EgressOptions are the choices a client made in its username.
+type EgressOptions struct {
+	// Pool selects one of the user's pools, empty for the default.
+	Pool string
+	// Session, when set, keeps the chosen addresses for SessionTTL across
+	// connections and proxy instances.
+	Session    string
+	SessionTTL time.Duration
+}
+
+// ErrPoolNotAllowed is returned for a pool the user may not use.
+var ErrPoolNotAllowed = errors.New("egress pool not allowed")
+
+// EgressPolicy returns the source of a user's outbound connections, or nil
+// when they leave from the host's default address.
+type EgressPolicy interface {
+	EgressSource(username string, opts EgressOptions) (EgressSource, error)
+}
+
+// SessionPinner keeps choices made for a sticky session, such as its
+// upstream proxy, across connections and proxy instances.
+type SessionPinner interface {
+	// PinSession returns the value of field pinned to the session, pinning
+	// candidate when there is none yet or valid rejects it. A session
+	// expires ttl after it started.
+	PinSession(username, session, field, candidate string, ttl time.Duration, valid func(string) bool) string
+}
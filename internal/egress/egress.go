@@ -0,0 +1,184 @@
+// Package egress chooses the local address outbound connections leave from.
+//
+// A user either has a single address or belongs to a pool. Pools hand out
+// their addresses with one of three strategies:
+//
+//	fixed        every user of the pool always uses the same address,
+//	             picked from the pool by username
+//	round_robin  each connection takes the next address
+//	random       each connection takes a random address
+//
+// Only addresses of the remote address family (IPv4 or IPv6) are
+// considered, so a dual-stack pool serves both kinds of destinations.
+package egress
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Strategy string
+
+const (
+	Fixed      Strategy = "fixed"
+	RoundRobin Strategy = "round_robin"
+	Random     Strategy = "random"
+)
+
+// ValidStrategy reports whether s is a known strategy.
+func ValidStrategy(s Strategy) bool {
+	switch s {
+	case Fixed, RoundRobin, Random:
+		return true
+	}
+	return false
+}
+
+// Pool is a named set of local addresses.
+type Pool struct {
+	Name      string
+	Strategy  Strategy
+	Addresses []netip.Addr
+}
+
+// Source is where the connections of one user leave from.
+type Source struct {
+	key      string
+	strategy Strategy
+	v4, v6   []netip.Addr
+	next     *atomic.Uint64
+}
+
+// Key identifies sources that pick from the same addresses the same way, so
+// connections dialed from one may be reused by another.
+func (s *Source) Key() string {
+	return s.key
+}
+
+// LocalAddr returns the address a connection to remote should leave from.
+// It reports false when the source has no address of remote's family.
+func (s *Source) LocalAddr(remote netip.Addr) (netip.Addr, bool) {
+	addrs := s.v6
+	if remote.Unmap().Is4() {
+		addrs = s.v4
+	}
+	switch {
+	case len(addrs) == 0:
+		return netip.Addr{}, false
+	case len(addrs) == 1:
+		return addrs[0], true
+	case s.strategy == Random:
+		return addrs[rand.IntN(len(addrs))], true
+	default:
+		return addrs[(s.next.Add(1)-1)%uint64(len(addrs))], true
+	}
+}
+
+// Contains reports whether addr is one of the source's addresses.
+func (s *Source) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return slices.Contains(s.v4, addr) || slices.Contains(s.v6, addr)
+}
+
+// Pick returns one address per family the source has, chosen the way
+// LocalAddr chooses them.
+func (s *Source) Pick() []netip.Addr {
+	var picked []netip.Addr
+	for _, remote := range []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()} {
+		if addr, ok := s.LocalAddr(remote); ok {
+			picked = append(picked, addr)
+		}
+	}
+	return picked
+}
+
+// Selector builds sources. It keeps the round-robin position of every pool,
+// so one selector should be shared by all connections.
+type Selector struct {
+	mu       sync.Mutex
+	counters map[string]*atomic.Uint64
+}
+
+func NewSelector() *Selector {
+	return &Selector{counters: make(map[string]*atomic.Uint64)}
+}
+
+// Fixed returns a source that always uses addrs, at most one per family.
+func (s *Selector) Fixed(addrs ...netip.Addr) *Source {
+	return newSource(Fixed, addrs, nil)
+}
+
+// Pool returns the source of username in pool.
+func (s *Selector) Pool(pool Pool, username string) *Source {
+	if pool.Strategy != Fixed {
+		return newSource(pool.Strategy, pool.Addresses, s.counter(pool.Name))
+	}
+
+	// A fixed user gets one address per family, chosen by a hash of the
+	// username so it stays the same on every proxy instance.
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(username))
+	sum := h.Sum32()
+
+	src := newSource(Fixed, pool.Addresses, nil)
+	var picked []netip.Addr
+	for _, addrs := range [][]netip.Addr{src.v4, src.v6} {
+		if len(addrs) > 0 {
+			picked = append(picked, addrs[sum%uint32(len(addrs))])
+		}
+	}
+	return newSource(Fixed, picked, nil)
+}
+
+func (s *Selector) counter(pool string) *atomic.Uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[pool]
+	if !ok {
+		c = new(atomic.Uint64)
+		s.counters[pool] = c
+	}
+	return c
+}
+
+func newSource(strategy Strategy, addrs []netip.Addr, next *atomic.Uint64) *Source {
+	src := &Source{strategy: strategy, next: next}
+	if src.next == nil {
+		src.next = new(atomic.Uint64)
+	}
+
+	names := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			src.v4 = append(src.v4, addr)
+		} else {
+			src.v6 = append(src.v6, addr)
+		}
+		names = append(names, addr.String())
+	}
+	src.key = fmt.Sprintf("%s:%s", strategy, strings.Join(names, ","))
+	return src
+}
+
+// ParseAddresses parses a list of local addresses.
+func ParseAddresses(values []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, v := range values {
+		addr, err := netip.ParseAddr(v)
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid address %q", v)
+		}
+		if addr.IsUnspecified() || addr.IsMulticast() {
+			return nil, fmt.Errorf("%s cannot be used as a source address", v)
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
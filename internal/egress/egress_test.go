@@ -0,0 +1,96 @@
+package egress
+
+import (
+	"net/netip"
+	"testing"
+)
+
+var (
+	remote4 = netip.MustParseAddr("198.51.100.1")
+	remote6 = netip.MustParseAddr("2001:db8::1")
+)
+
+func addrs(values ...string) []netip.Addr {
+	out := make([]netip.Addr, len(values))
+	for i, v := range values {
+		out[i] = netip.MustParseAddr(v)
+	}
+	return out
+}
+
+func TestRoundRobinSharesPosition(t *testing.T) {
+	sel := NewSelector()
+	pool := Pool{Name: "dc1", Strategy: RoundRobin, Addresses: addrs("192.0.2.1", "192.0.2.2", "192.0.2.3")}
+
+	// Every lookup builds a new source, the position must survive that.
+	var got []string
+	for range 4 {
+		addr, ok := sel.Pool(pool, "alice").LocalAddr(remote4)
+		if !ok {
+			t.Fatal("expected an IPv4 address")
+		}
+		got = append(got, addr.String())
+	}
+	want := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("round robin order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFixedIsStablePerUser(t *testing.T) {
+	sel := NewSelector()
+	pool := Pool{Name: "dc1", Strategy: Fixed, Addresses: addrs("192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8:1::1")}
+
+	first, _ := sel.Pool(pool, "alice").LocalAddr(remote4)
+	for range 10 {
+		if addr, _ := sel.Pool(pool, "alice").LocalAddr(remote4); addr != first {
+			t.Fatalf("fixed address changed from %s to %s", first, addr)
+		}
+	}
+	if addr, ok := sel.Pool(pool, "alice").LocalAddr(remote6); !ok || addr.String() != "2001:db8:1::1" {
+		t.Errorf("expected the IPv6 address of the pool, got %s %v", addr, ok)
+	}
+}
+
+func mustLocal(t *testing.T, src *Source) netip.Addr {
+	t.Helper()
+	addr, ok := src.LocalAddr(remote4)
+	if !ok {
+		t.Fatal("expected an IPv4 address")
+	}
+	return addr
+}
+
+func TestRandomStaysInPool(t *testing.T) {
+	pool := Pool{Name: "dc1", Strategy: Random, Addresses: addrs("192.0.2.1", "192.0.2.2")}
+	src := NewSelector().Pool(pool, "alice")
+	for range 20 {
+		addr := mustLocal(t, src)
+		if addr != pool.Addresses[0] && addr != pool.Addresses[1] {
+			t.Fatalf("random picked %s outside the pool", addr)
+		}
+	}
+}
+
+func TestAddressFamilyMismatch(t *testing.T) {
+	src := NewSelector().Fixed(netip.MustParseAddr("192.0.2.1"))
+	if _, ok := src.LocalAddr(remote6); ok {
+		t.Error("an IPv4 source should not serve an IPv6 destination")
+	}
+	if addr, ok := src.LocalAddr(netip.MustParseAddr("::ffff:198.51.100.1")); !ok || addr.String() != "192.0.2.1" {
+		t.Errorf("an IPv4-mapped destination should use the IPv4 address, got %s %v", addr, ok)
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	if _, err := ParseAddresses([]string{"192.0.2.1", "2001:db8::5"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, bad := range []string{"192.0.2.0/24", "0.0.0.0", "fe80::1%eth0", "host"} {
+		if _, err := ParseAddresses([]string{bad}); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
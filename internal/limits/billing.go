@@ -0,0 +1,58 @@
+package limits
+
+import (
+	"fmt"
+	"time"
+)
+
+// Billing periods after which a user's data counter starts from zero.
+const (
+	PeriodNone    = "none"
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+)
+
+func ValidPeriod(period string) bool {
+	switch period {
+	case PeriodNone, PeriodDaily, PeriodWeekly, PeriodMonthly:
+		return true
+	}
+	return false
+}
+
+// PeriodBounds returns the UTC billing period [start, end) containing now.
+// Weekly periods start on the anchor's weekday and monthly periods on the
+// anchor's day of month, moved to the last day in shorter months. Daily
+// periods start at midnight UTC. PeriodNone has no bounds.
+func PeriodBounds(period string, anchor, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	anchor = anchor.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case PeriodDaily:
+		return today, today.AddDate(0, 0, 1), nil
+	case PeriodWeekly:
+		back := (int(today.Weekday()) - int(anchor.Weekday()) + 7) % 7
+		start := today.AddDate(0, 0, -back)
+		return start, start.AddDate(0, 0, 7), nil
+	case PeriodMonthly:
+		start := monthlyBoundary(now.Year(), now.Month(), anchor.Day())
+		if start.After(now) {
+			start = monthlyBoundary(now.Year(), now.Month()-1, anchor.Day())
+		}
+		end := monthlyBoundary(start.Year(), start.Month()+1, anchor.Day())
+		return start, end, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("no bounds for billing period %q", period)
+}
+
+func monthlyBoundary(year int, month time.Month, day int) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	last := first.AddDate(0, 1, -1).Day()
+	if day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
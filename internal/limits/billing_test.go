@@ -0,0 +1,89 @@
+package limits
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			t.Fatalf("bad date %s: %v", s, err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		name      string
+		period    string
+		anchor    string
+		now       time.Time
+		wantStart string
+		wantEnd   string
+	}{
+		{
+			name:      "Daily",
+			period:    PeriodDaily,
+			anchor:    "2024-01-15",
+			now:       time.Date(2024, 3, 10, 13, 30, 0, 0, time.UTC),
+			wantStart: "2024-03-10",
+			wantEnd:   "2024-03-11",
+		},
+		{
+			name:      "Weekly on anchor weekday",
+			period:    PeriodWeekly,
+			anchor:    "2024-01-03", // Wednesday
+			now:       time.Date(2024, 3, 10, 8, 0, 0, 0, time.UTC),
+			wantStart: "2024-03-06",
+			wantEnd:   "2024-03-13",
+		},
+		{
+			name:      "Monthly after anchor day",
+			period:    PeriodMonthly,
+			anchor:    "2023-11-15",
+			now:       time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC),
+			wantStart: "2024-03-15",
+			wantEnd:   "2024-04-15",
+		},
+		{
+			name:      "Monthly before anchor day",
+			period:    PeriodMonthly,
+			anchor:    "2023-11-15",
+			now:       time.Date(2024, 3, 14, 23, 59, 0, 0, time.UTC),
+			wantStart: "2024-02-15",
+			wantEnd:   "2024-03-15",
+		},
+		{
+			name:      "Monthly anchor clamped in short month",
+			period:    PeriodMonthly,
+			anchor:    "2024-01-31",
+			now:       time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC),
+			wantStart: "2024-02-29",
+			wantEnd:   "2024-03-31",
+		},
+		{
+			name:      "Monthly across year boundary",
+			period:    PeriodMonthly,
+			anchor:    "2024-05-20",
+			now:       time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+			wantStart: "2024-12-20",
+			wantEnd:   "2025-01-20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := PeriodBounds(tt.period, date(tt.anchor), tt.now)
+			if err != nil {
+				t.Fatalf("PeriodBounds() error: %v", err)
+			}
+			if !start.Equal(date(tt.wantStart)) || !end.Equal(date(tt.wantEnd)) {
+				t.Errorf("PeriodBounds() = [%s, %s), want [%s, %s)", start.Format(time.DateOnly), end.Format(time.DateOnly), tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+
+	if _, _, err := PeriodBounds(PeriodNone, date("2024-01-01"), time.Now()); err == nil {
+		t.Errorf("PeriodBounds(none) expected an error")
+	}
+}
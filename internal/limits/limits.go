@@ -3,24 +3,50 @@ package limits
 import (
 	"awesomeProject11/internal/domain"
 
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-const TimeLimit = 1 * time.Hour
+// DefaultTimeLimit is the longest a tunnel or request may stay open unless
+// configured otherwise.
+const DefaultTimeLimit = 1 * time.Hour
+
+var timeLimit atomic.Int64
+
+func init() {
+	timeLimit.Store(int64(DefaultTimeLimit))
+}
+
+// TimeLimit is the longest a tunnel or request may stay open. Changes only
+// affect connections opened afterwards.
+func TimeLimit() time.Duration {
+	return time.Duration(timeLimit.Load())
+}
+
+func SetTimeLimit(d time.Duration) {
+	timeLimit.Store(int64(d))
+}
+
+var ErrDataLimitExceeded = errors.New("data limit exceeded")
 
 type dataTrackingWriter struct {
-	user  domain.User
-	limit int64
-	wc    io.WriteCloser
+	ctx     context.Context
+	user    domain.User
+	limit   int64
+	limiter domain.RateLimiter
+	wc      io.WriteCloser
 }
 
 type dataTrackingReader struct {
-	user  domain.User
-	limit int64
-	rc    io.ReadCloser
+	ctx     context.Context
+	user    domain.User
+	limit   int64
+	limiter domain.RateLimiter
+	rc      io.ReadCloser
 }
 
 type NopCloserWriter struct {
@@ -32,7 +58,13 @@ func (n *NopCloserWriter) Close() error { return nil }
 func (d *dataTrackingWriter) Write(p []byte) (int, error) {
 
 	if d.user.IsOverDataLimit(d.limit) {
-		return 0, fmt.Errorf("data limit exceeded")
+		return 0, ErrDataLimitExceeded
+	}
+
+	if d.limiter != nil {
+		if err := d.limiter.WaitN(d.ctx, len(p)); err != nil {
+			return 0, err
+		}
 	}
 
 	n, err := d.wc.Write(p)
@@ -47,7 +79,7 @@ func (d *dataTrackingWriter) Write(p []byte) (int, error) {
 func (d *dataTrackingReader) Read(p []byte) (int, error) {
 
 	if d.user.IsOverDataLimit(d.limit) {
-		return 0, fmt.Errorf("data limit exceeded")
+		return 0, ErrDataLimitExceeded
 	}
 
 	n, err := d.rc.Read(p)
@@ -55,6 +87,11 @@ func (d *dataTrackingReader) Read(p []byte) (int, error) {
 
 		d.user.AddData(int64(n))
 
+		if d.limiter != nil {
+			if waitErr := d.limiter.WaitN(d.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
 	}
 	return n, err
 }
@@ -67,16 +104,40 @@ func (d *dataTrackingWriter) Close() error {
 	return d.wc.Close()
 }
 
-func NewTrackingWriter(user domain.User, wc io.WriteCloser) io.WriteCloser {
+// NewTrackingWriter counts every byte written against the user and fails
+// with ErrDataLimitExceeded once the user is over dataLimit. A dataLimit of 0
+// is unlimited.
+func NewTrackingWriter(user domain.User, dataLimit int64, wc io.WriteCloser) io.WriteCloser {
+	return NewThrottledWriter(context.Background(), user, dataLimit, nil, wc)
+}
+
+// NewTrackingReader is the reading side of NewTrackingWriter.
+func NewTrackingReader(user domain.User, dataLimit int64, rc io.ReadCloser) io.ReadCloser {
+	return NewThrottledReader(context.Background(), user, dataLimit, nil, rc)
+}
+
+// NewThrottledWriter is NewTrackingWriter that also paces writes with
+// limiter. A nil limiter does not throttle. A write waiting for the limiter
+// fails with ctx's error once ctx is done.
+func NewThrottledWriter(ctx context.Context, user domain.User, dataLimit int64, limiter domain.RateLimiter, wc io.WriteCloser) io.WriteCloser {
 	return &dataTrackingWriter{
-		user: user,
-		wc:   wc,
+		ctx:     ctx,
+		user:    user,
+		limit:   dataLimit,
+		limiter: limiter,
+		wc:      wc,
 	}
 }
 
-func NewTrackingReader(user domain.User, rc io.ReadCloser) io.ReadCloser {
+// NewThrottledReader is NewTrackingReader that also paces reads with
+// limiter. A nil limiter does not throttle. A read waiting for the limiter
+// fails with ctx's error once ctx is done.
+func NewThrottledReader(ctx context.Context, user domain.User, dataLimit int64, limiter domain.RateLimiter, rc io.ReadCloser) io.ReadCloser {
 	return &dataTrackingReader{
-		user: user,
-		rc:   rc,
+		ctx:     ctx,
+		user:    user,
+		limit:   dataLimit,
+		limiter: limiter,
+		rc:      rc,
 	}
 }
@@ -0,0 +1,134 @@
+package limits
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+type countingUser struct {
+	used int64
+}
+
+func (u *countingUser) AddData(n int64)                    { u.used += n }
+func (u *countingUser) IsOverDataLimit(limit int64) bool   { return limit > 0 && limit < u.used }
+func (u *countingUser) TryIncrementConnections(int64) bool { return true }
+func (u *countingUser) DecrementConnections()              {}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestTrackingWriterStopsAtDataLimit(t *testing.T) {
+	user := &countingUser{}
+	var dst bytes.Buffer
+	w := NewTrackingWriter(user, 100, nopWriteCloser{&dst})
+
+	chunk := make([]byte, 60)
+	for i := 0; i < 2; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	if _, err := w.Write(chunk); !errors.Is(err, ErrDataLimitExceeded) {
+		t.Fatalf("expected ErrDataLimitExceeded after %d bytes, got %v", user.used, err)
+	}
+	if dst.Len() != 120 {
+		t.Errorf("expected 120 bytes written, got %d", dst.Len())
+	}
+}
+
+func TestTrackingReaderWithoutLimit(t *testing.T) {
+	user := &countingUser{}
+	r := NewTrackingReader(user, 0, io.NopCloser(bytes.NewReader(make([]byte, 1000))))
+
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if n != 1000 || user.used != 1000 {
+		t.Errorf("expected 1000 bytes read and counted, got %d read and %d counted", n, user.used)
+	}
+}
+
+type recordingLimiter struct {
+	waits []int
+}
+
+func (l *recordingLimiter) WaitN(ctx context.Context, n int) error {
+	l.waits = append(l.waits, n)
+	return ctx.Err()
+}
+
+func (l *recordingLimiter) AllowN(n int) bool { return true }
+
+func TestThrottledWriterWaitsForEveryChunk(t *testing.T) {
+	limiter := &recordingLimiter{}
+	var dst bytes.Buffer
+	w := NewThrottledWriter(context.Background(), &countingUser{}, 0, limiter, nopWriteCloser{&dst})
+
+	for _, size := range []int{10, 4096, 1} {
+		if _, err := w.Write(make([]byte, size)); err != nil {
+			t.Fatalf("write of %d bytes failed: %v", size, err)
+		}
+	}
+	if want := []int{10, 4096, 1}; !slices.Equal(limiter.waits, want) {
+		t.Errorf("WaitN calls = %v, want %v", limiter.waits, want)
+	}
+	if dst.Len() != 4107 {
+		t.Errorf("expected 4107 bytes written, got %d", dst.Len())
+	}
+}
+
+func TestThrottledReaderWaitsForBytesRead(t *testing.T) {
+	limiter := &recordingLimiter{}
+	r := NewThrottledReader(context.Background(), &countingUser{}, 0, limiter, io.NopCloser(bytes.NewReader(make([]byte, 250))))
+
+	// The limiter is charged what was read, not the size of the buffer.
+	buf := make([]byte, 100)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+	}
+	if want := []int{100, 100, 50}; !slices.Equal(limiter.waits, want) {
+		t.Errorf("WaitN calls = %v, want %v", limiter.waits, want)
+	}
+}
+
+func TestThrottledWithoutLimiter(t *testing.T) {
+	user := &countingUser{}
+	src := bytes.Repeat([]byte("data"), 256)
+	var dst bytes.Buffer
+	w := NewThrottledWriter(context.Background(), user, 0, nil, nopWriteCloser{&dst})
+	r := NewThrottledReader(context.Background(), user, 0, nil, io.NopCloser(bytes.NewReader(src)))
+
+	if _, err := io.Copy(w, r); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if !bytes.Equal(dst.Bytes(), src) {
+		t.Error("expected the data to pass through unchanged")
+	}
+	if user.used != 2*int64(len(src)) {
+		t.Errorf("expected %d bytes counted, got %d", 2*len(src), user.used)
+	}
+}
+
+func TestThrottledWriterStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var dst bytes.Buffer
+	w := NewThrottledWriter(ctx, &countingUser{}, 0, &recordingLimiter{}, nopWriteCloser{&dst})
+
+	if _, err := w.Write(make([]byte, 10)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("expected nothing written, got %d bytes", dst.Len())
+	}
+}
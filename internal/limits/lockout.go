@@ -0,0 +1,32 @@
+package limits
+
+import "time"
+
+// LockoutPolicy decides how long logins are refused after repeated
+// failures. Usernames and client addresses are counted separately, each
+// against its own threshold.
+type LockoutPolicy struct {
+	// UserThreshold and IPThreshold are the failures in a row after which
+	// a username or client address is locked out. 0 does not lock out.
+	UserThreshold int
+	IPThreshold   int
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+	// The first lockout lasts BaseDelay, every further failure doubles it
+	// up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Delay returns how long to lock out after the given number of failures in
+// a row, 0 while they are below threshold.
+func (p LockoutPolicy) Delay(failures int64, threshold int) time.Duration {
+	if threshold <= 0 || failures < int64(threshold) {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := int64(threshold); i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
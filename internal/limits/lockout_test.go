@@ -0,0 +1,29 @@
+package limits
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	p := LockoutPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}
+
+	tests := []struct {
+		failures  int64
+		threshold int
+		want      time.Duration
+	}{
+		{4, 5, 0},
+		{5, 5, time.Second},
+		{6, 5, 2 * time.Second},
+		{9, 5, 16 * time.Second},
+		{11, 5, time.Minute},
+		{1000, 5, time.Minute},
+		{1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := p.Delay(tt.failures, tt.threshold); got != tt.want {
+			t.Errorf("Delay(%d, %d) = %v, want %v", tt.failures, tt.threshold, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// Label values shared by the proxy front ends.
+const (
+	MethodConnect = "CONNECT"
+	MethodHTTP    = "HTTP"
+	MethodSOCKS5  = "SOCKS5"
+	MethodUDP     = "SOCKS5_UDP"
+
+	LimitData        = "data"
+	LimitConnections = "connections"
+
+	Upload   = "upload"
+	Download = "download"
+)
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Proxy requests by method.",
+	}, []string{"method"})
+
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_auth_failures_total",
+		Help: "Failed proxy authentications by method.",
+	}, []string{"method"})
+
+	AuthLockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_auth_lockouts_total",
+		Help: "Proxy authentications refused because the username or client was locked out, by method.",
+	}, []string{"method"})
+
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_logins_total",
+		Help: "Successful proxy authentications by auth method.",
+	}, []string{"auth_method"})
+
+	LimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_limit_rejections_total",
+		Help: "Requests rejected by a user limit.",
+	}, []string{"limit"})
+
+	BytesTransferred = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_bytes_total",
+		Help: "Bytes relayed, upload is client to target.",
+	}, []string{"direction"})
+
+	DialDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_dial_duration_seconds",
+		Help:    "Time to connect to the target.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	AccessDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_access_denials_total",
+		Help: "Destinations refused by an access rule, by method.",
+	}, []string{"method"})
+
+	BlockedDestinations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_blocked_destinations_total",
+		Help: "Destinations refused because they resolve to an internal address, by method.",
+	}, []string{"method"})
+
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_errors_total",
+		Help: "Errors reaching the target by method.",
+	}, []string{"method"})
+
+	GatewayHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_gateway_healthy",
+		Help: "1 if the upstream proxy is in rotation, 0 if it is ejected.",
+	}, []string{"gateway"})
+
+	GatewayDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_gateway_dials_total",
+		Help: "Connections opened through an upstream proxy, by result (ok, refused, error).",
+	}, []string{"gateway", "result"})
+
+	ActiveTunnels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_active_tunnels",
+		Help: "Open CONNECT tunnels and SOCKS5 sessions.",
+	}, []string{"method"})
+
+	RepoCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_repo_call_duration_seconds",
+		Help:    "Latency of Redis and Postgres calls.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"backend", "operation"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObservePostgres records the duration of a Postgres call started at start.
+func ObservePostgres(operation string, start time.Time) {
+	RepoCallDuration.WithLabelValues("postgres", operation).Observe(time.Since(start).Seconds())
+}
+
+// RedisHook records the latency of every Redis command, labelled by command
+// name. Pipelines are recorded as a single "pipeline" operation.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RepoCallDuration.WithLabelValues("redis", cmd.Name()).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RepoCallDuration.WithLabelValues("redis", "pipeline").Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	counter prometheus.Counter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// CountWriter adds every byte written to wc to BytesTransferred.
+func CountWriter(wc io.WriteCloser, direction string) io.WriteCloser {
+	return &countingWriter{WriteCloser: wc, counter: BytesTransferred.WithLabelValues(direction)}
+}
+
+// CountReader adds every byte read from rc to BytesTransferred.
+func CountReader(rc io.ReadCloser, direction string) io.ReadCloser {
+	return &countingReader{ReadCloser: rc, counter: BytesTransferred.WithLabelValues(direction)}
+}
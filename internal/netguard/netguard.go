@@ -0,0 +1,178 @@
+// Package netguard keeps proxy traffic away from internal addresses.
+//
+// Names are resolved by the guard itself and only the vetted addresses are
+// dialed, so a name cannot resolve to a public address during the check and
+// to an internal one during the dial (DNS rebinding). The dialer's Control
+// hook checks the address of every socket once more before it connects.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+)
+
+// DefaultBlocked are the ranges no customer should reach: loopback,
+// private networks, link-local (including the 169.254.169.254 cloud
+// metadata service), carrier-grade NAT, NAT64 (which can reach any of the
+// IPv4 ranges), multicast and reserved space.
+var DefaultBlocked = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// ParsePrefixes parses CIDR ranges. A bare address is taken as a range of
+// one address.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address range %q", v)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// BlockedError is returned when a destination only resolves to blocked
+// addresses.
+type BlockedError struct {
+	Host string
+	Addr netip.Addr
+}
+
+func (e *BlockedError) Error() string {
+	if e.Host == e.Addr.String() {
+		return fmt.Sprintf("address %s is not allowed", e.Addr)
+	}
+	return fmt.Sprintf("%s resolves to %s, which is not allowed", e.Host, e.Addr)
+}
+
+// IsBlocked reports whether err was caused by a blocked destination.
+func IsBlocked(err error) bool {
+	var blocked *BlockedError
+	return errors.As(err, &blocked)
+}
+
+// Guard is a resolver and dial hook that refuses blocked addresses. The zero
+// value blocks nothing; use New.
+type Guard struct {
+	// Resolver looks up names, nil uses net.DefaultResolver.
+	Resolver *net.Resolver
+
+	mu      sync.RWMutex
+	blocked []netip.Prefix
+	allowed []netip.Prefix
+}
+
+// New returns a guard blocking DefaultBlocked plus extra, except for the
+// ranges in allowed.
+func New(extra, allowed []netip.Prefix) *Guard {
+	g := &Guard{}
+	g.SetRanges(extra, allowed)
+	return g
+}
+
+// SetRanges replaces the extra blocked and the allowed ranges. It is safe
+// to call while the guard is in use.
+func (g *Guard) SetRanges(extra, allowed []netip.Prefix) {
+	blocked := append(append([]netip.Prefix{}, DefaultBlocked...), extra...)
+
+	g.mu.Lock()
+	g.blocked = blocked
+	g.allowed = append([]netip.Prefix{}, allowed...)
+	g.mu.Unlock()
+}
+
+// Allowed reports whether addr may be reached. The zone of an IPv6 address
+// is ignored.
+func (g *Guard) Allowed(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, p := range g.allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	for _, p := range g.blocked {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve returns the addresses of host that may be reached. It fails with
+// a *BlockedError when every address is blocked. Addresses with a zone are
+// always refused, they only make sense on the proxy's own links.
+func (g *Guard) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Zone() != "" || !g.Allowed(addr) {
+			return nil, &BlockedError{Host: host, Addr: addr}
+		}
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	resolver := g.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	vetted := addrs[:0]
+	var blocked netip.Addr
+	for _, addr := range addrs {
+		if g.Allowed(addr) {
+			vetted = append(vetted, addr.Unmap())
+		} else {
+			blocked = addr.Unmap()
+		}
+	}
+	if len(vetted) == 0 {
+		return nil, &BlockedError{Host: host, Addr: blocked}
+	}
+	return vetted, nil
+}
+
+// Control refuses to connect a socket to a blocked address, whatever path
+// the address took to get here. It can be used as net.Dialer.Control.
+func (g *Guard) Control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("unexpected dial address %q", address)
+	}
+	if !g.Allowed(ap.Addr()) {
+		return &BlockedError{Host: ap.Addr().String(), Addr: ap.Addr().Unmap()}
+	}
+	return nil
+}
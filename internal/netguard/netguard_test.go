@@ -0,0 +1,95 @@
+package netguard
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	g := New(
+		[]netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		[]netip.Prefix{netip.MustParsePrefix("10.1.2.3/32")},
+	)
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.20.0.5", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"fe80::1%eth0", false},
+		{"::1%lo", false},
+		{"64:ff9b::7f00:1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"203.0.113.9", false},
+		{"10.1.2.3", true},
+	}
+
+	for _, tt := range tests {
+		if got := g.Allowed(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRefusesBlockedNames(t *testing.T) {
+	g := New(nil, nil)
+
+	_, err := g.Resolve(context.Background(), "localhost")
+	if !IsBlocked(err) {
+		t.Fatalf("expected localhost to be blocked, got %v", err)
+	}
+	if _, err := g.Resolve(context.Background(), "169.254.169.254"); !IsBlocked(err) {
+		t.Errorf("expected the metadata address to be blocked, got %v", err)
+	}
+	for _, host := range []string{"fe80::1%eth0", "::1%lo", "2001:4860:4860::8888%eth0"} {
+		if _, err := g.Resolve(context.Background(), host); !IsBlocked(err) {
+			t.Errorf("expected the zoned address %s to be refused, got %v", host, err)
+		}
+	}
+
+	g.SetRanges(nil, []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")})
+	addrs, err := g.Resolve(context.Background(), "127.0.0.1")
+	if err != nil || len(addrs) != 1 {
+		t.Fatalf("expected an allowed range to resolve, got %v, %v", addrs, err)
+	}
+}
+
+func TestControlChecksDialedAddress(t *testing.T) {
+	g := New(nil, nil)
+	if err := g.Control("tcp4", "127.0.0.1:80", nil); !IsBlocked(err) {
+		t.Errorf("expected the socket address to be refused, got %v", err)
+	}
+	if err := g.Control("tcp4", "8.8.8.8:53", nil); err != nil {
+		t.Errorf("expected a public address to pass, got %v", err)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := ParsePrefixes([]string{"10.0.0.1", "192.168.1.7/16", "::ffff:1.2.3.4"})
+	if err != nil {
+		t.Fatalf("ParsePrefixes failed: %v", err)
+	}
+	want := []string{"10.0.0.1/32", "192.168.0.0/16", "1.2.3.4/32"}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, p, want[i])
+		}
+	}
+	if _, err := ParsePrefixes([]string{"example.com"}); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+}
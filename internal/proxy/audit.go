@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/limits"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Close reasons stored in connection records.
+const (
+	reasonCompleted       = "completed"
+	reasonClientClosed    = "client_closed"
+	reasonTargetClosed    = "target_closed"
+	reasonTimeout         = "timeout"
+	reasonIdleTimeout     = "idle_timeout"
+	reasonDataLimit       = "data_limit"
+	reasonConnectionLimit = "connection_limit"
+	reasonAccessDenied    = "access_denied"
+	reasonBlockedAddress  = "blocked_address"
+	reasonDialError       = "dial_error"
+	reasonUpstreamError   = "upstream_error"
+	reasonError           = "error"
+)
+
+// connAudit collects one connection record while the connection is open.
+type connAudit struct {
+	server *Server
+	rec    domain.ConnectionRecord
+	up     atomic.Int64
+	down   atomic.Int64
+}
+
+func (s *Server) startAudit(username, clientAddr, method, target string) *connAudit {
+	clientIP := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		clientIP = host
+	}
+	return &connAudit{
+		server: s,
+		rec: domain.ConnectionRecord{
+			Username: username,
+			ClientIP: clientIP,
+			Method:   method,
+			Target:   target,
+			Start:    time.Now(),
+		},
+	}
+}
+
+// finish sends the record to the audit log, if one is configured.
+func (a *connAudit) finish(statusCode int, reason string) {
+	if a.server.Audit == nil {
+		return
+	}
+	rec := a.rec
+	rec.StatusCode = statusCode
+	rec.CloseReason = reason
+	rec.BytesUp = a.up.Load()
+	rec.BytesDown = a.down.Load()
+	rec.Duration = time.Since(rec.Start)
+	a.server.Audit.Record(rec)
+}
+
+func (a *connAudit) countUp(wc io.WriteCloser) io.WriteCloser {
+	return &auditWriter{WriteCloser: wc, n: &a.up}
+}
+
+func (a *connAudit) countDown(wc io.WriteCloser) io.WriteCloser {
+	return &auditWriter{WriteCloser: wc, n: &a.down}
+}
+
+func (a *connAudit) countUpReader(rc io.ReadCloser) io.ReadCloser {
+	return &auditReader{ReadCloser: rc, n: &a.up}
+}
+
+type auditWriter struct {
+	io.WriteCloser
+	n *atomic.Int64
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+type auditReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// copyCloseReason explains why one direction of a tunnel stopped. closed is
+// the reason used when the source simply reached EOF.
+func copyCloseReason(err error, closed string) string {
+	switch {
+	case err == nil:
+		return closed
+	case errors.Is(err, limits.ErrDataLimitExceeded):
+		return reasonDataLimit
+	case os.IsTimeout(err):
+		return reasonTimeout
+	default:
+		return reasonError
+	}
+}
+
+func limitCloseReason(err error) string {
+	if errors.Is(err, errDataLimit) {
+		return reasonDataLimit
+	}
+	return reasonConnectionLimit
+}
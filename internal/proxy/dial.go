@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/metrics"
+	"awesomeProject11/internal/netguard"
+	"awesomeProject11/internal/upstream"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+var (
+	errEgressUnavailable = errors.New("outbound address unavailable")
+	// errEgressWithUpstream refuses users with outbound addresses when
+	// connections go through upstream proxies, which pick their own.
+	errEgressWithUpstream = errors.New("outbound addresses cannot be used through upstream proxies")
+)
+
+// route is how the connections of a session leave the proxy.
+type route struct {
+	// src picks the local address, nil for the host's default.
+	src domain.EgressSource
+	// ipVersion limits destinations to IPv4 or IPv6 addresses, 0 allows
+	// both.
+	ipVersion int
+	// upstreamKey is what a sticky upstream pool pins the session's
+	// connections on.
+	upstreamKey string
+	// upstream is the upstream pinned to the session, tried first.
+	upstream string
+	// user is whose access rules vet the addresses destinations resolve
+	// to, empty when there are no access rules.
+	user string
+}
+
+// key identifies routes whose connections are interchangeable.
+func (rt route) key() string {
+	key := fmt.Sprintf("ipv%d", rt.ipVersion)
+	if rt.src != nil {
+		key += "/" + rt.src.Key()
+	}
+	if rt.upstreamKey != "" {
+		key += "/upstream:" + rt.upstreamKey
+	}
+	if rt.upstream != "" {
+		key += "/via:" + rt.upstream
+	}
+	if rt.user != "" {
+		// Pooled connections were vetted against one user's rules.
+		key += "/user:" + rt.user
+	}
+	return key
+}
+
+// route returns how the session's connections leave the proxy.
+func (s *Server) route(sess *session) (route, error) {
+	rt := route{ipVersion: sess.login.IPVersion}
+	if s.ACL != nil {
+		rt.user = sess.username
+	}
+	if s.Upstream != nil {
+		// The connection would leave from the upstream's address, so
+		// egress pools and addresses are refused rather than ignored.
+		if sess.login.Pool != "" {
+			log.Printf("[EGRESS] User: %s | pool %q not allowed through upstream proxies", sess.username, sess.login.Pool)
+			return rt, domain.ErrPoolNotAllowed
+		}
+		if err := s.checkNoEgress(sess.username); err != nil {
+			return rt, err
+		}
+		if s.Upstream.Sticky() {
+			rt.upstreamKey = sess.username
+			if sess.login.Session != "" {
+				rt.upstreamKey += "/" + sess.login.Session
+			}
+		}
+		if sess.login.Session != "" && s.Sessions != nil {
+			rt.upstream = s.Sessions.PinSession(sess.username, sess.login.Session, "upstream",
+				s.Upstream.Choose(rt.upstreamKey), sess.login.SessionTTL, s.Upstream.Healthy)
+		}
+		return rt, nil
+	}
+	if s.Egress == nil {
+		return rt, nil
+	}
+
+	src, err := s.Egress.EgressSource(sess.username, domain.EgressOptions{
+		Pool:       sess.login.Pool,
+		Session:    sess.login.Session,
+		SessionTTL: sess.login.SessionTTL,
+	})
+	if errors.Is(err, domain.ErrPoolNotAllowed) {
+		log.Printf("[EGRESS] User: %s | pool %q not allowed", sess.username, sess.login.Pool)
+		return rt, err
+	}
+	if err != nil {
+		log.Printf("Failed to load egress settings for %s: %v", sess.username, err)
+		return rt, errEgressUnavailable
+	}
+	rt.src = src
+	return rt, nil
+}
+
+// checkNoEgress fails when the user has an outbound address or pool set.
+func (s *Server) checkNoEgress(username string) error {
+	if s.Egress == nil {
+		return nil
+	}
+	src, err := s.Egress.EgressSource(username, domain.EgressOptions{})
+	if err != nil {
+		log.Printf("Failed to load egress settings for %s: %v", username, err)
+		return errEgressUnavailable
+	}
+	if src != nil {
+		log.Printf("[EGRESS] User: %s | %v", username, errEgressWithUpstream)
+		return errEgressWithUpstream
+	}
+	return nil
+}
+
+// dialContext connects to addr over rt, through the guard if there is one.
+// The name is resolved here rather than by the dialer so the local address
+// can match the family of each remote address.
+func (s *Server) dialContext(ctx context.Context, network, addr string, rt route) (net.Conn, error) {
+	if s.Upstream != nil {
+		return s.dialUpstream(ctx, addr, rt)
+	}
+
+	var d net.Dialer
+	if rt.src == nil && rt.ipVersion == 0 && rt.user == "" && s.Guard == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := s.resolveRoute(ctx, host, port, rt)
+	if err != nil {
+		return nil, err
+	}
+	if s.Guard != nil {
+		d.Control = s.Guard.Control
+	}
+
+	var firstErr error
+	for _, remote := range remotes {
+		d.LocalAddr = nil
+		if rt.src != nil {
+			local, ok := rt.src.LocalAddr(remote)
+			if !ok {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("no outbound address for %s", remote)
+				}
+				continue
+			}
+			d.LocalAddr = &net.TCPAddr{IP: local.AsSlice()}
+		}
+
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(remote.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialUpstream connects to addr through the upstream pool. When the guard
+// or access rules vet the target or rt asks for one IP version, the
+// upstream is sent the addresses resolved here in turn, so it cannot
+// resolve the name to another one; the next address is tried when the
+// upstream cannot reach one. Otherwise it resolves the name itself.
+func (s *Server) dialUpstream(ctx context.Context, addr string, rt route) (net.Conn, error) {
+	if s.Guard == nil && rt.ipVersion == 0 && rt.user == "" {
+		return s.Upstream.DialContext(ctx, addr, rt.upstreamKey, rt.upstream)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := s.resolveRoute(ctx, host, port, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, remote := range remotes {
+		target := net.JoinHostPort(remote.String(), port)
+		conn, err := s.Upstream.DialContext(ctx, target, rt.upstreamKey, rt.upstream)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		// Other errors mean no upstream worked, another address will not
+		// help.
+		var targetErr *upstream.TargetError
+		if !errors.As(err, &targetErr) || ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// resolveRoute resolves host and keeps the addresses of rt's IP version
+// that rt's user may reach on port.
+func (s *Server) resolveRoute(ctx context.Context, host, port string, rt route) ([]netip.Addr, error) {
+	remotes, err := s.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if rt.ipVersion != 0 {
+		remotes = slices.DeleteFunc(remotes, func(a netip.Addr) bool {
+			return a.Is4() != (rt.ipVersion == 4)
+		})
+		if len(remotes) == 0 {
+			return nil, fmt.Errorf("%s has no IPv%d address", host, rt.ipVersion)
+		}
+	}
+	if rt.user != "" {
+		target := net.JoinHostPort(host, port)
+		var denied error
+		remotes = slices.DeleteFunc(remotes, func(a netip.Addr) bool {
+			err := s.checkAddress(rt.user, target, a)
+			if err != nil && denied == nil {
+				denied = err
+			}
+			return err != nil
+		})
+		if len(remotes) == 0 {
+			return nil, denied
+		}
+	}
+	return remotes, nil
+}
+
+// accessDeniedError is a resolved address the access rules refuse.
+type accessDeniedError struct {
+	reason string
+}
+
+func (e *accessDeniedError) Error() string {
+	return e.reason
+}
+
+func isAccessDenied(err error) bool {
+	var denied *accessDeniedError
+	return errors.As(err, &denied)
+}
+
+// checkAddress applies the user's access rules to an address target
+// resolved to, and logs and counts a denial.
+func (s *Server) checkAddress(username, target string, addr netip.Addr) error {
+	allowed, reason := s.ACL.CheckAddress(username, target, addr)
+	if allowed {
+		return nil
+	}
+	log.Printf("[ACL] User: %s | Server: %s (%s) | %s", username, target, addr, reason)
+	return &accessDeniedError{reason: reason}
+}
+
+func (s *Server) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if s.Guard != nil {
+		return s.Guard.Resolve(ctx, host)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// dialTarget connects to the target of a tunnel and records the dial
+// latency. method labels failures in the upstream error metric.
+func (s *Server) dialTarget(method, addr string, sess *session) (net.Conn, error) {
+	rt, err := s.route(sess)
+	if errors.Is(err, domain.ErrPoolNotAllowed) {
+		return nil, err
+	}
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(method).Inc()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.TimeLimit())
+	defer cancel()
+
+	start := time.Now()
+	conn, err := s.dialContext(ctx, "tcp", addr, rt)
+	metrics.DialDuration.Observe(time.Since(start).Seconds())
+
+	if blocked := s.blocked(method, addr, err); blocked != nil {
+		return nil, blocked
+	}
+	if isAccessDenied(err) {
+		metrics.AccessDenials.WithLabelValues(method).Inc()
+		return nil, err
+	}
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(method).Inc()
+	}
+	return conn, err
+}
+
+// blocked returns the refusal wrapped in err when the guard refused
+// target, and logs and counts it.
+func (s *Server) blocked(method, target string, err error) *netguard.BlockedError {
+	var blocked *netguard.BlockedError
+	if !errors.As(err, &blocked) {
+		return nil
+	}
+	metrics.BlockedDestinations.WithLabelValues(method).Inc()
+	log.Printf("[SSRF] Server: %s | %v", target, blocked)
+	return blocked
+}
@@ -4,22 +4,72 @@ import (
 	"awesomeProject11/internal/auth"
 	"awesomeProject11/internal/domain"
 	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/metrics"
+	"awesomeProject11/internal/netguard"
+	"awesomeProject11/internal/upstream"
+	"context"
 	"errors"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type Server struct {
 	Repo domain.Repository
+	// Auth authenticates clients, trying each method in order. Nil checks
+	// Basic credentials against Repo.
+	Auth auth.Chain
+	// Lockout refuses logins after repeated failures. Nil disables
+	// lockouts.
+	Lockout domain.LoginLimiter
+	// Throttle limits per-user bandwidth. Nil disables throttling.
+	Throttle domain.Throttler
+	// Audit receives a record of every connection. Nil disables auditing.
+	Audit domain.AuditLog
+	// ACL decides which destinations users may reach. Nil allows all.
+	ACL domain.AccessPolicy
+	// Guard refuses destinations that resolve to internal addresses. Nil
+	// dials any address.
+	Guard *netguard.Guard
+	// Egress picks the local address of outbound connections. Nil uses the
+	// host's default address. With Upstream, connections of users with an
+	// outbound address or pool, and logins asking for a pool, are refused.
+	Egress domain.EgressPolicy
+	// Upstream sends outbound connections through other proxies. Nil
+	// connects to targets directly.
+	Upstream *upstream.Pool
+	// Sessions pins the upstream of a sticky session, so its connections
+	// use one upstream across proxy instances. Nil leaves every connection
+	// to the pool's strategy.
+	Sessions domain.SessionPinner
+	// Transport tunes plain HTTP forwarding. Nil uses
+	// DefaultTransportOptions.
+	Transport *TransportOptions
+
+	active connTracker
+
+	transportsMu    sync.Mutex
+	transports      map[string]*routeTransport
+	transportsSwept time.Time
 }
 
 func (s *Server) ProxyHandler(w http.ResponseWriter, r *http.Request) {
 
+	metrics.Requests.WithLabelValues(requestMethod(r)).Inc()
+
+	if !s.active.begin() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.active.end()
+
 	if r.Method == http.MethodConnect {
 		s.HandleHTTPSRequests(w, r)
 	} else {
@@ -27,9 +77,7 @@ func (s *Server) ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) tunnelConn(dst io.WriteCloser, src io.ReadCloser, user domain.User, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+func (s *Server) tunnelConn(ctx context.Context, dst io.WriteCloser, src io.ReadCloser, sess *session, rateLimiter domain.RateLimiter) error {
 	defer func() {
 		if closeError := dst.Close(); closeError != nil {
 			log.Printf("Tunnel close error: %v", closeError)
@@ -42,53 +90,260 @@ func (s *Server) tunnelConn(dst io.WriteCloser, src io.ReadCloser, user domain.U
 		}
 	}()
 
-	limiter := limits.NewTrackingWriter(user, dst)
+	limiter := limits.NewThrottledWriter(ctx, sess.user, sess.dataLimit, rateLimiter, dst)
 	_, err := io.Copy(limiter, src)
 	if err != nil {
 		log.Printf("Tunnel copy error: %v", err)
 	}
+	return err
+}
+
+// tunnel relays bytes between client and target until either side stops
+// or deadline passes and returns the close reason of the direction that
+// stopped first.
+func (s *Server) tunnel(clientConn, targetConn net.Conn, sess *session, audit *connAudit, deadline time.Time) string {
+	upload, download := s.rateLimiters(sess.username)
+
+	// A direction waiting for its rate limiter does not notice the
+	// connections closing, so it is stopped through ctx.
+	ctx, cancel := context.WithDeadline(s.active.forceContext(), deadline)
+	defer cancel()
+
+	reasons := make(chan string, 2)
+	go func() {
+		dst := audit.countUp(metrics.CountWriter(targetConn, metrics.Upload))
+		reasons <- copyCloseReason(s.tunnelConn(ctx, dst, clientConn, sess, upload), reasonClientClosed)
+	}()
+	go func() {
+		dst := audit.countDown(metrics.CountWriter(clientConn, metrics.Download))
+		reasons <- copyCloseReason(s.tunnelConn(ctx, dst, targetConn, sess, download), reasonTargetClosed)
+	}()
+
+	reason := <-reasons
+	cancel()
+	<-reasons
+	return reason
+}
+
+func requestMethod(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return metrics.MethodConnect
+	}
+	return metrics.MethodHTTP
+}
 
+// requestTarget returns host:port of the origin a proxy request is for.
+func requestTarget(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if r.URL.Scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
 }
 
-func (s *Server) authenticateUser(w http.ResponseWriter, r *http.Request) (domain.User, string, func(), bool) {
-	username, password, found := auth.ExtractCredentials(r)
+var (
+	errDataLimit       = errors.New("data limit has been reached")
+	errConnectionLimit = errors.New("connection limits has been reached")
+	errLockedOut       = errors.New("too many failed logins, try again later")
+)
 
-	if !found || !s.Repo.ValidateUser(username, password) {
+// session is an admitted user together with the data limit it was
+// admitted against. release gives the connection slot back.
+type session struct {
+	user  domain.User
+	login auth.Username
+	// username is login.Account, the name limits and records are kept
+	// under.
+	username  string
+	dataLimit int64
+	release   func()
+}
+
+func (s *Server) authenticateUser(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	login, retryAfter, ok := s.authenticate(auth.FromHTTP(r))
+	if retryAfter > 0 {
+		metrics.AuthLockouts.WithLabelValues(requestMethod(r)).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, errLockedOut.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	if !ok {
+		metrics.AuthFailures.WithLabelValues(requestMethod(r)).Inc()
 		w.Header().Set("Proxy-Authenticate", `Basic realm="Proxy"`)
 
 		http.Error(w, "Authentication error", http.StatusProxyAuthRequired)
-		return nil, "", nil, false
+		return nil, false
+	}
+	sess, err := s.acquireUser(login)
+	if err != nil {
+		s.startAudit(login.Account, r.RemoteAddr, r.Method, requestTarget(r)).finish(http.StatusTooManyRequests, limitCloseReason(err))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	return sess, true
+}
+
+// authenticate runs the authenticator chain over r. retryAfter is set
+// instead when the credentials' username or the client is locked out.
+func (s *Server) authenticate(r *auth.Request) (login auth.Username, retryAfter time.Duration, ok bool) {
+	chain := s.Auth
+	if chain == nil {
+		chain = auth.Chain{&auth.Basic{Users: s.Repo}}
+	}
+
+	// Only logins with credentials count, a client that has not sent any
+	// yet is not guessing.
+	tracked := s.Lockout != nil && (r.HasPassword || r.Token != "")
+	var account, clientIP string
+	if tracked {
+		account = lockoutAccount(r)
+		if r.RemoteAddr.IsValid() {
+			clientIP = r.RemoteAddr.String()
+		}
+		if retryAfter := s.Lockout.LoginLockedOut(account, clientIP); retryAfter > 0 {
+			return auth.Username{}, retryAfter, false
+		}
+	}
+
+	login, method, ok := chain.Authenticate(r)
+	if ok {
+		metrics.Logins.WithLabelValues(method).Inc()
+	}
+	if tracked {
+		// Only a correct password clears the account's failures. A wrong
+		// one counts even when another method lets the request in.
+		switch {
+		case !ok || passwordRefused(chain, r, method):
+			s.Lockout.LoginFailed(account, clientIP)
+		case method == auth.MethodBasic && login.Account == account:
+			s.Lockout.LoginSucceeded(account)
+		}
+	}
+	return login, 0, ok
+}
+
+// passwordRefused reports whether chain checked the password of r and
+// refused it before method accepted r.
+func passwordRefused(chain auth.Chain, r *auth.Request, method string) bool {
+	if !r.HasPassword {
+		return false
+	}
+	for _, a := range chain {
+		switch a.Method() {
+		case method:
+			return false
+		case auth.MethodBasic:
+			return true
+		}
+	}
+	return false
+}
+
+// lockoutAccount is the account failed logins with r count against, so
+// username options cannot be varied to dodge a lockout. Tokens only count
+// against the client address.
+func lockoutAccount(r *auth.Request) string {
+	if !r.HasPassword {
+		return ""
 	}
+	if login, err := auth.ParseUsername(r.Username); err == nil {
+		return login.Account
+	}
+	return r.Username
+}
+
+// acquireUser applies the data and connection limits of an already
+// authenticated user. It is shared by every front end so a user's quota is
+// the same no matter which protocol they connect with.
+func (s *Server) acquireUser(login auth.Username) (*session, error) {
+	username := login.Account
 	user := s.Repo.GetOrCreateUser(username)
 	dataLimit, maxConnections := s.Repo.GetUserLimits(username)
 
 	if user.IsOverDataLimit(dataLimit) {
-		http.Error(w, "Data limit has been reached", http.StatusTooManyRequests)
-		return nil, "", nil, false
+		metrics.LimitRejections.WithLabelValues(metrics.LimitData).Inc()
+		return nil, errDataLimit
 	}
 	if !user.TryIncrementConnections(maxConnections) {
-		http.Error(w, "Connection limits has been reached", http.StatusTooManyRequests)
-		return nil, "", nil, false
+		metrics.LimitRejections.WithLabelValues(metrics.LimitConnections).Inc()
+		return nil, errConnectionLimit
+	}
+	return &session{
+		user:      user,
+		login:     login,
+		username:  username,
+		dataLimit: dataLimit,
+		release:   user.DecrementConnections,
+	}, nil
+}
+
+// checkDestination applies the access rules to target before it is dialed
+// and logs denials. method labels the denial metric.
+func (s *Server) checkDestination(method, username, target string) (bool, string) {
+	if s.ACL == nil {
+		return true, ""
 	}
-	cleanup := func() {
-		user.DecrementConnections()
+	allowed, reason := s.ACL.CheckDestination(username, target)
+	if !allowed {
+		metrics.AccessDenials.WithLabelValues(method).Inc()
+		log.Printf("[ACL] User: %s | Server: %s | %s", username, target, reason)
 	}
-	return user, username, cleanup, true
+	return allowed, reason
+}
+
+// rateLimiters returns the user's upload (client to target) and download
+// (target to client) limiters.
+func (s *Server) rateLimiters(username string) (domain.RateLimiter, domain.RateLimiter) {
+	if s.Throttle == nil {
+		return nil, nil
+	}
+	return s.Throttle.RateLimiters(username)
 }
 
 func (s *Server) HandleHTTPSRequests(w http.ResponseWriter, r *http.Request) {
 
-	user, username, cleanup, ok := s.authenticateUser(w, r)
+	sess, ok := s.authenticateUser(w, r)
 
 	if !ok {
 		return
 	}
-	defer cleanup()
+	defer sess.release()
+	username := sess.username
 
 	log.Printf("[HTTPS] User: %s | Server: %s", username, r.Host)
 
-	targetConn, err := net.DialTimeout("tcp", r.Host, limits.TimeLimit)
+	audit := s.startAudit(username, r.RemoteAddr, http.MethodConnect, r.Host)
+
+	if allowed, reason := s.checkDestination(metrics.MethodConnect, username, requestTarget(r)); !allowed {
+		audit.finish(http.StatusForbidden, reasonAccessDenied)
+		http.Error(w, "Destination not allowed: "+reason, http.StatusForbidden)
+		return
+	}
+
+	targetConn, err := s.dialTarget(metrics.MethodConnect, r.Host, sess)
+	if errors.Is(err, domain.ErrPoolNotAllowed) {
+		audit.finish(http.StatusForbidden, reasonAccessDenied)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if netguard.IsBlocked(err) {
+		audit.finish(http.StatusForbidden, reasonBlockedAddress)
+		http.Error(w, "Destination not allowed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if isAccessDenied(err) {
+		audit.finish(http.StatusForbidden, reasonAccessDenied)
+		http.Error(w, "Destination not allowed: "+err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
+		audit.finish(http.StatusServiceUnavailable, reasonDialError)
 		http.Error(w, "User exceeded time limit", http.StatusServiceUnavailable)
 		return
 	}
@@ -102,15 +357,18 @@ func (s *Server) HandleHTTPSRequests(w http.ResponseWriter, r *http.Request) {
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
+		audit.finish(http.StatusInternalServerError, reasonError)
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 
 	clientConn, _, err := hj.Hijack()
 	if err != nil {
+		audit.finish(http.StatusServiceUnavailable, reasonError)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	defer s.active.attach(clientConn)()
 	defer func() {
 		err := clientConn.Close()
 
@@ -120,39 +378,40 @@ func (s *Server) HandleHTTPSRequests(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	if _, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		audit.finish(http.StatusOK, reasonClientClosed)
 		return
 	}
 
-	deadline := time.Now().Add(limits.TimeLimit)
+	metrics.ActiveTunnels.WithLabelValues(metrics.MethodConnect).Inc()
+	defer metrics.ActiveTunnels.WithLabelValues(metrics.MethodConnect).Dec()
+
+	deadline := time.Now().Add(limits.TimeLimit())
 
 	err = clientConn.SetDeadline(deadline)
 	if err != nil {
 		log.Printf("Failed to set deadline: %v", err)
+		audit.finish(http.StatusOK, reasonError)
 		return
 	}
 
 	err = targetConn.SetDeadline(deadline)
 	if err != nil {
 		log.Printf("Failed to set deadline: %v", err)
+		audit.finish(http.StatusOK, reasonError)
 		return
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go s.tunnelConn(targetConn, clientConn, user, &wg)
-	go s.tunnelConn(clientConn, targetConn, user, &wg)
-
-	wg.Wait()
+	audit.finish(http.StatusOK, s.tunnel(clientConn, targetConn, sess, audit, deadline))
 }
 
 func (s *Server) HandleHTTPRequests(w http.ResponseWriter, r *http.Request) {
-	user, username, cleanup, ok := s.authenticateUser(w, r)
+	sess, ok := s.authenticateUser(w, r)
 
 	if !ok {
 		return
 	}
-	defer cleanup()
+	defer sess.release()
+	username := sess.username
 
 	log.Printf("[HTTP] User: %s | Server: %s", username, r.Host)
 
@@ -163,9 +422,9 @@ func (s *Server) HandleHTTPRequests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for k, v := range r.Header {
-		req.Header[k] = v
-	}
+	req.ContentLength = r.ContentLength
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
 
 	if req.URL.Scheme == "" {
 		req.URL.Scheme = "http"
@@ -173,14 +432,55 @@ func (s *Server) HandleHTTPRequests(w http.ResponseWriter, r *http.Request) {
 	if req.URL.Host == "" {
 		req.URL.Host = r.Host
 	}
-	req.Header.Del("Proxy-Authorization")
+
+	audit := s.startAudit(username, r.RemoteAddr, r.Method, requestTarget(req))
+
+	if allowed, reason := s.checkDestination(metrics.MethodHTTP, username, requestTarget(req)); !allowed {
+		audit.finish(http.StatusForbidden, reasonAccessDenied)
+		http.Error(w, "Destination not allowed: "+reason, http.StatusForbidden)
+		return
+	}
+
+	upload, download := s.rateLimiters(username)
 
 	if req.Body != nil {
-		req.Body = limits.NewTrackingReader(user, req.Body)
+		req.Body = limits.NewThrottledReader(req.Context(), sess.user, sess.dataLimit, upload, audit.countUpReader(metrics.CountReader(req.Body, metrics.Upload)))
+	}
+
+	// Happy Eyeballs may dial several addresses at once, so starts are
+	// tracked per address.
+	var dialMu sync.Mutex
+	dialStarts := make(map[string]time.Time)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			dialMu.Lock()
+			dialStarts[addr] = time.Now()
+			dialMu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			dialMu.Lock()
+			start := dialStarts[addr]
+			dialMu.Unlock()
+			metrics.DialDuration.Observe(time.Since(start).Seconds())
+		},
+	}))
+
+	rt, err := s.route(sess)
+	if errors.Is(err, domain.ErrPoolNotAllowed) {
+		audit.finish(http.StatusForbidden, reasonAccessDenied)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(metrics.MethodHTTP).Inc()
+		audit.finish(http.StatusServiceUnavailable, reasonError)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
 
 	client := &http.Client{
-		Timeout: limits.TimeLimit,
+		Transport: s.httpTransport(rt),
+		Timeout:   limits.TimeLimit(),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -188,11 +488,26 @@ func (s *Server) HandleHTTPRequests(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := client.Do(req)
 	if err != nil {
+		if blocked := s.blocked(metrics.MethodHTTP, requestTarget(req), err); blocked != nil {
+			audit.finish(http.StatusForbidden, reasonBlockedAddress)
+			http.Error(w, "Destination not allowed: "+blocked.Error(), http.StatusForbidden)
+			return
+		}
+		var denied *accessDeniedError
+		if errors.As(err, &denied) {
+			metrics.AccessDenials.WithLabelValues(metrics.MethodHTTP).Inc()
+			audit.finish(http.StatusForbidden, reasonAccessDenied)
+			http.Error(w, "Destination not allowed: "+denied.Error(), http.StatusForbidden)
+			return
+		}
 		log.Printf("Proxy transport error: %v", err)
+		metrics.UpstreamErrors.WithLabelValues(metrics.MethodHTTP).Inc()
 		if os.IsTimeout(err) {
+			audit.finish(http.StatusServiceUnavailable, reasonTimeout)
 			http.Error(w, "User exceeded time limit", http.StatusServiceUnavailable)
 			return
 		}
+		audit.finish(http.StatusBadGateway, reasonUpstreamError)
 		http.Error(w, "Could not reach server: "+err.Error(), http.StatusBadGateway)
 		return
 	}
@@ -203,6 +518,7 @@ func (s *Server) HandleHTTPRequests(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	removeHopHeaders(resp.Header)
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
@@ -210,8 +526,10 @@ func (s *Server) HandleHTTPRequests(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	tracker := limits.NewTrackingWriter(user, &limits.NopCloserWriter{ResponseWriter: w})
-	if _, err = io.Copy(tracker, resp.Body); err != nil {
+	tracker := limits.NewThrottledWriter(req.Context(), sess.user, sess.dataLimit, download, audit.countDown(metrics.CountWriter(&limits.NopCloserWriter{ResponseWriter: w}, metrics.Download)))
+	_, err = io.Copy(tracker, resp.Body)
+	if err != nil {
 		log.Printf("Connection error: %v", err)
 	}
+	audit.finish(resp.StatusCode, copyCloseReason(err, reasonCompleted))
 }
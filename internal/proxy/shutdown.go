@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// connTracker keeps the handlers that are still running so Shutdown can wait
+// for them. Hijacked CONNECT tunnels and SOCKS5 sessions are not known to
+// http.Server, so their client connections are attached here to be closed
+// when the drain deadline passes.
+type connTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	conns   map[net.Conn]struct{}
+	closing bool
+	forced  bool
+	// force ends when the remaining connections are force-closed, so
+	// handlers waiting on something other than their connection stop too.
+	force       context.Context
+	cancelForce context.CancelFunc
+}
+
+// begin registers a handler. It fails once shutdown has started.
+func (t *connTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) end() {
+	t.wg.Done()
+}
+
+// attach makes conn part of the force close and returns a func that
+// detaches it again.
+func (t *connTracker) attach(conn net.Conn) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.forced {
+		_ = conn.Close()
+		return func() {}
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+	}
+}
+
+// forceContext returns a context that is cancelled by closeAll.
+func (t *connTracker) forceContext() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.initForce()
+	return t.force
+}
+
+func (t *connTracker) initForce() {
+	if t.force == nil {
+		t.force, t.cancelForce = context.WithCancel(context.Background())
+	}
+}
+
+func (t *connTracker) stopAccepting() {
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+}
+
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forced = true
+	t.initForce()
+	t.cancelForce()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	return len(t.conns)
+}
+
+// Shutdown stops new tunnels and SOCKS5 sessions and waits for the running
+// ones to finish. When ctx is done first the remaining client connections
+// are closed and Shutdown waits for their handlers to return, so connection
+// counters are released for everything that was cut off. Listeners are not
+// closed here; plain HTTP requests are drained by http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.active.stopAccepting()
+	defer s.closeIdleConnections()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutdown deadline reached, force-closing %d connections", s.active.closeAll())
+	<-drained
+	return ctx.Err()
+}
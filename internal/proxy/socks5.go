@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/metrics"
+	"awesomeProject11/internal/netguard"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929).
+const (
+	socks5Version     = 0x05
+	socks5AuthVersion = 0x01
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepCommandNotSupported = 0x07
+	socks5RepAddrNotSupported    = 0x08
+
+	socks5AuthSuccess = 0x00
+	socks5AuthFailure = 0x01
+)
+
+const socks5HandshakeTimeout = 30 * time.Second
+
+var errSOCKS5AddrType = errors.New("socks5: unsupported address type")
+
+// ServeSOCKS5 accepts SOCKS5 clients on l until the listener is closed.
+func (s *Server) ServeSOCKS5(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("SOCKS5 accept error: %v", err)
+				continue
+			}
+			return err
+		}
+		go s.handleSOCKS5(conn)
+	}
+}
+
+func (s *Server) handleSOCKS5(clientConn net.Conn) {
+	defer func() {
+		err := clientConn.Close()
+
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Client close error: %v", err)
+		}
+	}()
+
+	if !s.active.begin() {
+		return
+	}
+	defer s.active.end()
+	defer s.active.attach(clientConn)()
+
+	if err := clientConn.SetDeadline(time.Now().Add(socks5HandshakeTimeout)); err != nil {
+		log.Printf("Failed to set deadline: %v", err)
+		return
+	}
+
+	login, ok := s.socks5Authenticate(clientConn)
+	if !ok {
+		return
+	}
+
+	cmd, target, err := readSOCKS5Request(clientConn)
+	if err != nil {
+		if errors.Is(err, errSOCKS5AddrType) {
+			_ = writeSOCKS5Reply(clientConn, socks5RepAddrNotSupported, nil)
+		}
+		return
+	}
+
+	switch cmd {
+	case socks5CmdConnect:
+		metrics.Requests.WithLabelValues(metrics.MethodSOCKS5).Inc()
+		s.socks5Connect(clientConn, login, target)
+	case socks5CmdUDPAssociate:
+		metrics.Requests.WithLabelValues(metrics.MethodUDP).Inc()
+		s.socks5UDPAssociate(clientConn, login, target)
+	default:
+		_ = writeSOCKS5Reply(clientConn, socks5RepCommandNotSupported, nil)
+	}
+}
+
+// socks5Authenticate negotiates the auth method and runs the authenticator
+// chain. Clients offering "no authentication" are let in without
+// credentials when the chain accepts them by their address alone.
+func (s *Server) socks5Authenticate(conn net.Conn) (auth.Username, bool) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return auth.Username{}, false
+	}
+	if header[0] != socks5Version {
+		return auth.Username{}, false
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return auth.Username{}, false
+	}
+
+	req := &auth.Request{RemoteAddr: auth.ClientAddr(conn.RemoteAddr().String())}
+	if slices.Contains(methods, socks5MethodNoAuth) {
+		if login, _, ok := s.authenticate(req); ok {
+			if _, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth}); err != nil {
+				return auth.Username{}, false
+			}
+			return login, true
+		}
+	}
+	if !slices.Contains(methods, socks5MethodUserPass) {
+		_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return auth.Username{}, false
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodUserPass}); err != nil {
+		return auth.Username{}, false
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil || version[0] != socks5AuthVersion {
+		return auth.Username{}, false
+	}
+	username, err := readSOCKS5String(conn)
+	if err != nil {
+		return auth.Username{}, false
+	}
+	password, err := readSOCKS5String(conn)
+	if err != nil {
+		return auth.Username{}, false
+	}
+
+	req.Username, req.Password, req.HasPassword = username, password, true
+	login, retryAfter, ok := s.authenticate(req)
+	if !ok {
+		// RFC 1929 has no way to say when to retry.
+		if retryAfter > 0 {
+			metrics.AuthLockouts.WithLabelValues(metrics.MethodSOCKS5).Inc()
+		} else {
+			metrics.AuthFailures.WithLabelValues(metrics.MethodSOCKS5).Inc()
+		}
+		_, _ = conn.Write([]byte{socks5AuthVersion, socks5AuthFailure})
+		return auth.Username{}, false
+	}
+	if _, err := conn.Write([]byte{socks5AuthVersion, socks5AuthSuccess}); err != nil {
+		return auth.Username{}, false
+	}
+	return login, true
+}
+
+// socks5Connect handles a CONNECT request. Connection records of SOCKS5
+// sessions carry the SOCKS5 reply code as their status.
+func (s *Server) socks5Connect(clientConn net.Conn, login auth.Username, target string) {
+	username := login.Account
+	audit := s.startAudit(username, clientConn.RemoteAddr().String(), metrics.MethodSOCKS5, target)
+
+	if allowed, _ := s.checkDestination(metrics.MethodSOCKS5, username, target); !allowed {
+		audit.finish(socks5RepNotAllowed, reasonAccessDenied)
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+
+	sess, err := s.acquireUser(login)
+	if err != nil {
+		log.Printf("[SOCKS5] User: %s | rejected: %v", username, err)
+		audit.finish(socks5RepNotAllowed, limitCloseReason(err))
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+	defer sess.release()
+
+	log.Printf("[SOCKS5] User: %s | Server: %s", username, target)
+
+	targetConn, err := s.dialTarget(metrics.MethodSOCKS5, target, sess)
+	if errors.Is(err, domain.ErrPoolNotAllowed) {
+		audit.finish(socks5RepNotAllowed, reasonAccessDenied)
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+	if netguard.IsBlocked(err) {
+		audit.finish(socks5RepNotAllowed, reasonBlockedAddress)
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+	if isAccessDenied(err) {
+		audit.finish(socks5RepNotAllowed, reasonAccessDenied)
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+	if err != nil {
+		audit.finish(socks5RepHostUnreachable, reasonDialError)
+		_ = writeSOCKS5Reply(clientConn, socks5RepHostUnreachable, nil)
+		return
+	}
+	defer func() {
+		err := targetConn.Close()
+
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Target close error: %v", err)
+		}
+	}()
+
+	if err := writeSOCKS5Reply(clientConn, socks5RepSucceeded, targetConn.LocalAddr()); err != nil {
+		audit.finish(socks5RepSucceeded, reasonClientClosed)
+		return
+	}
+
+	metrics.ActiveTunnels.WithLabelValues(metrics.MethodSOCKS5).Inc()
+	defer metrics.ActiveTunnels.WithLabelValues(metrics.MethodSOCKS5).Dec()
+
+	deadline := time.Now().Add(limits.TimeLimit())
+
+	if err := clientConn.SetDeadline(deadline); err != nil {
+		log.Printf("Failed to set deadline: %v", err)
+		audit.finish(socks5RepSucceeded, reasonError)
+		return
+	}
+	if err := targetConn.SetDeadline(deadline); err != nil {
+		log.Printf("Failed to set deadline: %v", err)
+		audit.finish(socks5RepSucceeded, reasonError)
+		return
+	}
+
+	audit.finish(socks5RepSucceeded, s.tunnel(clientConn, targetConn, sess, audit, deadline))
+}
+
+func readSOCKS5String(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readSOCKS5Request reads VER CMD RSV and the destination address.
+func readSOCKS5Request(r io.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", fmt.Errorf("socks5: unsupported version %d", header[0])
+	}
+	target, err := readSOCKS5Addr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return header[1], target, nil
+}
+
+// readSOCKS5Addr reads ATYP DST.ADDR DST.PORT and returns it as host:port.
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		domain, err := readSOCKS5String(r)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		return "", errSOCKS5AddrType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSOCKS5Addr encodes addr as ATYP BND.ADDR BND.PORT. Unknown addresses
+// are encoded as 0.0.0.0:0.
+func appendSOCKS5Addr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSOCKS5Reply(w io.Writer, rep byte, bound net.Addr) error {
+	reply := appendSOCKS5Addr([]byte{socks5Version, rep, 0x00}, bound)
+	_, err := w.Write(reply)
+	return err
+}
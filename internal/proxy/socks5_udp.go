@@ -0,0 +1,500 @@
+package proxy
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/metrics"
+	"awesomeProject11/internal/netguard"
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const socks5CmdUDPAssociate = 0x03
+
+// UDPIdleTimeout closes a UDP association when no datagram has been relayed
+// in either direction for this long.
+const UDPIdleTimeout = 2 * time.Minute
+
+const maxUDPDatagram = 64 * 1024
+
+// udpResolveTimeout bounds the lookup of a datagram's destination.
+const udpResolveTimeout = 5 * time.Second
+
+// maxUDPDestinations bounds the destinations an association remembers, so
+// a client spraying datagrams at random hosts cannot grow it without limit.
+const maxUDPDestinations = 256
+
+// udpAssociation relays datagrams between one SOCKS5 client and any number
+// of remote hosts. Datagrams to remote hosts leave from the relay socket,
+// or from sockets bound to the outbound addresses of the user's egress
+// source.
+type udpAssociation struct {
+	user      domain.User
+	dataLimit int64
+	upload    domain.RateLimiter
+	download  domain.RateLimiter
+	relay     *net.UDPConn
+
+	// src picks the outbound address, nil sends from the relay.
+	src domain.EgressSource
+	// outbound are the sockets opened for src's addresses.
+	outbound map[netip.Addr]*net.UDPConn
+
+	// packets receives what the relay and the outbound sockets read, done
+	// stops their readers.
+	packets chan udpPacket
+	done    chan struct{}
+
+	// clientIP and clientPort restrict which source may use the relay.
+	// clientPort is 0 until the first datagram if the client did not
+	// announce it in the request.
+	clientIP   net.IP
+	clientPort int
+	client     *net.UDPAddr
+
+	// dests caches the access rule decision and address per destination.
+	// Only addresses in it may reply.
+	dests       *udpDestinations
+	checkTarget func(target string) bool
+
+	// audit records the first destination as the association's target.
+	audit *connAudit
+
+	// resolve looks up a destination host the way the session's TCP
+	// connections do, through the guard if there is one.
+	resolve func(ctx context.Context, host, port string) ([]netip.Addr, error)
+}
+
+// udpPacket is a datagram read from one of an association's sockets.
+type udpPacket struct {
+	data []byte
+	from *net.UDPAddr
+	conn *net.UDPConn
+	// err is set when reading the relay failed, which ends the
+	// association.
+	err error
+}
+
+func (s *Server) socks5UDPAssociate(clientConn net.Conn, login auth.Username, requested string) {
+	username := login.Account
+	audit := s.startAudit(username, clientConn.RemoteAddr().String(), metrics.MethodUDP, "")
+
+	if s.Upstream != nil {
+		// Upstream proxies are only spoken to over TCP, and datagrams sent
+		// directly would leave from the wrong address.
+		log.Printf("[SOCKS5-UDP] User: %s | rejected: UDP is not relayed through upstream proxies", username)
+		audit.finish(socks5RepNotAllowed, reasonAccessDenied)
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+
+	sess, err := s.acquireUser(login)
+	if err != nil {
+		log.Printf("[SOCKS5-UDP] User: %s | rejected: %v", username, err)
+		audit.finish(socks5RepNotAllowed, limitCloseReason(err))
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+	defer sess.release()
+
+	rt, err := s.route(sess)
+	if errors.Is(err, domain.ErrPoolNotAllowed) {
+		audit.finish(socks5RepNotAllowed, reasonAccessDenied)
+		_ = writeSOCKS5Reply(clientConn, socks5RepNotAllowed, nil)
+		return
+	}
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(metrics.MethodUDP).Inc()
+		audit.finish(socks5RepGeneralFailure, reasonError)
+		_ = writeSOCKS5Reply(clientConn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	upload, download := s.rateLimiters(username)
+
+	localAddr, _ := clientConn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, _ := clientConn.RemoteAddr().(*net.TCPAddr)
+	if localAddr == nil || remoteAddr == nil {
+		audit.finish(socks5RepGeneralFailure, reasonError)
+		_ = writeSOCKS5Reply(clientConn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		log.Printf("Failed to open UDP relay: %v", err)
+		audit.finish(socks5RepGeneralFailure, reasonError)
+		_ = writeSOCKS5Reply(clientConn, socks5RepGeneralFailure, nil)
+		return
+	}
+	defer func() {
+		err := relay.Close()
+
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("UDP relay close error: %v", err)
+		}
+	}()
+
+	assoc := &udpAssociation{
+		user:      sess.user,
+		dataLimit: sess.dataLimit,
+		upload:    upload,
+		download:  download,
+		relay:     relay,
+		src:       rt.src,
+		outbound:  make(map[netip.Addr]*net.UDPConn),
+		packets:   make(chan udpPacket),
+		done:      make(chan struct{}),
+		clientIP:  remoteAddr.IP,
+		dests:     newUDPDestinations(maxUDPDestinations),
+		checkTarget: func(target string) bool {
+			allowed, _ := s.checkDestination(metrics.MethodUDP, username, target)
+			return allowed
+		},
+		audit: audit,
+		resolve: func(ctx context.Context, host, port string) ([]netip.Addr, error) {
+			return s.resolveRoute(ctx, host, port, rt)
+		},
+	}
+	if host, port, err := net.SplitHostPort(requested); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			assoc.clientIP = ip
+		}
+		assoc.clientPort, _ = net.LookupPort("udp", port)
+	}
+
+	if err := writeSOCKS5Reply(clientConn, socks5RepSucceeded, relay.LocalAddr()); err != nil {
+		audit.finish(socks5RepSucceeded, reasonClientClosed)
+		return
+	}
+
+	log.Printf("[SOCKS5-UDP] User: %s | Relay: %s", username, relay.LocalAddr())
+
+	// The association lives as long as the TCP control connection, so
+	// closing either side tears the other down.
+	if err := clientConn.SetDeadline(time.Now().Add(limits.TimeLimit())); err != nil {
+		log.Printf("Failed to set deadline: %v", err)
+		audit.finish(socks5RepSucceeded, reasonError)
+		return
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+		_ = relay.Close()
+	}()
+
+	metrics.ActiveTunnels.WithLabelValues(metrics.MethodUDP).Inc()
+	defer metrics.ActiveTunnels.WithLabelValues(metrics.MethodUDP).Dec()
+
+	audit.finish(socks5RepSucceeded, assoc.serve())
+}
+
+// serve relays datagrams until the association ends and returns why it
+// ended.
+func (a *udpAssociation) serve() string {
+	defer a.close()
+	go a.read(a.relay)
+
+	deadline := time.Now().Add(limits.TimeLimit())
+	timer := time.NewTimer(UDPIdleTimeout)
+	defer timer.Stop()
+
+	for {
+		idle := time.Now().Add(UDPIdleTimeout)
+		if idle.After(deadline) {
+			idle = deadline
+		}
+		timer.Reset(time.Until(idle))
+
+		var p udpPacket
+		select {
+		case p = <-a.packets:
+		case <-timer.C:
+			log.Printf("UDP association expired")
+			if idle.Equal(deadline) {
+				return reasonTimeout
+			}
+			return reasonIdleTimeout
+		}
+		if p.err != nil {
+			if errors.Is(p.err, net.ErrClosed) {
+				return reasonClientClosed
+			}
+			return reasonError
+		}
+
+		if a.user.IsOverDataLimit(a.dataLimit) {
+			log.Printf("UDP association closed: %v", errDataLimit)
+			return reasonDataLimit
+		}
+
+		if p.conn == a.relay && a.isClient(p.from) {
+			a.forward(p.data)
+		} else {
+			a.deliver(p.data, p.from)
+		}
+	}
+}
+
+// read hands the datagrams conn receives to serve until conn is closed.
+func (a *udpAssociation) read(conn *net.UDPConn) {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil && conn != a.relay {
+			return
+		}
+		p := udpPacket{from: from, conn: conn, err: err}
+		if err == nil {
+			p.data = bytes.Clone(buf[:n])
+		}
+		select {
+		case a.packets <- p:
+		case <-a.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close stops the readers and closes the outbound sockets. The relay is
+// closed by its owner.
+func (a *udpAssociation) close() {
+	close(a.done)
+	for _, conn := range a.outbound {
+		if err := conn.Close(); err != nil {
+			log.Printf("UDP socket close error: %v", err)
+		}
+	}
+}
+
+func (a *udpAssociation) isClient(from *net.UDPAddr) bool {
+	if a.client != nil {
+		return a.client.IP.Equal(from.IP) && a.client.Port == from.Port
+	}
+	if !a.clientIP.Equal(from.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != from.Port {
+		return false
+	}
+	a.client = from
+	return true
+}
+
+// forward strips the SOCKS5 UDP header from a client datagram and sends the
+// payload to its destination.
+func (a *udpAssociation) forward(packet []byte) {
+	if len(packet) < 4 || packet[2] != 0x00 {
+		// Fragmentation is not supported, such datagrams are dropped.
+		return
+	}
+	r := bytes.NewReader(packet[3:])
+	target, err := readSOCKS5Addr(r)
+	if err != nil {
+		return
+	}
+	payload := packet[len(packet)-r.Len():]
+
+	dest := a.dests.get(target)
+	if dest == nil {
+		dest = a.dests.add(target, a.checkTarget(target))
+	}
+	if !dest.permitted {
+		return
+	}
+
+	if dest.addr == nil {
+		addr, conn, err := a.lookup(target)
+		if netguard.IsBlocked(err) {
+			// Remember the refusal so the name is not resolved again.
+			dest.permitted = false
+			metrics.BlockedDestinations.WithLabelValues(metrics.MethodUDP).Inc()
+			log.Printf("[SSRF] Server: %s | %v", target, err)
+			return
+		}
+		if isAccessDenied(err) {
+			dest.permitted = false
+			metrics.AccessDenials.WithLabelValues(metrics.MethodUDP).Inc()
+			return
+		}
+		if err != nil {
+			log.Printf("UDP resolve error: %v", err)
+			metrics.UpstreamErrors.WithLabelValues(metrics.MethodUDP).Inc()
+			return
+		}
+		dest.conn = conn
+		a.dests.resolved(dest, addr)
+		if a.audit.rec.Target == "" {
+			a.audit.rec.Target = target
+		}
+	}
+	dst := dest.addr
+
+	// One loop serves both directions, so datagrams over the rate are
+	// dropped rather than waited for.
+	if a.upload != nil && !a.upload.AllowN(len(payload)) {
+		return
+	}
+
+	n, err := dest.conn.WriteToUDP(payload, dst)
+	if err != nil {
+		log.Printf("UDP write error: %v", err)
+		return
+	}
+	a.user.AddData(int64(n))
+	a.audit.up.Add(int64(n))
+	metrics.BytesTransferred.WithLabelValues(metrics.Upload).Add(float64(n))
+}
+
+// deliver wraps a datagram from a remote host and sends it to the client.
+// Only hosts the client has sent to may reply.
+func (a *udpAssociation) deliver(payload []byte, from *net.UDPAddr) {
+	if a.client == nil {
+		return
+	}
+	if !a.dests.allows(from) {
+		return
+	}
+
+	if a.download != nil && !a.download.AllowN(len(payload)) {
+		return
+	}
+
+	packet := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, from)
+	packet = append(packet, payload...)
+
+	if _, err := a.relay.WriteToUDP(packet, a.client); err != nil {
+		log.Printf("UDP write error: %v", err)
+		return
+	}
+	a.user.AddData(int64(len(payload)))
+	a.audit.down.Add(int64(len(payload)))
+	metrics.BytesTransferred.WithLabelValues(metrics.Download).Add(float64(len(payload)))
+}
+
+// lookup resolves target and returns the socket datagrams to it are sent
+// from. With an egress source the first address it has an outbound address
+// for is used.
+func (a *udpAssociation) lookup(target string) (*net.UDPAddr, *net.UDPConn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), udpResolveTimeout)
+	defer cancel()
+	remotes, err := a.resolve(ctx, host, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.src == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(remotes[0], uint16(portNum))), a.relay, nil
+	}
+	for _, remote := range remotes {
+		local, ok := a.src.LocalAddr(remote)
+		if !ok {
+			continue
+		}
+		conn, err := a.outboundConn(local)
+		if err != nil {
+			return nil, nil, err
+		}
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(remote, uint16(portNum))), conn, nil
+	}
+	return nil, nil, fmt.Errorf("no outbound address for %s", host)
+}
+
+// outboundConn returns the socket bound to local, opening it on first use.
+func (a *udpAssociation) outboundConn(local netip.Addr) (*net.UDPConn, error) {
+	if conn, ok := a.outbound[local]; ok {
+		return conn, nil
+	}
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(local, 0)))
+	if err != nil {
+		return nil, err
+	}
+	a.outbound[local] = conn
+	go a.read(conn)
+	return conn, nil
+}
+
+type udpDestination struct {
+	target    string
+	permitted bool
+	// addr is nil until the target has been resolved.
+	addr *net.UDPAddr
+	// conn is the socket datagrams to addr are sent from.
+	conn *net.UDPConn
+}
+
+// udpDestinations remembers the most recently used destinations of an
+// association. When it is full the least recently used one is forgotten;
+// its replies are dropped until the client sends to it again.
+type udpDestinations struct {
+	max      int
+	order    *list.List
+	byTarget map[string]*list.Element
+	// replies counts the remembered destinations resolving to an address.
+	replies map[string]int
+}
+
+func newUDPDestinations(max int) *udpDestinations {
+	return &udpDestinations{
+		max:      max,
+		order:    list.New(),
+		byTarget: make(map[string]*list.Element),
+		replies:  make(map[string]int),
+	}
+}
+
+func (d *udpDestinations) get(target string) *udpDestination {
+	e, ok := d.byTarget[target]
+	if !ok {
+		return nil
+	}
+	d.order.MoveToFront(e)
+	return e.Value.(*udpDestination)
+}
+
+func (d *udpDestinations) add(target string, permitted bool) *udpDestination {
+	if d.order.Len() >= d.max {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		evicted := oldest.Value.(*udpDestination)
+		delete(d.byTarget, evicted.target)
+		if evicted.addr != nil {
+			key := evicted.addr.String()
+			if d.replies[key]--; d.replies[key] <= 0 {
+				delete(d.replies, key)
+			}
+		}
+	}
+	dest := &udpDestination{target: target, permitted: permitted}
+	d.byTarget[target] = d.order.PushFront(dest)
+	return dest
+}
+
+func (d *udpDestinations) resolved(dest *udpDestination, addr *net.UDPAddr) {
+	dest.addr = addr
+	d.replies[addr.String()]++
+}
+
+// allows reports whether from is the address of a remembered destination.
+func (d *udpDestinations) allows(from *net.UDPAddr) bool {
+	return d.replies[from.String()] > 0
+}
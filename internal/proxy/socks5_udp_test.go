@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestUDPDestinationsEvictLeastRecentlyUsed(t *testing.T) {
+	d := newUDPDestinations(2)
+	addr := func(port int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port} }
+
+	for port := 1; port <= 2; port++ {
+		d.resolved(d.add("host:"+strconv.Itoa(port), true), addr(port))
+	}
+	// Using host:1 makes host:2 the one to go.
+	d.get("host:1")
+	d.resolved(d.add("host:3", true), addr(3))
+
+	if d.get("host:2") != nil || d.allows(addr(2)) {
+		t.Error("expected host:2 to be forgotten along with its replies")
+	}
+	for _, port := range []int{1, 3} {
+		if d.get("host:"+strconv.Itoa(port)) == nil || !d.allows(addr(port)) {
+			t.Errorf("expected host:%d to be remembered", port)
+		}
+	}
+	if len(d.byTarget) != 2 || len(d.replies) != 2 {
+		t.Errorf("expected 2 destinations, got %d targets and %d reply addresses", len(d.byTarget), len(d.replies))
+	}
+}
+
+func TestUDPDestinationsShareReplyAddress(t *testing.T) {
+	d := newUDPDestinations(2)
+	shared := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+
+	d.resolved(d.add("a.example:53", true), shared)
+	d.resolved(d.add("b.example:53", true), shared)
+	d.add("c.example:53", true)
+
+	if !d.allows(shared) {
+		t.Error("expected replies to stay allowed while another name still resolves to the address")
+	}
+}
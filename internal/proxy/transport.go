@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// TransportOptions tune the connections plain HTTP requests are sent over.
+type TransportOptions struct {
+	// MaxIdleConns caps idle connections over one route, across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps idle connections to one host.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps all connections to one host, 0 is unlimited.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes connections idle for longer.
+	IdleConnTimeout time.Duration
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// DefaultTransportOptions are used when Server.Transport is nil.
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   32,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       90 * time.Second,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+}
+
+// routeTransport is the transport of one route and when it was last handed
+// out.
+type routeTransport struct {
+	*http.Transport
+	used time.Time
+}
+
+// httpTransport returns the transport plain HTTP requests over rt are sent
+// with. Requests over the same route share one transport so connections to
+// origins are reused, but never across routes, which would send a user's
+// request from someone else's address. Routes can be as narrow as one
+// client session, so transports unused for longer than the idle timeout
+// are dropped.
+func (s *Server) httpTransport(rt route) *http.Transport {
+	key := rt.key()
+	now := time.Now()
+
+	s.transportsMu.Lock()
+	defer s.transportsMu.Unlock()
+
+	opts := DefaultTransportOptions()
+	if s.Transport != nil {
+		opts = *s.Transport
+	}
+	s.evictTransports(now, opts.IdleConnTimeout)
+
+	if t, ok := s.transports[key]; ok {
+		t.used = now
+		return t.Transport
+	}
+
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if opts.DialTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.DialTimeout)
+				defer cancel()
+			}
+			return s.dialContext(ctx, network, addr, rt)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if s.transports == nil {
+		s.transports = make(map[string]*routeTransport)
+	}
+	s.transports[key] = &routeTransport{Transport: t, used: now}
+	return t
+}
+
+// evictTransports drops transports unused for longer than idle, at most
+// once per idle period. Requests still running on a dropped transport
+// finish normally, its connections are closed once idle. s.transportsMu
+// must be held.
+func (s *Server) evictTransports(now time.Time, idle time.Duration) {
+	if idle <= 0 {
+		idle = DefaultTransportOptions().IdleConnTimeout
+	}
+	if now.Sub(s.transportsSwept) < idle {
+		return
+	}
+	s.transportsSwept = now
+	for key, t := range s.transports {
+		if now.Sub(t.used) > idle {
+			t.CloseIdleConnections()
+			delete(s.transports, key)
+		}
+	}
+}
+
+// closeIdleConnections closes the kept-alive connections to origins.
+func (s *Server) closeIdleConnections() {
+	s.transportsMu.Lock()
+	defer s.transportsMu.Unlock()
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// hopHeaders apply to a single connection and are never forwarded
+// (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers from h, including the ones
+// the Connection header names.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleTransportsAreDropped(t *testing.T) {
+	s := &Server{Transport: &TransportOptions{IdleConnTimeout: time.Minute}}
+	session := func(id string) route { return route{upstreamKey: "alice/" + id} }
+
+	first := s.httpTransport(session("a"))
+	if s.httpTransport(session("a")) != first {
+		t.Fatal("expected requests of one session to share a transport")
+	}
+	s.httpTransport(session("b"))
+
+	// Session a has gone quiet, b is still sending requests.
+	s.transports[session("a").key()].used = time.Now().Add(-2 * time.Minute)
+	s.transportsSwept = time.Time{}
+	s.httpTransport(session("b"))
+
+	if _, ok := s.transports[session("a").key()]; ok {
+		t.Error("expected the idle transport of session a to be dropped")
+	}
+	if _, ok := s.transports[session("b").key()]; !ok {
+		t.Error("expected the transport of session b to be kept")
+	}
+	if s.httpTransport(session("a")) == first {
+		t.Error("expected session a to get a new transport")
+	}
+}
@@ -0,0 +1,215 @@
+package repo
+
+import (
+	"awesomeProject11/internal/acl"
+	"awesomeProject11/internal/metrics"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Access rules live in acl_rules. Rows without a username are global. The
+// proxy caches each list as JSON under aclKey for CacheTTL() and keeps the
+// compiled list in an aclCache.
+func aclKey(username string) string {
+	if username == "" {
+		return "acl:global"
+	}
+	return "user_acl:" + username
+}
+
+// CheckDestination applies the user's and the global access rules to
+// target. When the rules cannot be loaded the destination is refused.
+func (r *RedisRepo) CheckDestination(username, target string) (bool, string) {
+	return r.CheckAddress(username, target, netip.Addr{})
+}
+
+// CheckAddress is CheckDestination for a target that resolved to addr.
+func (r *RedisRepo) CheckAddress(username, target string, addr netip.Addr) (bool, string) {
+	user, err := r.loadACL(username)
+	if err != nil {
+		log.Printf("Failed to load access rules for %s: %v", username, err)
+		return false, "access rules unavailable"
+	}
+	global, err := r.loadACL("")
+	if err != nil {
+		log.Printf("Failed to load global access rules: %v", err)
+		return false, "access rules unavailable"
+	}
+
+	d := acl.CheckAddr(user, global, target, addr)
+	return d.Allowed, d.Reason
+}
+
+// aclCheckInterval is how long a compiled list is used before Redis is asked
+// again whether its rules changed.
+const aclCheckInterval = 2 * time.Second
+
+type compiledACL struct {
+	source  string
+	list    *acl.List
+	expires time.Time
+}
+
+// aclCache keeps compiled access lists so a check does not decode and
+// compile the rules on every connection. An entry is bound to the cached
+// JSON it was compiled from; once it expires the JSON is read from Redis
+// again and the list is only recompiled if the rules changed, so Redis
+// stays the place where changes are invalidated.
+type aclCache struct {
+	mu      sync.RWMutex
+	entries map[string]compiledACL
+}
+
+func newACLCache() *aclCache {
+	return &aclCache{entries: make(map[string]compiledACL)}
+}
+
+func (c *aclCache) get(username string) (compiledACL, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[username]
+	c.mu.RUnlock()
+	return entry, ok
+}
+
+// compile returns the list for source, reusing the compiled entry when the
+// rules are unchanged.
+func (c *aclCache) compile(username, source string, rules []acl.Rule) (*acl.List, error) {
+	entry, ok := c.get(username)
+	if !ok || entry.source != source {
+		if rules == nil {
+			if err := json.Unmarshal([]byte(source), &rules); err != nil {
+				return nil, fmt.Errorf("failed to decode access rules: %v", err)
+			}
+		}
+		list, err := acl.Compile(rules)
+		if err != nil {
+			return nil, err
+		}
+		entry = compiledACL{source: source, list: list}
+	}
+	entry.expires = time.Now().Add(aclCheckInterval)
+
+	c.mu.Lock()
+	c.entries[username] = entry
+	c.mu.Unlock()
+	return entry.list, nil
+}
+
+func (r *RedisRepo) loadACL(username string) (*acl.List, error) {
+	if entry, ok := r.acls.get(username); ok && time.Now().Before(entry.expires) {
+		return entry.list, nil
+	}
+
+	redisKey := aclKey(username)
+
+	cached, err := r.client.Get(ctx, redisKey).Result()
+	if err == nil {
+		list, err := r.acls.compile(username, cached, nil)
+		if err == nil {
+			return list, nil
+		}
+		log.Printf("Invalid access rules cached for %s: %v", username, err)
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading access rules: %v", err)
+	}
+
+	start := time.Now()
+	rules, err := queryACL(r.db, username)
+	metrics.ObservePostgres("get_acl", start)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := json.Marshal(rules)
+	if err := r.client.Set(ctx, redisKey, data, CacheTTL()).Err(); err != nil {
+		log.Printf("Failed to cache access rules in Redis: %v", err)
+	}
+	return r.acls.compile(username, string(data), rules)
+}
+
+func queryACL(db *sql.DB, username string) ([]acl.Rule, error) {
+	rows, err := db.Query(
+		"SELECT action, pattern FROM acl_rules WHERE username IS NOT DISTINCT FROM NULLIF($1, '') ORDER BY position",
+		username,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query access rules: %v", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	rules := []acl.Rule{}
+	for rows.Next() {
+		var r acl.Rule
+		if err := rows.Scan(&r.Action, &r.Pattern); err != nil {
+			return nil, fmt.Errorf("failed to read access rule: %v", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// ACLRules returns the access rules of a user, or the global rules when
+// username is empty.
+func (s *UserStore) ACLRules(username string) ([]acl.Rule, error) {
+	if username != "" {
+		if _, err := s.GetUser(username); err != nil {
+			return nil, err
+		}
+	}
+	return queryACL(s.db, username)
+}
+
+// SetACLRules replaces the access rules of a user, or the global rules
+// when username is empty.
+func (s *UserStore) SetACLRules(username string, rules []acl.Rule) error {
+	if username != "" {
+		if _, err := s.GetUser(username); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.Exec("DELETE FROM acl_rules WHERE username IS NOT DISTINCT FROM NULLIF($1, '')", username)
+	if err != nil {
+		return fmt.Errorf("failed to clear access rules: %v", err)
+	}
+	for i, r := range rules {
+		_, err := tx.Exec(
+			"INSERT INTO acl_rules (username, position, action, pattern) VALUES (NULLIF($1, ''), $2, $3, $4)",
+			username, i, r.Action, r.Pattern,
+		)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("failed to write access rule: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.del(aclKey(username))
+	return nil
+}
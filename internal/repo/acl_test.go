@@ -0,0 +1,50 @@
+package repo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckDestinationCachesCompiledRules(t *testing.T) {
+	client, mr := newTestRedis(t)
+	r := NewRedisRepo(client, nil)
+
+	mr.Set(aclKey(""), `[]`)
+	mr.Set(aclKey("alice"), `[{"action":"deny","pattern":"example.com"}]`)
+
+	if ok, _ := r.CheckDestination("alice", "example.com:443"); ok {
+		t.Fatal("expected example.com to be denied")
+	}
+	first, _ := r.acls.get("alice")
+
+	// Within the check interval the compiled list is used without Redis.
+	mr.Set(aclKey("alice"), `[]`)
+	if ok, _ := r.CheckDestination("alice", "example.com:443"); ok {
+		t.Fatal("expected the compiled rules to be reused")
+	}
+
+	// Unchanged rules are not compiled again once the entry expires.
+	mr.Set(aclKey("alice"), first.source)
+	expire(r, "alice")
+	if _, err := r.loadACL("alice"); err != nil {
+		t.Fatalf("loadACL: %v", err)
+	}
+	if entry, _ := r.acls.get("alice"); entry.list != first.list {
+		t.Fatal("expected unchanged rules to keep the compiled list")
+	}
+
+	// Changed rules are picked up from Redis.
+	mr.Set(aclKey("alice"), `[]`)
+	expire(r, "alice")
+	if ok, reason := r.CheckDestination("alice", "example.com:443"); !ok {
+		t.Fatalf("expected the new rules to allow example.com, got %q", reason)
+	}
+}
+
+func expire(r *RedisRepo, username string) {
+	r.acls.mu.Lock()
+	entry := r.acls.entries[username]
+	entry.expires = time.Now().Add(-time.Second)
+	r.acls.entries[username] = entry
+	r.acls.mu.Unlock()
+}
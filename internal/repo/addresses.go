@@ -0,0 +1,240 @@
+package repo
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/metrics"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrAddressTaken is returned when a network overlaps one registered to
+// another user.
+var ErrAddressTaken = errors.New("address range overlaps another user's")
+
+// The user a client address logs in as is cached under addressKey for
+// CacheTTL(). Addresses without a user are cached too, as an empty value,
+// since every client without credentials is looked up. An IPv6 client can
+// pick any address of its /64, so IPv6 misses are cached once per /64
+// instead, unless a network registered inside it needs a finer answer.
+const addressKeyPrefix = "user_addr:"
+
+const missPrefixBits = 64
+
+func addressKey(addr netip.Addr) string { return addressKeyPrefix + addr.String() }
+
+// missKey is where a lookup of addr that found no user is cached.
+func missKey(addr netip.Addr) string {
+	if addr.Is4() {
+		return addressKey(addr)
+	}
+	return addressKeyPrefix + missPrefix(addr).String()
+}
+
+func missPrefix(addr netip.Addr) netip.Prefix {
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, addr.BitLen())
+	}
+	p, _ := addr.Prefix(missPrefixBits)
+	return p
+}
+
+// UserByAddress returns the user a client address is registered to, the
+// most specific network winning. The user must be enabled and allowed to
+// log in by address.
+func (r *RedisRepo) UserByAddress(addr netip.Addr) (string, bool) {
+	addr = addr.WithZone("").Unmap()
+
+	cached, err := r.client.MGet(ctx, addressKey(addr), missKey(addr)).Result()
+	if err != nil {
+		log.Printf("Redis error reading client address: %v", err)
+	} else if username, ok := cached[0].(string); ok {
+		return username, username != ""
+	} else if _, ok := cached[1].(string); ok {
+		return "", false
+	}
+
+	var username sql.NullString
+	var registered bool
+	start := time.Now()
+	err = r.db.QueryRow(
+		"SELECT (SELECT a.username FROM user_addresses a JOIN users u ON u.username = a.username "+
+			"WHERE a.network >>= $1::inet AND u.enabled AND $2 = ANY(u.auth_methods) "+
+			"ORDER BY masklen(a.network) DESC LIMIT 1), "+
+			"EXISTS (SELECT 1 FROM user_addresses WHERE network && $3::cidr)",
+		addr.String(), auth.MethodIP, missPrefix(addr).String(),
+	).Scan(&username, &registered)
+	metrics.ObservePostgres("user_by_address", start)
+	if err != nil {
+		log.Printf("Posgres query error: %v", err)
+		return "", false
+	}
+
+	redisKey := addressKey(addr)
+	if !username.Valid {
+		if addr.Is6() && registered {
+			// Misses inside a /64 with registered networks are not
+			// cached, caching each address would let a client fill
+			// Redis by walking its /64.
+			return "", false
+		}
+		redisKey = missKey(addr)
+	}
+	if err := r.client.Set(ctx, redisKey, username.String, CacheTTL()).Err(); err != nil {
+		log.Printf("Failed to cache client address in Redis: %v", err)
+	}
+	return username.String, username.Valid
+}
+
+// Addresses returns the client networks registered to a user.
+func (s *UserStore) Addresses(username string) ([]string, error) {
+	if _, err := s.GetUser(username); err != nil {
+		return nil, err
+	}
+	networks, err := s.networks(username)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(networks))
+	for i, n := range networks {
+		addrs[i] = n.String()
+	}
+	return addrs, nil
+}
+
+// SetAddresses replaces the client networks of a user. Networks may not
+// overlap those of other users, so every address belongs to one user.
+func (s *UserStore) SetAddresses(username string, networks []netip.Prefix) error {
+	if _, err := s.GetUser(username); err != nil {
+		return err
+	}
+	previous, err := s.networks(username)
+	if err != nil {
+		return err
+	}
+
+	values := make([]string, len(networks))
+	for i, n := range networks {
+		values[i] = n.String()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Writers are serialized so two users cannot claim overlapping networks
+	// at the same time. Readers are not blocked.
+	if _, err := tx.Exec("LOCK TABLE user_addresses IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return fmt.Errorf("failed to lock client addresses: %v", err)
+	}
+
+	var taken, owner string
+	err = tx.QueryRow(
+		"SELECT network::text, username FROM user_addresses "+
+			"WHERE username <> $1 AND network && ANY($2::cidr[]) ORDER BY network LIMIT 1",
+		username, pq.Array(values),
+	).Scan(&taken, &owner)
+	if err == nil {
+		return fmt.Errorf("%w: %s belongs to %s", ErrAddressTaken, taken, owner)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check client addresses: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_addresses WHERE username = $1", username); err != nil {
+		return fmt.Errorf("failed to clear client addresses: %v", err)
+	}
+	for _, v := range values {
+		_, err := tx.Exec("INSERT INTO user_addresses (network, username) VALUES ($1, $2)", v, username)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("failed to write client address: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Besides the user's own addresses this drops cached misses inside the
+	// new networks.
+	s.dropAddressCache(append(previous, networks...))
+	return nil
+}
+
+func (s *UserStore) networks(username string) ([]netip.Prefix, error) {
+	var values []string
+	err := s.db.QueryRow(
+		"SELECT array_agg(network::text ORDER BY network) FROM user_addresses WHERE username = $1", username,
+	).Scan(pq.Array(&values))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client addresses of %s: %v", username, err)
+	}
+	networks := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		n, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client address %q of %s: %v", v, username, err)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// dropAddresses removes the cached addresses of a user, e.g. after the user
+// was disabled.
+func (s *UserStore) dropAddresses(username string) {
+	networks, err := s.networks(username)
+	if err != nil {
+		log.Printf("Failed to invalidate client addresses: %v", err)
+		return
+	}
+	s.dropAddressCache(networks)
+}
+
+// dropAddressCache removes the cached lookups of every address inside
+// networks, and the cached misses of /64s they overlap. Lookups are cached
+// one by one, so the keys are found with SCAN; admin writes are rare enough
+// for that.
+func (s *UserStore) dropAddressCache(networks []netip.Prefix) {
+	if len(networks) == 0 {
+		return
+	}
+
+	var keys []string
+	iter := s.redis.Scan(ctx, 0, addressKeyPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		cached, err := netip.ParsePrefix(strings.TrimPrefix(iter.Val(), addressKeyPrefix))
+		if err != nil {
+			addr, err := netip.ParseAddr(strings.TrimPrefix(iter.Val(), addressKeyPrefix))
+			if err != nil {
+				continue
+			}
+			cached = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		for _, n := range networks {
+			if n.Overlaps(cached) {
+				keys = append(keys, iter.Val())
+				break
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Failed to scan cached client addresses: %v", err)
+	}
+	if len(keys) > 0 {
+		s.del(keys...)
+	}
+}
@@ -0,0 +1,137 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"net/netip"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db, mock
+}
+
+// expectAddressLookup expects one UserByAddress query. An empty username
+// finds no user; registered says whether the miss prefix holds networks.
+func expectAddressLookup(mock sqlmock.Sqlmock, addr, username string, registered bool) {
+	var found any
+	if username != "" {
+		found = username
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM user_addresses a JOIN users")).
+		WithArgs(addr, "ip", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "exists"}).AddRow(found, registered))
+}
+
+func TestUserByAddressCachesIPv6MissesPerPrefix(t *testing.T) {
+	client, mr := newTestRedis(t)
+	db, mock := newTestDB(t)
+	r := NewRedisRepo(client, db)
+
+	expectAddressLookup(mock, "2001:db8::1", "", false)
+	for _, addr := range []string{"2001:db8::1", "2001:db8::ffff", "2001:db8::1:2:3:4"} {
+		if _, ok := r.UserByAddress(netip.MustParseAddr(addr)); ok {
+			t.Errorf("UserByAddress(%s) found a user", addr)
+		}
+	}
+
+	// A /64 with registered networks is looked up address by address, and
+	// its misses are not cached.
+	expectAddressLookup(mock, "2001:db8:0:1::1", "alice", true)
+	expectAddressLookup(mock, "2001:db8:0:1::2", "", true)
+	expectAddressLookup(mock, "2001:db8:0:1::2", "", true)
+	if username, ok := r.UserByAddress(netip.MustParseAddr("2001:db8:0:1::1")); !ok || username != "alice" {
+		t.Errorf("UserByAddress() = %q, %v, want alice", username, ok)
+	}
+	for range 2 {
+		r.UserByAddress(netip.MustParseAddr("2001:db8:0:1::2"))
+	}
+
+	want := []string{"user_addr:2001:db8:0:1::1", "user_addr:2001:db8::/64"}
+	if keys := mr.Keys(); !slices.Equal(keys, want) {
+		t.Errorf("cached keys = %v, want %v", keys, want)
+	}
+}
+
+func TestSetAddressesRejectsOverlap(t *testing.T) {
+	client, _ := newTestRedis(t)
+	db, mock := newTestDB(t)
+	s := NewUserStore(db, client)
+	q := regexp.QuoteMeta
+
+	mock.ExpectQuery(q("FROM users WHERE username = $1")).WithArgs("alice").WillReturnRows(userRow("alice"))
+	mock.ExpectQuery(q("FROM user_addresses WHERE username = $1")).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"networks"}).AddRow(nil))
+	mock.ExpectBegin()
+	mock.ExpectExec(q("LOCK TABLE user_addresses")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(q("network && ANY($2::cidr[])")).WithArgs("alice", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"network", "username"}).AddRow("10.0.0.0/16", "bob"))
+	mock.ExpectRollback()
+
+	err := s.SetAddresses("alice", []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")})
+	if !errors.Is(err, ErrAddressTaken) {
+		t.Fatalf("expected ErrAddressTaken, got %v", err)
+	}
+	if want := "address range overlaps another user's: 10.0.0.0/16 belongs to bob"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
+
+func TestSetAddressesDropsCachedLookups(t *testing.T) {
+	client, mr := newTestRedis(t)
+	db, mock := newTestDB(t)
+	s := NewUserStore(db, client)
+	q := regexp.QuoteMeta
+
+	mr.Set("user_addr:10.0.0.5", "")        // miss inside the new network
+	mr.Set("user_addr:2001:db8::/64", "")   // miss of a /64 the new /128 is in
+	mr.Set("user_addr:192.0.2.1", "alice")  // address alice gives up
+	mr.Set("user_addr:198.51.100.7", "bob") // someone else's
+	mr.Set("user_addr:2001:db8:1::/64", "") // unrelated miss
+
+	mock.ExpectQuery(q("FROM users WHERE username = $1")).WithArgs("alice").WillReturnRows(userRow("alice"))
+	mock.ExpectQuery(q("FROM user_addresses WHERE username = $1")).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"networks"}).AddRow("{192.0.2.0/24}"))
+	mock.ExpectBegin()
+	mock.ExpectExec(q("LOCK TABLE user_addresses")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(q("network && ANY($2::cidr[])")).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(q("DELETE FROM user_addresses")).WithArgs("alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q("INSERT INTO user_addresses")).WithArgs("10.0.0.0/24", "alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q("INSERT INTO user_addresses")).WithArgs("2001:db8::1/128", "alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := s.SetAddresses("alice", []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	})
+	if err != nil {
+		t.Fatalf("SetAddresses failed: %v", err)
+	}
+
+	want := []string{"user_addr:198.51.100.7", "user_addr:2001:db8:1::/64"}
+	if keys := mr.Keys(); !slices.Equal(keys, want) {
+		t.Errorf("cached keys = %v, want %v", keys, want)
+	}
+}
+
+func userRow(username string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"username", "enabled", "data_limit_bytes", "max_connections",
+		"upload_rate_bytes", "download_rate_bytes", "rate_burst_bytes", "billing_period", "billing_anchor",
+		"egress_address", "egress_pool", "allowed_egress_pools", "auth_methods"}).
+		AddRow(username, true, 0, 10, 0, 0, 0, "none", "2026-01-01", "", "", "{}", "{basic,ip}")
+}
@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"awesomeProject11/internal/domain"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	auditQueueSize     = 10000
+	auditBatchSize     = 500
+	auditFlushInterval = 2 * time.Second
+)
+
+// AuditLogger batches connection records into the connection_logs table
+// from a single background goroutine.
+type AuditLogger struct {
+	db      *sql.DB
+	records chan domain.ConnectionRecord
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewAuditLogger(db *sql.DB) *AuditLogger {
+	return &AuditLogger{
+		db:      db,
+		records: make(chan domain.ConnectionRecord, auditQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Record queues rec for the next batch. When the queue is full the record
+// is dropped rather than slowing down the proxy.
+func (l *AuditLogger) Record(rec domain.ConnectionRecord) {
+	select {
+	case l.records <- rec:
+	default:
+		if l.dropped.Add(1)%1000 == 1 {
+			log.Printf("Audit queue full, dropped %d records so far", l.dropped.Load())
+		}
+	}
+}
+
+func (l *AuditLogger) Start() {
+	defer close(l.done)
+	log.Println("Audit log worker started")
+
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]domain.ConnectionRecord, 0, auditBatchSize)
+	for {
+		select {
+		case rec := <-l.records:
+			batch = append(batch, rec)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-l.stop:
+			l.drain(batch)
+			log.Println("Audit log worker stopped")
+			return
+		}
+
+		l.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// Stop writes the records still queued and waits for Start to return.
+// Records passed to Record afterwards are not written.
+func (l *AuditLogger) Stop() {
+	close(l.stop)
+	<-l.done
+}
+
+func (l *AuditLogger) drain(batch []domain.ConnectionRecord) {
+	for {
+		select {
+		case rec := <-l.records:
+			batch = append(batch, rec)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+			l.write(batch)
+			batch = batch[:0]
+		default:
+			if len(batch) > 0 {
+				l.write(batch)
+			}
+			return
+		}
+	}
+}
+
+func (l *AuditLogger) write(batch []domain.ConnectionRecord) {
+	if err := l.insert(batch); err != nil {
+		log.Printf("error when writing %d audit records: %v", len(batch), err)
+	}
+}
+
+func (l *AuditLogger) insert(batch []domain.ConnectionRecord) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.Prepare(pq.CopyIn("connection_logs",
+		"username", "client_ip", "method", "target", "status_code",
+		"bytes_up", "bytes_down", "started_at", "duration_ms", "close_reason",
+	))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %v", err)
+	}
+
+	for _, rec := range batch {
+		_, err := stmt.Exec(
+			rec.Username, rec.ClientIP, rec.Method, rec.Target, rec.StatusCode,
+			rec.BytesUp, rec.BytesDown, rec.Start, rec.Duration.Milliseconds(), rec.CloseReason,
+		)
+		if err != nil {
+			_ = stmt.Close()
+			return fmt.Errorf("failed to copy record: %v", err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		return fmt.Errorf("failed to flush copy: %v", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
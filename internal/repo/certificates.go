@@ -0,0 +1,174 @@
+package repo
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/metrics"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrIdentityTaken is returned when a certificate identity already belongs
+// to another user.
+var ErrIdentityTaken = errors.New("certificate identity belongs to another user")
+
+// The user a certificate identity maps to is cached under
+// certIdentityKey for CacheTTL(), only while the user may log in with it.
+func certIdentityKey(identity string) string { return "cert_identity:" + identity }
+
+// UserByCertificate returns the user the first of identities that is
+// registered belongs to. The user must be enabled and allowed to use
+// client certificates.
+func (r *RedisRepo) UserByCertificate(identities []string) (string, bool) {
+	if len(identities) == 0 {
+		return "", false
+	}
+
+	keys := make([]string, len(identities))
+	for i, id := range identities {
+		keys[i] = certIdentityKey(id)
+	}
+	cached, err := r.client.MGet(ctx, keys...).Result()
+	if err == nil {
+		for _, v := range cached {
+			if username, ok := v.(string); ok && username != "" {
+				return username, true
+			}
+		}
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading certificate identities: %v", err)
+	}
+
+	var username, identity string
+	start := time.Now()
+	err = r.db.QueryRow(
+		"SELECT c.username, c.identity FROM user_certificates c JOIN users u ON u.username = c.username "+
+			"WHERE c.identity = ANY($1) AND u.enabled AND $2 = ANY(u.auth_methods) "+
+			"ORDER BY array_position($1::text[], c.identity) LIMIT 1",
+		pq.Array(identities), auth.MethodMTLS,
+	).Scan(&username, &identity)
+	metrics.ObservePostgres("user_by_certificate", start)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Posgres query error: %v", err)
+		}
+		return "", false
+	}
+
+	if err := r.client.Set(ctx, certIdentityKey(identity), username, CacheTTL()).Err(); err != nil {
+		log.Printf("Failed to cache certificate identity in Redis: %v", err)
+	}
+	return username, true
+}
+
+// SetAuthMethods sets how the user may log in.
+func (s *UserStore) SetAuthMethods(username string, methods []string) error {
+	res, err := s.db.Exec("UPDATE users SET auth_methods = $1 WHERE username = $2", pq.Array(methods), username)
+	if err != nil {
+		return fmt.Errorf("failed to update auth methods for %s: %v", username, err)
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+
+	// The lookups only cache users allowed to use them.
+	s.dropCredentials(username)
+	s.dropLogins(username)
+	return nil
+}
+
+// Certificates returns the certificate identities registered to a user.
+func (s *UserStore) Certificates(username string) ([]string, error) {
+	if _, err := s.GetUser(username); err != nil {
+		return nil, err
+	}
+	ids, err := s.identities(username)
+	if err != nil {
+		return nil, err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return ids, nil
+}
+
+// SetCertificates replaces the certificate identities of a user.
+func (s *UserStore) SetCertificates(username string, identities []string) error {
+	if _, err := s.GetUser(username); err != nil {
+		return err
+	}
+	previous, err := s.identities(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.Exec("DELETE FROM user_certificates WHERE username = $1", username); err != nil {
+		return fmt.Errorf("failed to clear certificate identities: %v", err)
+	}
+	for _, id := range identities {
+		_, err := tx.Exec("INSERT INTO user_certificates (identity, username) VALUES ($1, $2)", id, username)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return fmt.Errorf("%w: %s", ErrIdentityTaken, id)
+			}
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("failed to write certificate identity: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(previous)+len(identities))
+	for _, id := range append(previous, identities...) {
+		keys = append(keys, certIdentityKey(id))
+	}
+	if len(keys) > 0 {
+		s.del(keys...)
+	}
+	return nil
+}
+
+func (s *UserStore) identities(username string) ([]string, error) {
+	var ids []string
+	err := s.db.QueryRow(
+		"SELECT array_agg(identity ORDER BY identity) FROM user_certificates WHERE username = $1", username,
+	).Scan(pq.Array(&ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate identities of %s: %v", username, err)
+	}
+	return ids, nil
+}
+
+// dropIdentities removes the cached identities of a user, e.g. after the
+// user was disabled.
+func (s *UserStore) dropIdentities(username string) {
+	ids, err := s.identities(username)
+	if err != nil {
+		log.Printf("Failed to invalidate certificate identities: %v", err)
+		return
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = certIdentityKey(id)
+	}
+	if len(keys) > 0 {
+		s.del(keys...)
+	}
+}
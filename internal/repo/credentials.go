@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCredentialCacheTTL is how long a successfully verified password is
+// trusted in-process before bcrypt has to run again.
+const DefaultCredentialCacheTTL = 5 * time.Minute
+
+type verifiedCredential struct {
+	hash    string
+	digest  []byte
+	expires time.Time
+}
+
+// credentialCache remembers passwords that already passed bcrypt so the hash
+// cost is paid once per user instead of once per request. Passwords are kept
+// only as an HMAC under a per-process random key, and an entry is bound to
+// the stored hash it was verified against, so a password change invalidates
+// it as soon as the new hash is read.
+type credentialCache struct {
+	mu      sync.RWMutex
+	key     []byte
+	entries map[string]verifiedCredential
+	ttl     atomic.Int64
+}
+
+func newCredentialCache() *credentialCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	c := &credentialCache{
+		key:     key,
+		entries: make(map[string]verifiedCredential),
+	}
+	c.ttl.Store(int64(DefaultCredentialCacheTTL))
+	return c
+}
+
+func (c *credentialCache) digest(password string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func (c *credentialCache) verified(username, hash, password string) bool {
+	c.mu.RLock()
+	entry, ok := c.entries[username]
+	c.mu.RUnlock()
+
+	if !ok || entry.hash != hash || time.Now().After(entry.expires) {
+		return false
+	}
+	return hmac.Equal(entry.digest, c.digest(password))
+}
+
+func (c *credentialCache) remember(username, hash, password string) {
+	entry := verifiedCredential{
+		hash:    hash,
+		digest:  c.digest(password),
+		expires: time.Now().Add(time.Duration(c.ttl.Load())),
+	}
+
+	c.mu.Lock()
+	c.entries[username] = entry
+	c.mu.Unlock()
+}
+
+// SetCredentialCacheTTL changes how long verified passwords are trusted.
+// A TTL of 0 runs bcrypt on every login. Entries already cached keep their
+// expiry.
+func (r *RedisRepo) SetCredentialCacheTTL(d time.Duration) {
+	r.verified.ttl.Store(int64(d))
+}
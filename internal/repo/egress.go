@@ -0,0 +1,352 @@
+package repo
+
+import (
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/egress"
+	"awesomeProject11/internal/metrics"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrPoolNotFound = errors.New("egress pool not found")
+
+func egressKey(username string) string { return "user_egress:" + username }
+func poolKey(name string) string       { return "egress_pool:" + name }
+
+// sessionKey holds what a sticky session is pinned to, one hash field per
+// pinned choice.
+func sessionKey(username, session string) string { return "session:" + username + ":" + session }
+
+// EgressPool is a row of the egress_pools table.
+type EgressPool struct {
+	Name      string   `json:"name"`
+	Strategy  string   `json:"strategy"`
+	Addresses []string `json:"addresses"`
+}
+
+// egressEntry is what user_egress:<name> caches: the user's own address or
+// the pool it belongs to, and the other pools it may pick by username.
+type egressEntry struct {
+	Address      string      `json:"address,omitempty"`
+	Pool         *EgressPool `json:"pool,omitempty"`
+	AllowedPools []string    `json:"allowed_pools,omitempty"`
+}
+
+// EgressSource returns where the user's connections leave from, nil for
+// the host's default address.
+func (r *RedisRepo) EgressSource(username string, opts domain.EgressOptions) (domain.EgressSource, error) {
+	entry, err := r.loadEgress(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var src *egress.Source
+	switch {
+	case opts.Pool != "":
+		pool := entry.Pool
+		if pool == nil || pool.Name != opts.Pool {
+			if !slices.Contains(entry.AllowedPools, opts.Pool) {
+				return nil, domain.ErrPoolNotAllowed
+			}
+			if pool, err = r.loadPool(opts.Pool); err != nil {
+				return nil, err
+			}
+		}
+		if src, err = r.poolSource(*pool, username); err != nil {
+			return nil, err
+		}
+	case entry.Address != "":
+		addr, err := netip.ParseAddr(entry.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress address %q: %v", entry.Address, err)
+		}
+		src = r.egress.Fixed(addr)
+	case entry.Pool != nil:
+		if src, err = r.poolSource(*entry.Pool, username); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	if opts.Session != "" {
+		src = r.stickySource(username, opts, src)
+	}
+	return src, nil
+}
+
+func (r *RedisRepo) poolSource(p EgressPool, username string) (*egress.Source, error) {
+	addrs, err := egress.ParseAddresses(p.Addresses)
+	if err != nil {
+		return nil, fmt.Errorf("egress pool %s: %v", p.Name, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("egress pool %s has no addresses", p.Name)
+	}
+	pool := egress.Pool{Name: p.Name, Strategy: egress.Strategy(p.Strategy), Addresses: addrs}
+	return r.egress.Pool(pool, username), nil
+}
+
+// stickySource pins the addresses src picks to the session, so every
+// connection of the session leaves from the same address until it expires.
+func (r *RedisRepo) stickySource(username string, opts domain.EgressOptions, src *egress.Source) *egress.Source {
+	var pinned []netip.Addr
+	for _, candidate := range src.Pick() {
+		field := "egress4"
+		if candidate.Is6() {
+			field = "egress6"
+		}
+		value := r.PinSession(username, opts.Session, field, candidate.String(), opts.SessionTTL, func(v string) bool {
+			addr, err := netip.ParseAddr(v)
+			return err == nil && src.Contains(addr)
+		})
+		addr, _ := netip.ParseAddr(value)
+		pinned = append(pinned, addr)
+	}
+	return r.egress.Fixed(pinned...)
+}
+
+// PinSession returns field of the sticky session, storing candidate when
+// the session has no value yet or valid rejects the stored one, e.g. after
+// the address left the pool. A session expires ttl after it started. If
+// Redis is unavailable the connection is not pinned.
+func (r *RedisRepo) PinSession(username, session, field, candidate string, ttl time.Duration, valid func(string) bool) string {
+	key := sessionKey(username, session)
+
+	pipe := r.client.TxPipeline()
+	pipe.HSetNX(ctx, key, field, candidate)
+	pipe.ExpireNX(ctx, key, ttl)
+	current := pipe.HGet(ctx, key, field)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to pin session %s of %s: %v", session, username, err)
+		return candidate
+	}
+	if valid(current.Val()) {
+		return current.Val()
+	}
+
+	if err := r.client.HSet(ctx, key, field, candidate).Err(); err != nil {
+		log.Printf("Failed to pin session %s of %s: %v", session, username, err)
+	}
+	return candidate
+}
+
+func (r *RedisRepo) loadEgress(username string) (egressEntry, error) {
+	redisKey := egressKey(username)
+
+	var entry egressEntry
+	cached, err := r.client.Get(ctx, redisKey).Result()
+	if err == nil {
+		if err := json.Unmarshal([]byte(cached), &entry); err == nil {
+			return entry, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading egress settings: %v", err)
+	}
+
+	var name, strategy sql.NullString
+	var addresses []string
+
+	start := time.Now()
+	err = r.db.QueryRow(
+		"SELECT COALESCE(host(u.egress_address), ''), u.allowed_egress_pools, p.name, p.strategy, COALESCE(p.addresses::text[], '{}') "+
+			"FROM users u LEFT JOIN egress_pools p ON p.name = u.egress_pool WHERE u.username = $1",
+		username,
+	).Scan(&entry.Address, pq.Array(&entry.AllowedPools), &name, &strategy, pq.Array(&addresses))
+	metrics.ObservePostgres("get_egress", start)
+	if err != nil && err != sql.ErrNoRows {
+		return egressEntry{}, fmt.Errorf("failed to query egress settings: %v", err)
+	}
+	if name.Valid {
+		entry.Pool = &EgressPool{Name: name.String, Strategy: strategy.String, Addresses: hosts(addresses)}
+	}
+
+	data, _ := json.Marshal(entry)
+	if err := r.client.Set(ctx, redisKey, data, CacheTTL()).Err(); err != nil {
+		log.Printf("Failed to cache egress settings in Redis: %v", err)
+	}
+	return entry, nil
+}
+
+// loadPool returns a pool a user picked by name.
+func (r *RedisRepo) loadPool(name string) (*EgressPool, error) {
+	redisKey := poolKey(name)
+
+	var p EgressPool
+	cached, err := r.client.Get(ctx, redisKey).Result()
+	if err == nil {
+		if err := json.Unmarshal([]byte(cached), &p); err == nil {
+			return &p, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading egress pool: %v", err)
+	}
+
+	var addresses []string
+	start := time.Now()
+	err = r.db.QueryRow("SELECT name, strategy, addresses::text[] FROM egress_pools WHERE name = $1", name).
+		Scan(&p.Name, &p.Strategy, pq.Array(&addresses))
+	metrics.ObservePostgres("get_egress_pool", start)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrPoolNotAllowed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query egress pool %s: %v", name, err)
+	}
+	p.Addresses = hosts(addresses)
+
+	data, _ := json.Marshal(p)
+	if err := r.client.Set(ctx, redisKey, data, CacheTTL()).Err(); err != nil {
+		log.Printf("Failed to cache egress pool in Redis: %v", err)
+	}
+	return &p, nil
+}
+
+// hosts strips the prefix length Postgres prints for inet values that are
+// not single hosts.
+func hosts(addresses []string) []string {
+	out := make([]string, len(addresses))
+	for i, a := range addresses {
+		if p, err := netip.ParsePrefix(a); err == nil {
+			a = p.Addr().String()
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// SetEgress assigns the user an address, a pool, or, with both empty, the
+// host's default address. allowedPools are the other pools the user may
+// pick with the pool username option.
+func (s *UserStore) SetEgress(username, address, pool string, allowedPools []string) error {
+	if allowedPools == nil {
+		allowedPools = []string{}
+	}
+	res, err := s.db.Exec(
+		"UPDATE users SET egress_address = NULLIF($1, '')::inet, egress_pool = NULLIF($2, ''), allowed_egress_pools = $3 WHERE username = $4",
+		address, pool, pq.Array(allowedPools), username,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrPoolNotFound
+		}
+		return fmt.Errorf("failed to update egress settings for %s: %v", username, err)
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+
+	s.del(egressKey(username))
+	return nil
+}
+
+func (s *UserStore) ListEgressPools() ([]EgressPool, error) {
+	rows, err := s.db.Query("SELECT name, strategy, addresses::text[] FROM egress_pools ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list egress pools: %v", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	pools := []EgressPool{}
+	for rows.Next() {
+		var p EgressPool
+		var addresses []string
+		if err := rows.Scan(&p.Name, &p.Strategy, pq.Array(&addresses)); err != nil {
+			return nil, fmt.Errorf("failed to read egress pool: %v", err)
+		}
+		p.Addresses = hosts(addresses)
+		pools = append(pools, p)
+	}
+	return pools, rows.Err()
+}
+
+// SetEgressPool creates or replaces a pool. Members pick up the change on
+// their next connection.
+func (s *UserStore) SetEgressPool(p EgressPool) error {
+	_, err := s.db.Exec(
+		"INSERT INTO egress_pools (name, strategy, addresses) VALUES ($1, $2, $3::inet[]) "+
+			"ON CONFLICT (name) DO UPDATE SET strategy = EXCLUDED.strategy, addresses = EXCLUDED.addresses",
+		p.Name, p.Strategy, pq.Array(p.Addresses),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write egress pool %s: %v", p.Name, err)
+	}
+
+	members, err := s.poolMembers(p.Name)
+	if err != nil {
+		return err
+	}
+	s.dropEgress(members)
+	s.del(poolKey(p.Name))
+	return nil
+}
+
+// DeleteEgressPool removes a pool. Its members fall back to the host's
+// default address.
+func (s *UserStore) DeleteEgressPool(name string) error {
+	// Members are looked up first, the foreign key clears their pool.
+	members, err := s.poolMembers(name)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec("DELETE FROM egress_pools WHERE name = $1", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete egress pool %s: %v", name, err)
+	}
+	if err := expectRow(res); errors.Is(err, ErrUserNotFound) {
+		return ErrPoolNotFound
+	} else if err != nil {
+		return err
+	}
+
+	s.dropEgress(members)
+	s.del(poolKey(name))
+	return nil
+}
+
+func (s *UserStore) dropEgress(usernames []string) {
+	if len(usernames) == 0 {
+		return
+	}
+	keys := make([]string, len(usernames))
+	for i, username := range usernames {
+		keys[i] = egressKey(username)
+	}
+	s.del(keys...)
+}
+
+func (s *UserStore) poolMembers(pool string) ([]string, error) {
+	rows, err := s.db.Query("SELECT username FROM users WHERE egress_pool = $1 OR $1 = ANY(allowed_egress_pools)", pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members of egress pool %s: %v", pool, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	var members []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, fmt.Errorf("failed to read pool member: %v", err)
+		}
+		members = append(members, username)
+	}
+	return members, rows.Err()
+}
@@ -0,0 +1,43 @@
+package repo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPinSession(t *testing.T) {
+	client, mr := newTestRedis(t)
+	r := NewRedisRepo(client, nil)
+	valid := func(v string) bool { return v != "" && v != "gone" }
+	key := sessionKey("alice", "s1")
+
+	if got := r.PinSession("alice", "s1", "upstream", "a", time.Minute, valid); got != "a" {
+		t.Fatalf("expected the first candidate to be pinned, got %q", got)
+	}
+	mr.FastForward(30 * time.Second)
+	if got := r.PinSession("alice", "s1", "upstream", "b", time.Minute, valid); got != "a" {
+		t.Errorf("expected the session to keep its pin, got %q", got)
+	}
+	if ttl := mr.TTL(key); ttl != 30*time.Second {
+		t.Errorf("expected the session to expire a minute after it started, TTL is %v", ttl)
+	}
+
+	// Fields are pinned independently.
+	if got := r.PinSession("alice", "s1", "egress4", "192.0.2.1", time.Minute, valid); got != "192.0.2.1" {
+		t.Errorf("expected another field to get its own pin, got %q", got)
+	}
+
+	// A pin the caller no longer accepts is replaced.
+	mr.HSet(key, "upstream", "gone")
+	if got := r.PinSession("alice", "s1", "upstream", "c", time.Minute, valid); got != "c" {
+		t.Errorf("expected an invalid pin to be replaced, got %q", got)
+	}
+	if got := mr.HGet(key, "upstream"); got != "c" {
+		t.Errorf("expected the new pin to be stored, got %q", got)
+	}
+
+	mr.FastForward(31 * time.Second)
+	if got := r.PinSession("alice", "s1", "upstream", "d", time.Minute, valid); got != "d" {
+		t.Errorf("expected an expired session to be pinned again, got %q", got)
+	}
+}
@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Connection leases replace the old user:<name>:connections counter. Every
+// open connection holds a member of user:<name>:leases scored by its expiry
+// time, and each proxy instance keeps extending the leases it owns. Leases of
+// an instance that crashed simply expire, so its connections stop counting
+// against the user's limit without any manual cleanup.
+const (
+	ConnectionLeaseTTL   = 30 * time.Second
+	LeaseRenewalInterval = 10 * time.Second
+)
+
+func leasesKey(username string) string { return "user:" + username + ":leases" }
+
+// acquireLeaseScript drops expired leases, then adds the new one if the
+// user is still below the limit. Returns 1 when the lease was taken.
+//
+// KEYS[1] leases, ARGV[1] lease id, ARGV[2] ttl ms, ARGV[3] max connections
+var acquireLeaseScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local ttl = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// renewLeasesScript pushes the expiry of existing leases forward. Leases that
+// were already released or reclaimed are not added back.
+//
+// KEYS[1] leases, ARGV[1] ttl ms, ARGV[2..] lease ids
+var renewLeasesScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local ttl = tonumber(ARGV[1])
+
+for i = 2, #ARGV do
+	redis.call('ZADD', KEYS[1], 'XX', now + ttl, ARGV[i])
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 0
+`)
+
+// leaseTracker remembers the leases held by this instance so they can be
+// renewed.
+type leaseTracker struct {
+	instance string
+	seq      atomic.Uint64
+
+	mu     sync.Mutex
+	leases map[string]map[string]struct{}
+}
+
+func newLeaseTracker() *leaseTracker {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic("failed to generate instance id: " + err.Error())
+	}
+	return &leaseTracker{
+		instance: hex.EncodeToString(id),
+		leases:   make(map[string]map[string]struct{}),
+	}
+}
+
+func (t *leaseTracker) newID() string {
+	return t.instance + ":" + strconv.FormatUint(t.seq.Add(1), 10)
+}
+
+func (t *leaseTracker) add(username, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.leases[username] == nil {
+		t.leases[username] = make(map[string]struct{})
+	}
+	t.leases[username][id] = struct{}{}
+}
+
+func (t *leaseTracker) remove(username, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.leases[username], id)
+	if len(t.leases[username]) == 0 {
+		delete(t.leases, username)
+	}
+}
+
+func (t *leaseTracker) snapshot() map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string][]string, len(t.leases))
+	for username, ids := range t.leases {
+		for id := range ids {
+			out[username] = append(out[username], id)
+		}
+	}
+	return out
+}
+
+// RenewLeases extends the connection leases held by this instance every
+// LeaseRenewalInterval. It has to run for as long as the proxy accepts
+// connections, otherwise long tunnels stop counting after ConnectionLeaseTTL.
+func (r *RedisRepo) RenewLeases() {
+	log.Println("Connection lease renewal started")
+
+	ticker := time.NewTicker(LeaseRenewalInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.renewLeases()
+	}
+}
+
+func (r *RedisRepo) renewLeases() {
+	leases := r.leases.snapshot()
+	if len(leases) == 0 {
+		return
+	}
+
+	pipe := r.client.Pipeline()
+	for username, ids := range leases {
+		args := make([]interface{}, 0, len(ids)+1)
+		args = append(args, ConnectionLeaseTTL.Milliseconds())
+		for _, id := range ids {
+			args = append(args, id)
+		}
+		renewLeasesScript.Eval(ctx, pipe, []string{leasesKey(username)}, args...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to renew connection leases: %v", err)
+	}
+}
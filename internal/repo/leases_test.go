@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var testStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestRedis starts an in-memory Redis whose clock stands at testStart
+// until moved with SetTime.
+func newTestRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetTime(testStart)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return client, mr
+}
+
+func TestConnectionLeaseLimit(t *testing.T) {
+	client, _ := newTestRedis(t)
+	user := NewRedisRepo(client, nil).GetOrCreateUser("alice")
+
+	for i := 0; i < 2; i++ {
+		if !user.TryIncrementConnections(2) {
+			t.Fatalf("connection %d was refused below the limit", i+1)
+		}
+	}
+	if user.TryIncrementConnections(2) {
+		t.Fatal("expected the third connection to be refused")
+	}
+
+	user.DecrementConnections()
+	if !user.TryIncrementConnections(2) {
+		t.Error("expected a released lease to free a connection")
+	}
+	if n := client.ZCard(ctx, leasesKey("alice")).Val(); n != 2 {
+		t.Errorf("expected 2 leases, got %d", n)
+	}
+}
+
+func TestDeadInstanceLeasesExpire(t *testing.T) {
+	client, mr := newTestRedis(t)
+
+	live := NewRedisRepo(client, nil)
+	dead := NewRedisRepo(client, nil)
+	if !live.GetOrCreateUser("alice").TryIncrementConnections(2) ||
+		!dead.GetOrCreateUser("alice").TryIncrementConnections(2) {
+		t.Fatal("expected both instances to take a lease")
+	}
+	if live.GetOrCreateUser("alice").TryIncrementConnections(2) {
+		t.Fatal("expected the leases of both instances to count")
+	}
+
+	// Only the live instance keeps renewing, so the dead instance's lease
+	// runs out after ConnectionLeaseTTL.
+	mr.SetTime(testStart.Add(LeaseRenewalInterval))
+	live.renewLeases()
+	mr.SetTime(testStart.Add(ConnectionLeaseTTL + time.Second))
+
+	user := live.GetOrCreateUser("alice")
+	if !user.TryIncrementConnections(2) {
+		t.Fatal("expected the dead instance's lease to have expired")
+	}
+	if user.TryIncrementConnections(2) {
+		t.Error("expected the renewed lease to still count")
+	}
+}
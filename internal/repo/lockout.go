@@ -0,0 +1,162 @@
+package repo
+
+import (
+	"awesomeProject11/internal/limits"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of lockout keys.
+const (
+	LockoutUser = "user"
+	LockoutIP   = "ip"
+)
+
+// ErrLockoutNotFound is returned when clearing a key with no failures.
+var ErrLockoutNotFound = errors.New("lockout not found")
+
+// Failed logins are counted under loginFailuresKey for the policy's window.
+// Once they reach the threshold, loginLockKey holds the failure count until
+// the lockout ends.
+func loginFailuresKey(kind, key string) string { return "login_failures:" + kind + ":" + key }
+
+const loginLockPrefix = "login_lock:"
+
+func loginLockKey(kind, key string) string { return loginLockPrefix + kind + ":" + key }
+
+// LoginLockout keeps failed login counters in Redis, so every proxy
+// instance sees the same lockouts. Redis errors let logins through.
+type LoginLockout struct {
+	client *redis.Client
+	policy limits.LockoutPolicy
+}
+
+func NewLoginLockout(client *redis.Client, policy limits.LockoutPolicy) *LoginLockout {
+	return &LoginLockout{client: client, policy: policy}
+}
+
+func (l *LoginLockout) LoginLockedOut(username, clientIP string) time.Duration {
+	pipe := l.client.Pipeline()
+	var ttls []*redis.DurationCmd
+	if username != "" {
+		ttls = append(ttls, pipe.PTTL(ctx, loginLockKey(LockoutUser, username)))
+	}
+	if clientIP != "" {
+		ttls = append(ttls, pipe.PTTL(ctx, loginLockKey(LockoutIP, clientIP)))
+	}
+	if len(ttls) == 0 {
+		return 0
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("Redis error reading lockouts: %v", err)
+		return 0
+	}
+
+	// PTTL is negative for keys that do not exist.
+	var retryAfter time.Duration
+	for _, ttl := range ttls {
+		retryAfter = max(retryAfter, ttl.Val())
+	}
+	return retryAfter
+}
+
+func (l *LoginLockout) LoginFailed(username, clientIP string) {
+	if username != "" {
+		l.fail(LockoutUser, username, l.policy.UserThreshold)
+	}
+	if clientIP != "" {
+		l.fail(LockoutIP, clientIP, l.policy.IPThreshold)
+	}
+}
+
+func (l *LoginLockout) fail(kind, key string, threshold int) {
+	pipe := l.client.TxPipeline()
+	failures := pipe.Incr(ctx, loginFailuresKey(kind, key))
+	pipe.Expire(ctx, loginFailuresKey(kind, key), l.policy.Window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to count failed login in Redis: %v", err)
+		return
+	}
+
+	delay := l.policy.Delay(failures.Val(), threshold)
+	if delay == 0 {
+		return
+	}
+	if err := l.client.Set(ctx, loginLockKey(kind, key), failures.Val(), delay).Err(); err != nil {
+		log.Printf("Failed to lock out %s %s in Redis: %v", kind, key, err)
+		return
+	}
+	log.Printf("Locked out %s %s for %v after %d failed logins", kind, key, delay, failures.Val())
+}
+
+func (l *LoginLockout) LoginSucceeded(username string) {
+	if err := l.client.Del(ctx, loginFailuresKey(LockoutUser, username)).Err(); err != nil {
+		log.Printf("Failed to reset failed logins in Redis: %v", err)
+	}
+}
+
+// Lockout is a username or client address whose logins are refused.
+type Lockout struct {
+	Kind     string    `json:"kind"`
+	Key      string    `json:"key"`
+	Failures int64     `json:"failures"`
+	Until    time.Time `json:"locked_until"`
+}
+
+// Lockouts lists the current lockouts.
+func (s *UserStore) Lockouts() ([]Lockout, error) {
+	var keys []string
+	iter := s.redis.Scan(ctx, 0, loginLockPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	lockouts := []Lockout{}
+	if len(keys) == 0 {
+		return lockouts, nil
+	}
+
+	pipe := s.redis.Pipeline()
+	values := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		values[i] = pipe.Get(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i, key := range keys {
+		// The lockout may have ended since SCAN.
+		if ttls[i].Val() <= 0 {
+			continue
+		}
+		kind, id, _ := strings.Cut(strings.TrimPrefix(key, loginLockPrefix), ":")
+		failures, _ := strconv.ParseInt(values[i].Val(), 10, 64)
+		lockouts = append(lockouts, Lockout{Kind: kind, Key: id, Failures: failures, Until: now.Add(ttls[i].Val())})
+	}
+	return lockouts, nil
+}
+
+// ClearLockout lifts the lockout of a username or client address and
+// forgets its failures.
+func (s *UserStore) ClearLockout(kind, key string) error {
+	n, err := s.redis.Del(ctx, loginLockKey(kind, key), loginFailuresKey(kind, key)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockoutNotFound
+	}
+	return nil
+}
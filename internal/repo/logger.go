@@ -2,9 +2,13 @@ package repo
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -15,53 +19,225 @@ type TrafficLog struct {
 	BytesUsed int64
 }
 
+const (
+	pendingLogsKey    = "pending_db_logs"
+	processingLogsKey = "processing_db_logs"
+	// processingBatchKey holds the id of the batch in processingLogsKey. It
+	// is stored in traffic_log_batches together with the batch, so a batch
+	// that was committed but not yet deleted from Redis is not counted twice.
+	processingBatchKey = "processing_db_logs_batch"
+
+	// DefaultLogFlushInterval is how often traffic is written to Postgres
+	// unless configured otherwise.
+	DefaultLogFlushInterval = 5 * time.Second
+
+	logRetryMax = 5 * time.Minute
+)
+
+// claimBatchScript returns the id of the batch waiting in processing,
+// moving pending there first if nothing is waiting. A batch left behind by a
+// crashed process is always finished before new traffic is taken, so a
+// rename can never overwrite it. Returns nil when there is nothing to write.
+//
+// KEYS[1] pending, KEYS[2] processing, KEYS[3] batch id, ARGV[1] new batch id
+var claimBatchScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	local id = redis.call('GET', KEYS[3])
+	if not id then
+		id = ARGV[1]
+		redis.call('SET', KEYS[3], id)
+	end
+	return id
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+redis.call('SET', KEYS[3], ARGV[1])
+return ARGV[1]
+`)
+
+// deleteBatchScript removes the batch in processing if it is still the one
+// with the given id. Another instance may have finished it and claimed the
+// next one in the meantime.
+//
+// KEYS[1] processing, KEYS[2] batch id, ARGV[1] batch id
+var deleteBatchScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1], KEYS[2])
+end
+return 0
+`)
+
 type AsyncLogger struct {
 	db    *sql.DB
 	redis *redis.Client
+	stop  chan struct{}
+	done  chan struct{}
+
+	interval atomic.Int64
+	failures int
+	retryAt  time.Time
 }
 
 func NewAsyncLogger(db *sql.DB, redisClient *redis.Client) *AsyncLogger {
-	return &AsyncLogger{
+	l := &AsyncLogger{
 		db:    db,
 		redis: redisClient,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
 	}
+	l.interval.Store(int64(DefaultLogFlushInterval))
+	return l
 }
 
+// SetFlushInterval changes how often traffic is written to Postgres. It
+// takes effect after the next flush.
+func (l *AsyncLogger) SetFlushInterval(d time.Duration) {
+	l.interval.Store(int64(d))
+}
+
+// Start writes traffic to traffic_logs every few seconds. The first run
+// happens right away so a batch left over from a crash is recovered on
+// startup. Failed batches stay in Redis and are retried with exponential
+// backoff.
 func (l *AsyncLogger) Start() {
+	defer close(l.done)
 	log.Println("Async log worker started")
 
-	ticker := time.NewTicker(5 * time.Second)
+	interval := time.Duration(l.interval.Load())
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	l.tick()
+	for {
+		select {
+		case <-ticker.C:
+			l.tick()
+			if d := time.Duration(l.interval.Load()); d != interval {
+				interval = d
+				ticker.Reset(interval)
+			}
+		case <-l.stop:
+			if err := l.flush(); err != nil {
+				log.Printf("Final traffic log flush failed, batch stays in Redis: %v", err)
+			}
+			log.Println("Async log worker stopped")
+			return
+		}
+	}
+}
+
+// Stop writes whatever is still pending and waits for Start to return.
+func (l *AsyncLogger) Stop() {
+	close(l.stop)
+	<-l.done
+}
+
+func (l *AsyncLogger) tick() {
+	if time.Now().Before(l.retryAt) {
+		return
+	}
+	if err := l.flush(); err != nil {
+		l.failures++
+		backoff := time.Duration(l.interval.Load()) << min(l.failures, 6)
+		if backoff > logRetryMax {
+			backoff = logRetryMax
+		}
+		l.retryAt = time.Now().Add(backoff)
+		log.Printf("Failed to save traffic logs (attempt %d), retrying in %s: %v", l.failures, backoff, err)
+		return
+	}
+	l.failures = 0
+	l.retryAt = time.Time{}
+}
+
+// flush writes one batch and only then removes it from Redis.
+func (l *AsyncLogger) flush() error {
 	ctx := context.Background()
 
-	for range ticker.C {
-		err := l.redis.Rename(ctx, "pending_db_logs", "processing_db_logs").Err()
+	batchID, err := claimBatchScript.Run(ctx, l.redis,
+		[]string{pendingLogsKey, processingLogsKey, processingBatchKey}, newBatchID(),
+	).Text()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to claim batch: %v", err)
+	}
+
+	logs, err := l.redis.HGetAll(ctx, processingLogsKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read batch %s: %v", batchID, err)
+	}
+
+	written, err := l.insertBatch(batchID, logs)
+	if err != nil {
+		return err
+	}
+
+	err = deleteBatchScript.Run(ctx, l.redis, []string{processingLogsKey, processingBatchKey}, batchID).Err()
+	if err != nil {
+		// The batch id is recorded, so the retry only deletes it.
+		return fmt.Errorf("failed to delete batch %s: %v", batchID, err)
+	}
+	if written {
+		log.Printf("Successfuly saved %d users data from Redis to PostgreSQL", len(logs))
+	}
+	return nil
+}
+
+// insertBatch writes logs and records batchID in one transaction. It
+// reports false when the batch had already been written.
+func (l *AsyncLogger) insertBatch(batchID string, logs map[string]string) (bool, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.Exec("INSERT INTO traffic_log_batches (batch_id) VALUES ($1) ON CONFLICT DO NOTHING", batchID)
+	if err != nil {
+		return false, fmt.Errorf("failed to record batch %s: %v", batchID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 0 {
+		log.Printf("Traffic log batch %s was already saved", batchID)
+		return false, tx.Commit()
+	}
+
+	for username, bytesStr := range logs {
+		bytes, err := strconv.ParseInt(bytesStr, 10, 64)
 		if err != nil {
-			if err.Error() == "ERR no such key" {
-				continue
-			}
-			log.Printf("Worker redis error: %v", err)
-			continue
-		}
-		logs, err := l.redis.HGetAll(ctx, "processing_db_logs").Result()
-		if err != nil || len(logs) == 0 {
+			log.Printf("Skipping invalid traffic log for user %s: %q", username, bytesStr)
 			continue
 		}
 
-		for username, bytesStr := range logs {
-			bytes, _ := strconv.ParseInt(bytesStr, 10, 64)
-
-			_, err := l.db.Exec(
-				"INSERT INTO traffic_logs (username, bytes_used) VALUES ($1, $2)",
-				username, bytes,
-			)
-			if err != nil {
-				log.Printf("error when writing logs for user %s: %v", username, err)
-			}
+		// Traffic of a user deleted in the meantime would fail the foreign
+		// key and with it the whole batch.
+		_, err = tx.Exec(
+			"INSERT INTO traffic_logs (username, bytes_used) SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM users WHERE username = $1)",
+			username, bytes,
+		)
+		if err != nil {
+			return false, fmt.Errorf("error when writing logs for user %s: %v", username, err)
 		}
-		l.redis.Del(ctx, "processing_db_logs")
-		log.Printf("Successfuly saved %d users data from Redis to PostgreSQL", len(logs))
 	}
 
+	_, err = tx.Exec("DELETE FROM traffic_log_batches WHERE processed_at < NOW() - INTERVAL '7 days'")
+	if err != nil {
+		return false, fmt.Errorf("failed to prune batch ids: %v", err)
+	}
+	return true, tx.Commit()
+}
+
+func newBatchID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic("failed to generate batch id: " + err.Error())
+	}
+	return hex.EncodeToString(id)
 }
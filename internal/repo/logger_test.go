@@ -0,0 +1,89 @@
+package repo
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestLogger(t *testing.T) (*AsyncLogger, sqlmock.Sqlmock) {
+	t.Helper()
+	client, _ := newTestRedis(t)
+	db, mock := newTestDB(t)
+	return NewAsyncLogger(db, client), mock
+}
+
+// expectBatch expects one batch transaction. recorded is false when the
+// batch id is already in traffic_log_batches.
+func expectBatch(mock sqlmock.Sqlmock, batchID driver.Value, recorded bool) {
+	q := regexp.QuoteMeta
+	mock.ExpectBegin()
+	var rows int64
+	if recorded {
+		rows = 1
+	}
+	mock.ExpectExec(q("INSERT INTO traffic_log_batches")).WithArgs(batchID).WillReturnResult(sqlmock.NewResult(0, rows))
+	if recorded {
+		mock.ExpectExec(q("INSERT INTO traffic_logs")).WithArgs("alice", int64(100)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(q("DELETE FROM traffic_log_batches")).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectCommit()
+}
+
+func TestFlushClaimsWritesAndDeletes(t *testing.T) {
+	l, mock := newTestLogger(t)
+	l.redis.HSet(ctx, pendingLogsKey, "alice", 100)
+
+	expectBatch(mock, sqlmock.AnyArg(), true)
+	if err := l.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := l.redis.Exists(ctx, pendingLogsKey, processingLogsKey, processingBatchKey).Val(); n != 0 {
+		t.Errorf("expected the batch to be deleted, %d keys left", n)
+	}
+}
+
+func TestFlushReclaimsLeftoverBatch(t *testing.T) {
+	l, mock := newTestLogger(t)
+
+	// A crashed instance committed batch "b1" but did not delete it.
+	l.redis.HSet(ctx, processingLogsKey, "alice", 100)
+	l.redis.Set(ctx, processingBatchKey, "b1", 0)
+	l.redis.HSet(ctx, pendingLogsKey, "alice", 7)
+
+	expectBatch(mock, "b1", false)
+	if err := l.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if l.redis.Exists(ctx, processingLogsKey, processingBatchKey).Val() != 0 {
+		t.Error("expected the leftover batch to be deleted")
+	}
+	if got := l.redis.HGet(ctx, pendingLogsKey, "alice").Val(); got != "7" {
+		t.Errorf("expected new traffic to wait for the next batch, got %q", got)
+	}
+}
+
+func TestDeleteBatchOnlyDeletesOwnBatch(t *testing.T) {
+	l, _ := newTestLogger(t)
+
+	// Another instance finished "b1" and claimed "b2" meanwhile.
+	l.redis.HSet(ctx, processingLogsKey, "alice", 100)
+	l.redis.Set(ctx, processingBatchKey, "b2", 0)
+
+	keys := []string{processingLogsKey, processingBatchKey}
+	if err := deleteBatchScript.Run(ctx, l.redis, keys, "b1").Err(); err != nil {
+		t.Fatalf("delete b1: %v", err)
+	}
+	if l.redis.Exists(ctx, keys...).Val() != 2 {
+		t.Fatal("expected batch b2 to survive the delete of b1")
+	}
+
+	if err := deleteBatchScript.Run(ctx, l.redis, keys, "b2").Err(); err != nil {
+		t.Fatalf("delete b2: %v", err)
+	}
+	if l.redis.Exists(ctx, keys...).Val() != 0 {
+		t.Error("expected batch b2 to be deleted")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -18,7 +19,9 @@ func NewPostgresRepo(db *sql.DB) *PosgresRepo {
 	}
 }
 
-func ConnectPostgres(dsn string) (*sql.DB, error) {
+// ConnectPostgres opens a pool of at most maxOpenConns connections. A
+// connMaxLifetime of 0 keeps connections open indefinitely.
+func ConnectPostgres(dsn string, maxOpenConns, maxIdleConns int, connMaxLifetime time.Duration) (*sql.DB, error) {
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to postgres DB: %v", err)
@@ -28,8 +31,9 @@ func ConnectPostgres(dsn string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to reach DB (Ping error): %v", err)
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
 
 	log.Println("successfully connected to PostgreSQL")
 	return db, nil
@@ -0,0 +1,180 @@
+package repo
+
+import (
+	"awesomeProject11/internal/limits"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// QuotaCheckInterval is how often billing periods are checked for rollover.
+const QuotaCheckInterval = time.Minute
+
+func periodStartKey(username string) string { return "user:" + username + ":period_start" }
+
+// pendingPeriodsKey holds closed periods that still have to be written to
+// usage_periods, so a crash between the rollover and the insert loses
+// nothing.
+const pendingPeriodsKey = "pending_usage_periods"
+
+// rolloverLua resets the data counter when the current period start is
+// later than the stored one and queues the closed period's total. It is a
+// no-op when the period has not changed, so every proxy instance can run it
+// without double-resetting, and an instance whose clock is slightly behind
+// never moves the period back. A user seen for the first time only gets the
+// period recorded and keeps their counter. An empty start means the user
+// has no billing period.
+//
+// KEYS[1] data_used, KEYS[2] period_start, KEYS[3] pending periods
+// ARGV[1] current period start (unix), ARGV[2] username
+const rolloverLua = `
+local rolled = 0
+local previous = redis.call('GET', KEYS[2])
+if ARGV[1] ~= '' and previous ~= ARGV[1] and (not previous or tonumber(previous) < tonumber(ARGV[1])) then
+	redis.call('SET', KEYS[2], ARGV[1])
+	if previous then
+		local used = redis.call('GET', KEYS[1]) or '0'
+		redis.call('SET', KEYS[1], 0)
+		redis.call('HSET', KEYS[3], ARGV[2] .. '|' .. previous .. '|' .. ARGV[1], used)
+		rolled = 1
+	end
+end
+`
+
+// rolloverScript runs rolloverLua and returns 1 when it started a new
+// period.
+var rolloverScript = redis.NewScript(rolloverLua + `
+return rolled
+`)
+
+// QuotaResetter persists the totals of closed billing periods. Counters of
+// users with traffic are rolled over by the proxy as soon as their period
+// ends, see usageBuffer; the resetter rolls over the others so their
+// periods get persisted too.
+type QuotaResetter struct {
+	db    *sql.DB
+	redis *redis.Client
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewQuotaResetter(db *sql.DB, redisClient *redis.Client) *QuotaResetter {
+	return &QuotaResetter{
+		db:    db,
+		redis: redisClient,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (q *QuotaResetter) Start() {
+	defer close(q.done)
+	log.Println("Quota reset worker started")
+
+	ticker := time.NewTicker(QuotaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.rollover(time.Now()); err != nil {
+			log.Printf("Quota reset error: %v", err)
+		}
+		if err := q.persistPeriods(); err != nil {
+			log.Printf("Failed to persist usage periods: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-q.stop:
+			log.Println("Quota reset worker stopped")
+			return
+		}
+	}
+}
+
+// Stop ends the worker after its current run.
+func (q *QuotaResetter) Stop() {
+	close(q.stop)
+	<-q.done
+}
+
+func (q *QuotaResetter) rollover(now time.Time) error {
+	rows, err := q.db.Query("SELECT username, billing_period, billing_anchor FROM users WHERE billing_period <> $1", limits.PeriodNone)
+	if err != nil {
+		return fmt.Errorf("failed to query billing periods: %v", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	for rows.Next() {
+		var username, period string
+		var anchor time.Time
+		if err := rows.Scan(&username, &period, &anchor); err != nil {
+			return fmt.Errorf("failed to read billing period: %v", err)
+		}
+
+		start, _, err := limits.PeriodBounds(period, anchor, now)
+		if err != nil {
+			log.Printf("User %s: %v", username, err)
+			continue
+		}
+
+		keys := []string{dataUsedKey(username), periodStartKey(username), pendingPeriodsKey}
+		rolled, err := rolloverScript.Run(ctx, q.redis, keys, start.Unix(), username).Int()
+		if err != nil {
+			log.Printf("Failed to roll over quota for user %s: %v", username, err)
+			continue
+		}
+		if rolled == 1 {
+			log.Printf("Started new %s billing period for user %s at %s", period, username, start.Format(time.RFC3339))
+		}
+	}
+	return rows.Err()
+}
+
+// persistPeriods moves queued period totals into usage_periods. Inserts are
+// idempotent, so a field is only removed from Redis after its row exists.
+func (q *QuotaResetter) persistPeriods() error {
+	periods, err := q.redis.HGetAll(ctx, pendingPeriodsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for field, usedStr := range periods {
+		// The username may itself contain '|', so the timestamps are
+		// taken from the end.
+		endSep := strings.LastIndex(field, "|")
+		startSep := strings.LastIndex(field[:max(endSep, 0)], "|")
+		if startSep < 0 {
+			log.Printf("Dropping malformed usage period %q", field)
+			q.redis.HDel(ctx, pendingPeriodsKey, field)
+			continue
+		}
+		username := field[:startSep]
+		start, err1 := strconv.ParseInt(field[startSep+1:endSep], 10, 64)
+		end, err2 := strconv.ParseInt(field[endSep+1:], 10, 64)
+		used, err3 := strconv.ParseInt(usedStr, 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			log.Printf("Dropping malformed usage period %q=%q", field, usedStr)
+			q.redis.HDel(ctx, pendingPeriodsKey, field)
+			continue
+		}
+
+		_, err := q.db.Exec(
+			"INSERT INTO usage_periods (username, period_start, period_end, bytes_used) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			username, time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC(), used,
+		)
+		if err != nil {
+			log.Printf("error when writing usage period for user %s: %v", username, err)
+			continue
+		}
+		q.redis.HDel(ctx, pendingPeriodsKey, field)
+	}
+	return nil
+}
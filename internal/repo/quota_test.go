@@ -0,0 +1,77 @@
+package repo
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRolloverScript(t *testing.T) {
+	client, mr := newTestRedis(t)
+	keys := []string{dataUsedKey("alice"), periodStartKey("alice"), pendingPeriodsKey}
+	mr.Set(dataUsedKey("alice"), "50")
+
+	steps := []struct {
+		name       string
+		start      string
+		wantRolled int
+		wantStart  string
+		wantUsed   string
+	}{
+		{"first seen", "100", 0, "100", "50"},
+		{"same period", "100", 0, "100", "50"},
+		{"new period", "200", 1, "200", "0"},
+		{"clock behind", "150", 0, "200", "0"},
+	}
+	for _, step := range steps {
+		rolled, err := rolloverScript.Run(ctx, client, keys, step.start, "alice").Int()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		start, _ := mr.Get(periodStartKey("alice"))
+		used, _ := mr.Get(dataUsedKey("alice"))
+		if rolled != step.wantRolled || start != step.wantStart || used != step.wantUsed {
+			t.Errorf("%s: rolled %d, period start %s, data used %s; want %d, %s, %s",
+				step.name, rolled, start, used, step.wantRolled, step.wantStart, step.wantUsed)
+		}
+	}
+
+	if fields, _ := mr.HKeys(pendingPeriodsKey); len(fields) != 1 {
+		t.Fatalf("expected one pending period, got %v", fields)
+	}
+	if got := mr.HGet(pendingPeriodsKey, "alice|100|200"); got != "50" {
+		t.Errorf("pending period alice|100|200 = %q, want 50", got)
+	}
+}
+
+func TestUsageSyncRollsOverWhenPeriodEnds(t *testing.T) {
+	client, mr := newTestRedis(t)
+	b := newUsageBuffer(client)
+	start := testStart
+	b.period = func(username string, now time.Time) (time.Time, time.Time, bool) {
+		return start, start.AddDate(0, 0, 1), true
+	}
+
+	b.add("alice", 150)
+	if !b.isOver("alice", 100) {
+		t.Fatal("expected alice to be over the limit")
+	}
+
+	// The period ends: the next check syncs and sees the reset counter.
+	start = testStart.AddDate(0, 0, 1)
+	u := b.user("alice")
+	u.mu.Lock()
+	u.periodEnd = time.Now()
+	u.mu.Unlock()
+	if b.isOver("alice", 100) {
+		t.Error("expected the new period to start from zero")
+	}
+
+	if got, _ := mr.Get(dataUsedKey("alice")); got != "0" {
+		t.Errorf("data used = %q, want 0", got)
+	}
+	field := "alice|" + strconv.FormatInt(testStart.Unix(), 10) + "|" + strconv.FormatInt(start.Unix(), 10)
+	if got := mr.HGet(pendingPeriodsKey, field); got != "150" {
+		t.Errorf("pending period %s = %q, want 150", field, got)
+	}
+}
@@ -1,13 +1,18 @@
 package repo
 
 import (
+	"awesomeProject11/internal/auth"
 	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/egress"
+	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/metrics"
 	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -15,22 +20,95 @@ import (
 
 var ctx = context.Background()
 
+// DefaultCacheTTL is how long user credentials and limits stay cached in
+// Redis unless configured otherwise.
+const DefaultCacheTTL = time.Hour
+
+var cacheTTL atomic.Int64
+
+func init() {
+	cacheTTL.Store(int64(DefaultCacheTTL))
+}
+
+// CacheTTL is how long user credentials and limits stay cached in Redis.
+func CacheTTL() time.Duration {
+	return time.Duration(cacheTTL.Load())
+}
+
+func SetCacheTTL(d time.Duration) {
+	cacheTTL.Store(int64(d))
+}
+
+func credentialsKey(username string) string { return "user_cred:" + username }
+func limitsKey(username string) string      { return "user_limits:" + username }
+func dataUsedKey(username string) string    { return "user:" + username + ":data_used" }
+
+// credentialsVersionKey counts the changes to a user's login settings, so
+// a lookup that raced with one does not cache what it read before it.
+func credentialsVersionKey(username string) string { return "user_cred_version:" + username }
+
+// noCredentials is cached under credentialsKey for users that do not exist
+// or may not log in with a password. Every UserStore write that could let
+// them in drops the key.
+const (
+	noCredentials    = "-"
+	noCredentialsTTL = 5 * time.Minute
+)
+
+// cacheCredentialsScript caches a credentials lookup unless the user's login
+// settings changed since it started.
+//
+// KEYS[1] credentials, KEYS[2] version; ARGV[1] value, ARGV[2] ttl ms,
+// ARGV[3] version read before the lookup
+var cacheCredentialsScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[3] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
 type redisUser struct {
 	client   *redis.Client
 	username string
+	leases   *leaseTracker
+	usage    *usageBuffer
+
+	// held are the leases taken through this user, released last in first
+	// out.
+	mu   sync.Mutex
+	held []string
 }
 
 type RedisRepo struct {
 	client      *redis.Client
 	db          *sql.DB
 	credentials map[string]string
+	verified    *credentialCache
+	leases      *leaseTracker
+	usage       *usageBuffer
+	egress      *egress.Selector
+	acls        *aclCache
+
+	// limiters are the rate limiters of each user and direction, kept so
+	// a user's connections share one local token grant.
+	limitersMu sync.Mutex
+	limiters   map[string]*redisRateLimiter
 }
 
-func NewRedisRepo(client *redis.Client, db *sql.DB) domain.Repository {
-	return &RedisRepo{
-		client: client,
-		db:     db,
+func NewRedisRepo(client *redis.Client, db *sql.DB) *RedisRepo {
+	r := &RedisRepo{
+		client:   client,
+		db:       db,
+		verified: newCredentialCache(),
+		leases:   newLeaseTracker(),
+		usage:    newUsageBuffer(client),
+		egress:   egress.NewSelector(),
+		acls:     newACLCache(),
+		limiters: make(map[string]*redisRateLimiter),
 	}
+	r.usage.period = r.currentPeriod
+	return r
 }
 
 func (r *RedisRepo) GetCredentials() map[string]string {
@@ -41,115 +119,166 @@ func (r *RedisRepo) GetOrCreateUser(username string) domain.User {
 	return &redisUser{
 		client:   r.client,
 		username: username,
+		leases:   r.leases,
+		usage:    r.usage,
 	}
 }
 
 func (r *RedisRepo) ValidateUser(username, password string) bool {
-	redisKey := "user_cred:" + username
-
-	cachedPassword, err := r.client.Get(ctx, redisKey).Result()
+	redisKey := credentialsKey(username)
 
-	if err == nil {
-		return cachedPassword == password
-	} else if err != redis.Nil {
+	// The version is read with the cached value so a lookup that misses
+	// can tell whether the user changed while it queried Postgres.
+	var version string
+	cached, err := r.client.MGet(ctx, redisKey, credentialsVersionKey(username)).Result()
+	if err != nil {
 		log.Printf("Redis error reading credentials: %v", err)
+	} else {
+		storedHash, _ := cached[0].(string)
+		version, _ = cached[1].(string)
+		if storedHash == noCredentials {
+			return false
+		}
+		if auth.IsPasswordHash(storedHash) {
+			return r.verifyHash(username, storedHash, password)
+		}
 	}
+
 	var dbPassword string
-	err = r.db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&dbPassword)
+	start := time.Now()
+	err = r.db.QueryRow(
+		"SELECT password FROM users WHERE username = $1 AND enabled AND $2 = ANY(auth_methods)",
+		username, auth.MethodBasic,
+	).Scan(&dbPassword)
+	metrics.ObservePostgres("validate_user", start)
+	if err == sql.ErrNoRows {
+		// Guessing usernames should not cost a query each.
+		r.cacheCredentials(username, noCredentials, min(CacheTTL(), noCredentialsTTL), version)
+		return false
+	}
 	if err != nil {
-		if err != sql.ErrNoRows {
-			log.Printf("Posgres query error: %v", err)
-		}
+		log.Printf("Posgres query error: %v", err)
 		return false
 	}
-	if dbPassword == password {
-		err = r.client.Set(ctx, redisKey, dbPassword, time.Hour).Err()
-		if err != nil {
-			log.Printf("Failed to cache credentials in Redis: %v", err)
+
+	if !auth.IsPasswordHash(dbPassword) {
+		if !auth.VerifyPassword(dbPassword, password) {
+			return false
 		}
-		return true
+		dbPassword = r.upgradeLegacyPassword(username, dbPassword, password)
+		r.verified.remember(username, dbPassword, password)
 	}
-	return false
-}
 
-func (u *redisUser) AddData(n int64) {
-	key := "user:" + u.username + ":data_used"
-	err := u.client.IncrBy(ctx, key, n).Err()
-	if err != nil {
-		log.Printf("Failed to update user %s, data used in Redis db: %v", u.username, err)
+	// The hash is cached even when the password is wrong, so wrong
+	// guesses are checked against Redis instead of Postgres.
+	if auth.IsPasswordHash(dbPassword) {
+		r.cacheCredentials(username, dbPassword, CacheTTL(), version)
 	}
+	return r.verifyHash(username, dbPassword, password)
+}
 
-	err = u.client.HIncrBy(ctx, "pending_db_logs", u.username, n).Err()
+// cacheCredentials caches value as the credentials of username unless
+// UserStore changed the user's login settings since version was read.
+func (r *RedisRepo) cacheCredentials(username, value string, ttl time.Duration, version string) {
+	keys := []string{credentialsKey(username), credentialsVersionKey(username)}
+	err := cacheCredentialsScript.Run(ctx, r.client, keys, value, ttl.Milliseconds(), version).Err()
 	if err != nil {
-		log.Printf("failed to update pending logs in Redis: %v", err)
+		log.Printf("Failed to cache credentials in Redis: %v", err)
 	}
 }
 
-func (u *redisUser) IsOverDataLimit(limit int64) bool {
-	if limit == 0 {
+func (r *RedisRepo) verifyHash(username, hash, password string) bool {
+	if r.verified.verified(username, hash, password) {
+		return true
+	}
+	if !auth.VerifyPassword(hash, password) {
 		return false
 	}
+	r.verified.remember(username, hash, password)
+	return true
+}
 
-	key := "user:" + u.username + ":data_used"
-	val, err := u.client.Get(ctx, key).Result()
-
-	if err == redis.Nil {
-		return false
-	} else if err != nil {
-		log.Printf("Failed to read data from redis user: %s : %v", u.username, err)
-		return true
+// upgradeLegacyPassword replaces a plaintext password row with its bcrypt
+// hash after a successful login. The row is only updated if it still holds
+// the legacy value, so a concurrent password change is never overwritten.
+// It returns the value now stored for the user.
+func (r *RedisRepo) upgradeLegacyPassword(username, legacy, password string) string {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("Failed to hash password for user %s: %v", username, err)
+		return legacy
 	}
 
-	used, err := strconv.ParseInt(val, 10, 64)
+	start := time.Now()
+	_, err = r.db.Exec("UPDATE users SET password = $1 WHERE username = $2 AND password = $3", hash, username, legacy)
+	metrics.ObservePostgres("upgrade_password", start)
 	if err != nil {
-		log.Printf("Failed to convert string to int64 in Redis: %v", err)
-		return true
+		log.Printf("Failed to upgrade legacy password for user %s: %v", username, err)
+		return legacy
 	}
+	log.Printf("Upgraded legacy plaintext password for user %s", username)
+	return hash
+}
 
-	return limit < used
+// AddData counts n bytes against the user. The bytes reach Redis in
+// batches, see usageBuffer.
+func (u *redisUser) AddData(n int64) {
+	u.usage.add(u.username, n)
 }
-func (u *redisUser) TryIncrementConnections(max int64) bool {
 
-	key := "user:" + u.username + ":connections"
+func (u *redisUser) IsOverDataLimit(limit int64) bool {
+	return u.usage.isOver(u.username, limit)
+}
 
-	val, err := u.client.IncrBy(ctx, key, 1).Result()
+// TryIncrementConnections takes a connection lease if the user holds fewer
+// than max live leases.
+func (u *redisUser) TryIncrementConnections(max int64) bool {
+	id := u.leases.newID()
 
+	ok, err := acquireLeaseScript.Run(ctx, u.client, []string{leasesKey(u.username)}, id, ConnectionLeaseTTL.Milliseconds(), max).Bool()
 	if err != nil {
 		log.Printf("Cannot increment connections: user: %s %v", u.username, err)
 		return false
 	}
-	if val > max {
-		u.client.Decr(ctx, key)
+	if !ok {
 		return false
 	}
+
+	u.leases.add(u.username, id)
+	u.mu.Lock()
+	u.held = append(u.held, id)
+	u.mu.Unlock()
 	return true
 }
 
+// DecrementConnections releases the most recent lease taken through u.
 func (u *redisUser) DecrementConnections() {
-	key := "user:" + u.username + ":connections"
-
-	conns, err := u.client.Decr(ctx, key).Result()
-
-	if err != nil {
-		log.Printf("Cannot decrease connections: %v", err)
-	}
-	if conns < 0 {
+	u.mu.Lock()
+	if len(u.held) == 0 {
+		u.mu.Unlock()
 		log.Printf("Decreased below 0")
+		return
 	}
-}
-
-func CreateRedisCache(db int) (*redis.Client, error) {
-	redisAddr := os.Getenv("REDIS_ADDR")
+	id := u.held[len(u.held)-1]
+	u.held = u.held[:len(u.held)-1]
+	u.mu.Unlock()
 
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	u.leases.remove(u.username, id)
+	if err := u.client.ZRem(ctx, leasesKey(u.username), id).Err(); err != nil {
+		log.Printf("Cannot decrease connections: %v", err)
 	}
+}
 
+// CreateRedisCache connects to Redis. A poolSize of 0 keeps the go-redis
+// default.
+func CreateRedisCache(redisAddr, password string, db, poolSize int) (*redis.Client, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     redisAddr,
-		Password: "asd",
+		Password: password,
 		DB:       db,
+		PoolSize: poolSize,
 	})
+	client.AddHook(metrics.RedisHook{})
 
 	ctx := context.Background()
 	err := client.Ping(ctx).Err()
@@ -160,31 +289,83 @@ func CreateRedisCache(db int) (*redis.Client, error) {
 }
 
 func (r *RedisRepo) GetUserLimits(username string) (int64, int64) {
-	redisKey := "user_limits:" + username
+	limits := r.loadLimits(username)
+	return limits.dataLimit, limits.maxConnections
+}
+
+// userLimits is the users row cached under user_limits:<name>.
+type userLimits struct {
+	dataLimit      int64
+	maxConnections int64
+	uploadRate     int64
+	downloadRate   int64
+	rateBurst      int64
+	billingPeriod  string
+	// billingAnchor is a YYYY-MM-DD date.
+	billingAnchor string
+}
+
+var userLimitFields = []string{"data_limit_bytes", "max_connections", "upload_rate_bytes", "download_rate_bytes", "rate_burst_bytes", "billing_period", "billing_anchor"}
+
+func (r *RedisRepo) loadLimits(username string) userLimits {
+	redisKey := limitsKey(username)
 
-	limits, err := r.client.HGetAll(ctx, redisKey).Result()
-	if err == nil && len(limits) > 0 {
-		dataLimit, _ := strconv.ParseInt(limits["data_limit_bytes"], 10, 64)
-		maxConns, _ := strconv.ParseInt(limits["max_connections"], 10, 64)
-		return dataLimit, maxConns
+	cached, err := r.client.HGetAll(ctx, redisKey).Result()
+	if err == nil && len(cached) >= len(userLimitFields) {
+		values := make([]int64, 5)
+		for i, field := range userLimitFields[:5] {
+			values[i], _ = strconv.ParseInt(cached[field], 10, 64)
+		}
+		return userLimits{values[0], values[1], values[2], values[3], values[4], cached["billing_period"], cached["billing_anchor"]}
 	} else if err != redis.Nil && err != nil {
 		log.Printf("Redis error reading limits: %v", err)
 	}
 
-	var dataLimit, maxConns int64
+	var l userLimits
 
-	err = r.db.QueryRow("SELECT data_limit_bytes, max_connections FROM users WHERE username = $1", username).Scan(&dataLimit, &maxConns)
+	start := time.Now()
+	err = r.db.QueryRow(
+		"SELECT COALESCE(data_limit_bytes, 0), COALESCE(max_connections, 0), upload_rate_bytes, download_rate_bytes, rate_burst_bytes, "+
+			"billing_period, to_char(billing_anchor, 'YYYY-MM-DD') FROM users WHERE username = $1",
+		username,
+	).Scan(&l.dataLimit, &l.maxConnections, &l.uploadRate, &l.downloadRate, &l.rateBurst, &l.billingPeriod, &l.billingAnchor)
+	metrics.ObservePostgres("get_user_limits", start)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Printf("postgres query error for limits: %v", err)
 		}
-		return 0, 0
+		return userLimits{}
 	}
 
 	r.client.HSet(ctx, redisKey, map[string]interface{}{
-		"data_limit_bytes": dataLimit,
-		"max_connections":  maxConns,
+		"data_limit_bytes":    l.dataLimit,
+		"max_connections":     l.maxConnections,
+		"upload_rate_bytes":   l.uploadRate,
+		"download_rate_bytes": l.downloadRate,
+		"rate_burst_bytes":    l.rateBurst,
+		"billing_period":      l.billingPeriod,
+		"billing_anchor":      l.billingAnchor,
 	})
-	r.client.Expire(ctx, redisKey, time.Hour)
-	return dataLimit, maxConns
+	r.client.Expire(ctx, redisKey, CacheTTL())
+	return l
+}
+
+// currentPeriod returns the start and end of the user's billing period
+// around now. ok is false when the user has none.
+func (r *RedisRepo) currentPeriod(username string, now time.Time) (start, end time.Time, ok bool) {
+	l := r.loadLimits(username)
+	if l.billingPeriod == "" || l.billingPeriod == limits.PeriodNone {
+		return start, end, false
+	}
+	anchor, err := time.Parse(time.DateOnly, l.billingAnchor)
+	if err != nil {
+		log.Printf("User %s: bad billing anchor %q: %v", username, l.billingAnchor, err)
+		return start, end, false
+	}
+	start, end, err = limits.PeriodBounds(l.billingPeriod, anchor, now)
+	if err != nil {
+		log.Printf("User %s: %v", username, err)
+		return start, end, false
+	}
+	return start, end, true
 }
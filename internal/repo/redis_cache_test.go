@@ -0,0 +1,111 @@
+package repo
+
+import (
+	"awesomeProject11/internal/auth"
+	"database/sql"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectPassword expects one ValidateUser query for alice. A nil password
+// finds no user allowed to log in with one.
+func expectPassword(mock sqlmock.Sqlmock, password any) {
+	query := mock.ExpectQuery(regexp.QuoteMeta("SELECT password FROM users WHERE username = $1")).
+		WithArgs("alice", auth.MethodBasic)
+	if password == nil {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(password))
+}
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	return hash
+}
+
+func TestValidateUserUpgradesLegacyPassword(t *testing.T) {
+	client, mr := newTestRedis(t)
+	db, mock := newTestDB(t)
+	r := NewRedisRepo(client, db)
+
+	expectPassword(mock, "secret")
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $1 WHERE username = $2 AND password = $3")).
+		WithArgs(sqlmock.AnyArg(), "alice", "secret").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if !r.ValidateUser("alice", "secret") {
+		t.Fatal("expected the legacy password to be accepted")
+	}
+	cached, _ := mr.Get(credentialsKey("alice"))
+	if !auth.IsPasswordHash(cached) || !auth.VerifyPassword(cached, "secret") {
+		t.Errorf("expected the upgraded hash to be cached, got %q", cached)
+	}
+	// The next login is checked against the cached hash.
+	if !r.ValidateUser("alice", "secret") {
+		t.Error("expected the cached hash to accept the password")
+	}
+}
+
+func TestValidateUserCachesMissingUser(t *testing.T) {
+	client, mr := newTestRedis(t)
+	db, mock := newTestDB(t)
+	r := NewRedisRepo(client, db)
+
+	expectPassword(mock, nil)
+	for range 2 {
+		if r.ValidateUser("alice", "secret") {
+			t.Fatal("expected a missing user to be refused")
+		}
+	}
+	if cached, _ := mr.Get(credentialsKey("alice")); cached != noCredentials {
+		t.Errorf("cached credentials = %q, want %q", cached, noCredentials)
+	}
+	if ttl := mr.TTL(credentialsKey("alice")); ttl != noCredentialsTTL {
+		t.Errorf("cache TTL = %v, want %v", ttl, noCredentialsTTL)
+	}
+}
+
+func TestValidateUserCachesHashOnWrongPassword(t *testing.T) {
+	client, mr := newTestRedis(t)
+	db, mock := newTestDB(t)
+	r := NewRedisRepo(client, db)
+	hash := hashPassword(t, "secret")
+
+	expectPassword(mock, hash)
+	if r.ValidateUser("alice", "wrong") {
+		t.Fatal("expected the wrong password to be refused")
+	}
+	if cached, _ := mr.Get(credentialsKey("alice")); cached != hash {
+		t.Errorf("cached credentials = %q, want the hash", cached)
+	}
+	if !r.ValidateUser("alice", "secret") {
+		t.Error("expected the cached hash to accept the right password")
+	}
+}
+
+func TestValidateUserDoesNotCacheAfterDisable(t *testing.T) {
+	client, mr := newTestRedis(t)
+	db, mock := newTestDB(t)
+	r := NewRedisRepo(client, db)
+	s := NewUserStore(db, client)
+
+	// A lookup reads the version, then the user is disabled while it
+	// queries Postgres.
+	version, _ := mr.Get(credentialsVersionKey("alice"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET enabled = $1")).WithArgs(false, "alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.SetEnabled("alice", false); err != nil {
+		t.Fatalf("SetEnabled: %v", err)
+	}
+
+	r.cacheCredentials("alice", hashPassword(t, "secret"), CacheTTL(), version)
+	if mr.Exists(credentialsKey("alice")) {
+		t.Error("expected the lookup started before the change not to be cached")
+	}
+}
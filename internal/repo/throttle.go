@@ -0,0 +1,158 @@
+package repo
+
+import (
+	"awesomeProject11/internal/domain"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func rateBucketKey(username, direction string) string {
+	return "user:" + username + ":rate:" + direction
+}
+
+// tokenBucketScript takes n tokens from a bucket refilled at rate tokens per
+// second up to burst. The bucket may go into debt, in which case the caller
+// has to wait the returned number of milliseconds before sending. Time comes
+// from the Redis server so all proxy instances share one clock.
+//
+// KEYS[1] bucket, ARGV[1] rate, ARGV[2] burst, ARGV[3] n
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + (now - ts) * rate / 1000) - n
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+
+if tokens >= 0 then
+	return 0
+end
+return math.ceil(-tokens * 1000 / rate)
+`)
+
+// rateGrantInterval is how much traffic an instance takes from a user's
+// bucket at once. Tokens are kept locally until used, so a bucket costs one
+// script run per grant instead of one per chunk.
+const rateGrantInterval = 250 * time.Millisecond
+
+// redisRateLimiter is a token bucket kept in Redis, so one user's budget is
+// shared by every connection on every proxy instance. Tokens are taken from
+// Redis in grants and shared by the user's connections on this instance.
+type redisRateLimiter struct {
+	client *redis.Client
+	key    string
+
+	mu    sync.Mutex
+	rate  int64
+	burst int64
+	// tokens were taken from the bucket and not used yet. They may be spent
+	// once readyAt has passed.
+	tokens  int64
+	readyAt time.Time
+}
+
+// refill takes at least need tokens from the bucket. A bucket in debt moves
+// readyAt to when the debt is paid off.
+func (l *redisRateLimiter) refill(need int64) {
+	grant := max(need, min(l.burst, l.rate*int64(rateGrantInterval)/int64(time.Second)))
+	waitMs, err := tokenBucketScript.Run(ctx, l.client, []string{l.key}, l.rate, l.burst, grant).Int64()
+	if err != nil {
+		// Throttling fails open: a Redis outage should not stall tunnels.
+		log.Printf("Failed to take rate limit tokens for %s: %v", l.key, err)
+		l.tokens += need
+		return
+	}
+	l.tokens += grant
+	if ready := time.Now().Add(time.Duration(waitMs) * time.Millisecond); ready.After(l.readyAt) {
+		l.readyAt = ready
+	}
+}
+
+func (l *redisRateLimiter) WaitN(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	if l.tokens < int64(n) {
+		l.refill(int64(n) - l.tokens)
+	}
+	l.tokens -= int64(n)
+	wait := time.Until(l.readyAt)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *redisRateLimiter) AllowN(n int) bool {
+	if n <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tokens < int64(n) && !time.Now().Before(l.readyAt) {
+		l.refill(int64(n) - l.tokens)
+	}
+	if l.tokens < int64(n) || time.Now().Before(l.readyAt) {
+		return false
+	}
+	l.tokens -= int64(n)
+	return true
+}
+
+// RateLimiters returns the upload and download limiters configured for the
+// user in the upload_rate_bytes, download_rate_bytes and rate_burst_bytes
+// columns. A rate of 0 leaves that direction unlimited; a burst of 0 allows
+// one second worth of traffic.
+func (r *RedisRepo) RateLimiters(username string) (domain.RateLimiter, domain.RateLimiter) {
+	limits := r.loadLimits(username)
+
+	return r.rateLimiter(username, "up", limits.uploadRate, limits.rateBurst),
+		r.rateLimiter(username, "down", limits.downloadRate, limits.rateBurst)
+}
+
+func (r *RedisRepo) rateLimiter(username, direction string, rate, burst int64) domain.RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	key := rateBucketKey(username, direction)
+
+	r.limitersMu.Lock()
+	defer r.limitersMu.Unlock()
+	l, ok := r.limiters[key]
+	if !ok {
+		l = &redisRateLimiter{client: r.client, key: key}
+		r.limiters[key] = l
+	}
+	l.mu.Lock()
+	l.rate, l.burst = rate, burst
+	l.mu.Unlock()
+	return l
+}
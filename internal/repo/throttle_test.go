@@ -0,0 +1,43 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRateLimiterTakesTokensInGrants(t *testing.T) {
+	client, mr := newTestRedis(t)
+	r := NewRedisRepo(client, nil)
+	l := r.rateLimiter("alice", "up", 1000, 1000)
+
+	// A quarter second of traffic is taken at once and used up locally.
+	for range 2 {
+		if err := l.WaitN(context.Background(), 100); err != nil {
+			t.Fatalf("WaitN: %v", err)
+		}
+	}
+	if got := mr.HGet(rateBucketKey("alice", "up"), "tokens"); got != "750" {
+		t.Errorf("bucket tokens = %q, want 750", got)
+	}
+	if r.rateLimiter("alice", "up", 1000, 1000) != l {
+		t.Error("expected the user's connections to share one limiter")
+	}
+}
+
+func TestRateLimiterWaitIsCancelled(t *testing.T) {
+	client, _ := newTestRedis(t)
+	l := NewRedisRepo(client, nil).rateLimiter("alice", "up", 1000, 1000)
+
+	if err := l.WaitN(context.Background(), 1000); err != nil {
+		t.Fatalf("WaitN within the burst: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 500); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if l.AllowN(1) {
+		t.Error("expected AllowN to refuse while the bucket is in debt")
+	}
+}
@@ -0,0 +1,149 @@
+package repo
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/metrics"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrTokenNotFound is returned for an API token id the user does not have.
+var ErrTokenNotFound = errors.New("api token not found")
+
+// APIToken describes an API token without the token itself, which is only
+// returned by CreateToken.
+type APIToken struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The owner of a token is cached under apiTokenKey(auth.HashToken(token))
+// for CacheTTL(), only while the user may log in with it.
+func apiTokenKey(hash string) string { return "api_token:" + hash }
+
+// UserByToken returns the user an API token belongs to. The user must be
+// enabled and allowed to use tokens.
+func (r *RedisRepo) UserByToken(token string) (string, bool) {
+	hash := auth.HashToken(token)
+
+	username, err := r.client.Get(ctx, apiTokenKey(hash)).Result()
+	if err == nil {
+		return username, true
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading API token: %v", err)
+	}
+
+	start := time.Now()
+	err = r.db.QueryRow(
+		"SELECT t.username FROM api_tokens t JOIN users u ON u.username = t.username "+
+			"WHERE t.token_hash = $1 AND u.enabled AND $2 = ANY(u.auth_methods)",
+		hash, auth.MethodToken,
+	).Scan(&username)
+	metrics.ObservePostgres("user_by_token", start)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Posgres query error: %v", err)
+		}
+		return "", false
+	}
+
+	if err := r.client.Set(ctx, apiTokenKey(hash), username, CacheTTL()).Err(); err != nil {
+		log.Printf("Failed to cache API token in Redis: %v", err)
+	}
+	return username, true
+}
+
+// CreateToken issues a new API token for a user and returns it with its
+// description. The token cannot be read back later.
+func (s *UserStore) CreateToken(username, name string) (string, APIToken, error) {
+	token, err := auth.NewToken()
+	if err != nil {
+		return "", APIToken{}, fmt.Errorf("failed to generate API token: %v", err)
+	}
+
+	t := APIToken{Name: name}
+	err = s.db.QueryRow(
+		"INSERT INTO api_tokens (username, name, token_hash) VALUES ($1, $2, $3) RETURNING id, created_at",
+		username, name, auth.HashToken(token),
+	).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return "", APIToken{}, ErrUserNotFound
+		}
+		return "", APIToken{}, fmt.Errorf("failed to create API token for %s: %v", username, err)
+	}
+	return token, t, nil
+}
+
+// Tokens lists the API tokens of a user.
+func (s *UserStore) Tokens(username string) ([]APIToken, error) {
+	if _, err := s.GetUser(username); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		"SELECT id, name, created_at FROM api_tokens WHERE username = $1 ORDER BY id", username,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens of %s: %v", username, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteToken revokes an API token of a user.
+func (s *UserStore) DeleteToken(username string, id int64) error {
+	var hash string
+	err := s.db.QueryRow(
+		"DELETE FROM api_tokens WHERE id = $1 AND username = $2 RETURNING token_hash", id, username,
+	).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete API token %d: %v", id, err)
+	}
+
+	s.del(apiTokenKey(hash))
+	return nil
+}
+
+// dropTokens removes the cached tokens of a user, e.g. after the user was
+// disabled.
+func (s *UserStore) dropTokens(username string) {
+	var hashes []string
+	err := s.db.QueryRow(
+		"SELECT array_agg(token_hash) FROM api_tokens WHERE username = $1", username,
+	).Scan(pq.Array(&hashes))
+	if err != nil {
+		log.Printf("Failed to invalidate API tokens: %v", err)
+		return
+	}
+	keys := make([]string, len(hashes))
+	for i, hash := range hashes {
+		keys[i] = apiTokenKey(hash)
+	}
+	if len(keys) > 0 {
+		s.del(keys...)
+	}
+}
@@ -0,0 +1,179 @@
+package repo
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UsageIntervals are the buckets traffic_logs can be aggregated by.
+var UsageIntervals = map[string]bool{
+	"hour":  true,
+	"day":   true,
+	"month": true,
+}
+
+// UsageBucket is the traffic of one user in one interval starting at Start.
+type UsageBucket struct {
+	Start     time.Time `json:"period_start"`
+	BytesUsed int64     `json:"bytes_used"`
+}
+
+// UsagePeriod is the total of a closed billing period.
+type UsagePeriod struct {
+	Start     time.Time `json:"period_start"`
+	End       time.Time `json:"period_end"`
+	BytesUsed int64     `json:"bytes_used"`
+}
+
+// UserUsage is the traffic of one user over a whole report range.
+type UserUsage struct {
+	Username  string `json:"username"`
+	BytesUsed int64  `json:"bytes_used"`
+}
+
+// LiveUsage is the counter the proxy enforces data limits with.
+type LiveUsage struct {
+	Username       string `json:"username"`
+	DataUsedBytes  int64  `json:"data_used_bytes"`
+	DataLimitBytes int64  `json:"data_limit_bytes"`
+}
+
+// UsageStore reads the traffic_logs rows written by AsyncLogger and the
+// live counters kept in Redis.
+type UsageStore struct {
+	db    *sql.DB
+	redis *redis.Client
+}
+
+func NewUsageStore(db *sql.DB, redisClient *redis.Client) *UsageStore {
+	return &UsageStore{
+		db:    db,
+		redis: redisClient,
+	}
+}
+
+// UsageByInterval aggregates a user's traffic in [from, to) into UTC
+// buckets of the given interval.
+func (s *UsageStore) UsageByInterval(username, interval string, from, to time.Time) ([]UsageBucket, error) {
+	if !UsageIntervals[interval] {
+		return nil, fmt.Errorf("unknown interval %q", interval)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT date_trunc($1, timestamp AT TIME ZONE 'UTC') AS bucket, SUM(bytes_used)
+		FROM traffic_logs
+		WHERE username = $2 AND timestamp >= $3 AND timestamp < $4
+		GROUP BY bucket
+		ORDER BY bucket`,
+		interval, username, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage for %s: %v", username, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	buckets := []UsageBucket{}
+	for rows.Next() {
+		var b UsageBucket
+		if err := rows.Scan(&b.Start, &b.BytesUsed); err != nil {
+			return nil, fmt.Errorf("failed to read usage: %v", err)
+		}
+		b.Start = b.Start.UTC()
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// TopUsers returns the n users with the most traffic in [from, to).
+func (s *UsageStore) TopUsers(from, to time.Time, n int) ([]UserUsage, error) {
+	rows, err := s.db.Query(`
+		SELECT username, SUM(bytes_used) AS total
+		FROM traffic_logs
+		WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY username
+		ORDER BY total DESC
+		LIMIT $3`,
+		from, to, n,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query top users: %v", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	users := []UserUsage{}
+	for rows.Next() {
+		var u UserUsage
+		if err := rows.Scan(&u.Username, &u.BytesUsed); err != nil {
+			return nil, fmt.Errorf("failed to read usage: %v", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// LiveUsage returns the current value of user:<name>:data_used, which also
+// includes traffic not yet flushed to traffic_logs.
+func (s *UsageStore) LiveUsage(username string) (LiveUsage, error) {
+	usage := LiveUsage{Username: username}
+
+	err := s.db.QueryRow("SELECT COALESCE(data_limit_bytes, 0) FROM users WHERE username = $1", username).Scan(&usage.DataLimitBytes)
+	if err == sql.ErrNoRows {
+		return usage, ErrUserNotFound
+	}
+	if err != nil {
+		return usage, fmt.Errorf("failed to read user %s: %v", username, err)
+	}
+
+	val, err := s.redis.Get(ctx, dataUsedKey(username)).Result()
+	if err == redis.Nil {
+		return usage, nil
+	}
+	if err != nil {
+		return usage, fmt.Errorf("failed to read live usage for %s: %v", username, err)
+	}
+	usage.DataUsedBytes, err = strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return usage, fmt.Errorf("failed to parse live usage for %s: %v", username, err)
+	}
+	return usage, nil
+}
+
+// Periods returns the closed billing periods of a user, newest first.
+func (s *UsageStore) Periods(username string) ([]UsagePeriod, error) {
+	rows, err := s.db.Query(
+		"SELECT period_start, period_end, bytes_used FROM usage_periods WHERE username = $1 ORDER BY period_start DESC",
+		username,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage periods for %s: %v", username, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	periods := []UsagePeriod{}
+	for rows.Next() {
+		var p UsagePeriod
+		if err := rows.Scan(&p.Start, &p.End, &p.BytesUsed); err != nil {
+			return nil, fmt.Errorf("failed to read usage period: %v", err)
+		}
+		p.Start, p.End = p.Start.UTC(), p.End.UTC()
+		periods = append(periods, p)
+	}
+	return periods, rows.Err()
+}
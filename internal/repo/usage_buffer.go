@@ -0,0 +1,319 @@
+package repo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// UsageFlushInterval is how often buffered traffic is written to Redis.
+	UsageFlushInterval = time.Second
+	// UsageRefreshInterval is how old the local view of a user's data_used
+	// may get before it is read again, which is how traffic of other proxy
+	// instances becomes visible.
+	UsageRefreshInterval = 5 * time.Second
+	// DefaultMaxOvershoot is the default for SetMaxOvershoot.
+	DefaultMaxOvershoot = 1 << 20
+
+	usageIdleTimeout = 10 * time.Minute
+
+	// usageSyncTTL is how long an applied sync is remembered, which bounds
+	// how late a retry may come and still be recognised.
+	usageSyncTTL = time.Hour
+)
+
+func usageSyncKey(id string) string { return "usage_sync:" + id }
+
+// userUsage is the in-process view of one user's data counter.
+type userUsage struct {
+	// syncMu serialises round trips so an older reply never overwrites a
+	// newer one.
+	syncMu sync.Mutex
+
+	mu      sync.Mutex
+	known   int64 // data_used in Redis at the last sync
+	pending int64 // bytes counted here but not yet added in Redis
+	// retryID and retryN are a sync that failed and may or may not have
+	// been applied. They are only changed with syncMu held.
+	retryID string
+	retryN  int64
+	limit   int64 // limit of the last IsOverDataLimit call
+	synced  time.Time
+	touched time.Time
+	// periodEnd is when the billing period the counter was last synced in
+	// ends, zero without a billing period.
+	periodEnd time.Time
+	// periodStart and periodLoaded are only used with syncMu held.
+	periodStart  string
+	periodLoaded time.Time
+	// evicted is set when flushAll drops the entry. Callers that looked it
+	// up before that have to look the user up again.
+	evicted bool
+}
+
+// usageBuffer batches AddData in process. Traffic is written to Redis with
+// one pipelined round trip per user per UsageFlushInterval, or as soon as a
+// user has maxPending unwritten bytes. Once a user is within maxPending of
+// their limit every check and every write goes to Redis, so the unwritten
+// traffic of one instance never lets a user exceed data_limit_bytes by more
+// than maxPending bytes plus the chunk in flight on each connection.
+type usageBuffer struct {
+	client *redis.Client
+	// instance and seq make the ids that let Redis recognise a retried
+	// sync.
+	instance string
+	seq      atomic.Uint64
+	// period returns a user's current billing period, ok is false when
+	// the user has none. A nil period leaves counters to QuotaResetter.
+	period func(username string, now time.Time) (start, end time.Time, ok bool)
+
+	mu         sync.Mutex
+	users      map[string]*userUsage
+	maxPending int64
+}
+
+func newUsageBuffer(client *redis.Client) *usageBuffer {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic("failed to generate instance id: " + err.Error())
+	}
+	return &usageBuffer{
+		client:     client,
+		instance:   hex.EncodeToString(id),
+		users:      make(map[string]*userUsage),
+		maxPending: DefaultMaxOvershoot,
+	}
+}
+
+func (b *usageBuffer) user(username string) *userUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, ok := b.users[username]
+	if !ok {
+		u = &userUsage{}
+		b.users[username] = u
+	}
+	return u
+}
+
+// lockUser returns the user's entry with u.mu held.
+func (b *usageBuffer) lockUser(username string) *userUsage {
+	for {
+		u := b.user(username)
+		u.mu.Lock()
+		if !u.evicted {
+			return u
+		}
+		u.mu.Unlock()
+	}
+}
+
+func (b *usageBuffer) overshoot() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxPending
+}
+
+func (b *usageBuffer) add(username string, n int64) {
+	maxPending := b.overshoot()
+	u := b.lockUser(username)
+	u.pending += n
+	u.touched = time.Now()
+	flush := u.pending >= maxPending || u.nearLimit(maxPending)
+	u.mu.Unlock()
+
+	if flush {
+		b.sync(username, u)
+	}
+}
+
+func (b *usageBuffer) isOver(username string, limit int64) bool {
+	if limit == 0 {
+		return false
+	}
+	maxPending := b.overshoot()
+	u := b.lockUser(username)
+	u.limit = limit
+	u.touched = time.Now()
+	// A counter read in an ended period is stale, so the reset is seen as
+	// soon as the period ends.
+	stale := time.Since(u.synced) > UsageRefreshInterval ||
+		!u.periodEnd.IsZero() && !time.Now().Before(u.periodEnd)
+	near := u.nearLimit(maxPending)
+	u.mu.Unlock()
+
+	if stale || near {
+		if err := b.sync(username, u); err != nil && stale {
+			// Same as before batching: when the counter cannot be read
+			// the user is treated as over the limit.
+			return true
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return limit < u.known+u.unsynced()
+}
+
+// nearLimit reports whether batching could push the user over their limit.
+// u.mu must be held.
+func (u *userUsage) nearLimit(maxPending int64) bool {
+	return u.limit > 0 && u.limit-(u.known+u.unsynced()) < maxPending
+}
+
+// unsynced is the number of bytes not known to be in Redis yet. u.mu must
+// be held.
+func (u *userUsage) unsynced() int64 {
+	return u.pending + u.retryN
+}
+
+// usageSyncScript rolls the counter over when a new billing period has
+// started, see rolloverLua, then adds ARGV[3] bytes to data_used and the
+// pending traffic logs and returns the new data_used. The bytes are only
+// added once per sync id, so a sync retried after an error that hid its
+// success is not counted twice.
+//
+// KEYS[1] data_used, KEYS[2] period_start, KEYS[3] pending periods,
+// KEYS[4] pending logs, KEYS[5] sync id
+// ARGV[1] current period start (unix) or ”, ARGV[2] username, ARGV[3] bytes,
+// ARGV[4] ttl of the sync id in ms
+var usageSyncScript = redis.NewScript(rolloverLua + `
+local n = tonumber(ARGV[3])
+if n > 0 and redis.call('SET', KEYS[5], 1, 'NX', 'PX', ARGV[4]) then
+	redis.call('HINCRBY', KEYS[4], ARGV[2], n)
+	return redis.call('INCRBY', KEYS[1], n)
+end
+return tonumber(redis.call('GET', KEYS[1]) or '0')
+`)
+
+// sync writes the user's pending bytes to Redis and refreshes the known
+// total from the reply. The counter is rolled over first when the user's
+// billing period has ended, and data_used and the pending logs are updated
+// in the same script, so a failed sync never leaves only one of them
+// counted. A failed sync is retried on its own with the same id before new
+// bytes are written.
+func (b *usageBuffer) sync(username string, u *userUsage) error {
+	u.syncMu.Lock()
+	defer u.syncMu.Unlock()
+
+	start := b.periodStart(username, u)
+
+	u.mu.Lock()
+	id, n := u.retryID, u.retryN
+	if id == "" {
+		id = b.instance + ":" + strconv.FormatUint(b.seq.Add(1), 10)
+		n = u.pending
+		u.pending = 0
+		// Until the reply the bytes count as unsynced under the id.
+		u.retryID, u.retryN = id, n
+	}
+	u.mu.Unlock()
+
+	keys := []string{dataUsedKey(username), periodStartKey(username), pendingPeriodsKey, pendingLogsKey, usageSyncKey(id)}
+	known, err := usageSyncScript.Run(ctx, b.client, keys, start, username, n, usageSyncTTL.Milliseconds()).Int64()
+	if err != nil {
+		log.Printf("Failed to sync data used of user %s with Redis: %v", username, err)
+		return err
+	}
+
+	u.mu.Lock()
+	u.retryID, u.retryN = "", 0
+	u.known = known
+	u.synced = time.Now()
+	u.mu.Unlock()
+	return nil
+}
+
+// periodStart returns the start of the user's billing period in unix
+// seconds, "" when the user has none. The billing settings are looked up
+// again every UsageRefreshInterval and when the period has ended. u.syncMu
+// must be held.
+func (b *usageBuffer) periodStart(username string, u *userUsage) string {
+	if b.period == nil {
+		return ""
+	}
+	now := time.Now()
+	u.mu.Lock()
+	end := u.periodEnd
+	u.mu.Unlock()
+	if now.Sub(u.periodLoaded) <= UsageRefreshInterval && (end.IsZero() || now.Before(end)) {
+		return u.periodStart
+	}
+
+	start, end, ok := b.period(username, now)
+	u.periodStart = ""
+	if ok {
+		u.periodStart = strconv.FormatInt(start.Unix(), 10)
+	} else {
+		end = time.Time{}
+	}
+	u.periodLoaded = now
+	u.mu.Lock()
+	u.periodEnd = end
+	u.mu.Unlock()
+	return u.periodStart
+}
+
+// flushAll writes every user's pending bytes and forgets users that have
+// been idle for a while.
+func (b *usageBuffer) flushAll() {
+	b.mu.Lock()
+	users := make(map[string]*userUsage, len(b.users))
+	for username, u := range b.users {
+		u.mu.Lock()
+		idle := u.unsynced() == 0 && time.Since(u.touched) > usageIdleTimeout
+		if idle {
+			u.evicted = true
+		}
+		u.mu.Unlock()
+		if idle {
+			delete(b.users, username)
+			continue
+		}
+		users[username] = u
+	}
+	b.mu.Unlock()
+
+	for username, u := range users {
+		u.mu.Lock()
+		pending := u.unsynced()
+		u.mu.Unlock()
+		if pending > 0 {
+			_ = b.sync(username, u)
+		}
+	}
+}
+
+// SetMaxOvershoot sets how many bytes of a user's traffic this instance may
+// hold before writing them to Redis, which is also how far past
+// data_limit_bytes the instance can let the user go.
+func (r *RedisRepo) SetMaxOvershoot(n int64) {
+	r.usage.mu.Lock()
+	r.usage.maxPending = n
+	r.usage.mu.Unlock()
+}
+
+// RunUsageFlusher writes buffered traffic to Redis every UsageFlushInterval.
+func (r *RedisRepo) RunUsageFlusher() {
+	log.Println("Usage flush worker started")
+
+	ticker := time.NewTicker(UsageFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.usage.flushAll()
+	}
+}
+
+// FlushUsage writes all buffered traffic to Redis. It is called on
+// shutdown after the last connection has closed.
+func (r *RedisRepo) FlushUsage() {
+	r.usage.flushAll()
+}
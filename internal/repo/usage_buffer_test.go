@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageSyncWritesCounterAndLogs(t *testing.T) {
+	client, mr := newTestRedis(t)
+	b := newUsageBuffer(client)
+
+	b.add("alice", 100)
+	b.add("alice", 50)
+	b.flushAll()
+
+	if got, _ := mr.Get(dataUsedKey("alice")); got != "150" {
+		t.Errorf("data used = %q, want 150", got)
+	}
+	if got := mr.HGet(pendingLogsKey, "alice"); got != "150" {
+		t.Errorf("pending logs = %q, want 150", got)
+	}
+}
+
+func TestAddAfterEviction(t *testing.T) {
+	client, mr := newTestRedis(t)
+	b := newUsageBuffer(client)
+
+	// An entry looked up just before flushAll drops it must not swallow
+	// the bytes added through it.
+	stale := b.user("alice")
+	stale.touched = time.Now().Add(-2 * usageIdleTimeout)
+	b.flushAll()
+	if !stale.evicted {
+		t.Fatal("expected the idle entry to be evicted")
+	}
+
+	b.add("alice", 100)
+	if stale.pending != 0 {
+		t.Errorf("evicted entry got %d pending bytes", stale.pending)
+	}
+	b.flushAll()
+	if got, _ := mr.Get(dataUsedKey("alice")); got != "100" {
+		t.Errorf("data used = %q, want 100", got)
+	}
+}
+
+func TestUsageSyncRetryIsIdempotent(t *testing.T) {
+	client, mr := newTestRedis(t)
+	b := newUsageBuffer(client)
+
+	// "applied" reached Redis although its reply was lost, "lost" did not.
+	mr.Set(usageSyncKey("applied"), "1")
+	mr.Set(dataUsedKey("alice"), "100")
+	mr.HSet(pendingLogsKey, "alice", "100")
+	for _, retry := range []string{"applied", "lost"} {
+		u := b.user("alice")
+		u.retryID, u.retryN = retry, 100
+		if err := b.sync("alice", u); err != nil {
+			t.Fatalf("retry of %s: %v", retry, err)
+		}
+	}
+
+	if got, _ := mr.Get(dataUsedKey("alice")); got != "200" {
+		t.Errorf("data used = %q, want 200", got)
+	}
+	if got := mr.HGet(pendingLogsKey, "alice"); got != "200" {
+		t.Errorf("pending logs = %q, want 200", got)
+	}
+}
@@ -0,0 +1,282 @@
+package repo
+
+import (
+	"awesomeProject11/internal/auth"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserInUse    = errors.New("user has traffic history")
+)
+
+// UserInfo is a row of the users table without the password.
+type UserInfo struct {
+	Username       string `json:"username"`
+	Enabled        bool   `json:"enabled"`
+	DataLimitBytes int64  `json:"data_limit_bytes"`
+	MaxConnections int64  `json:"max_connections"`
+	// Bandwidth limits in bytes per second, 0 means unlimited.
+	UploadRateBytes   int64  `json:"upload_rate_bytes"`
+	DownloadRateBytes int64  `json:"download_rate_bytes"`
+	RateBurstBytes    int64  `json:"rate_burst_bytes"`
+	BillingPeriod     string `json:"billing_period"`
+	BillingAnchor     string `json:"billing_anchor"`
+	// EgressAddress or EgressPool select the outbound address, both empty
+	// means the host's default.
+	EgressAddress string `json:"egress_address"`
+	EgressPool    string `json:"egress_pool"`
+	// AllowedEgressPools may be picked with the pool username option.
+	AllowedEgressPools []string `json:"allowed_egress_pools"`
+	// AuthMethods are the ways the user may log in, see auth.MethodBasic.
+	AuthMethods []string `json:"auth_methods"`
+}
+
+// UserStore manages the users table for the admin API. Every write also
+// rewrites or drops the Redis entries RedisRepo caches for the user, so a
+// change reaches running proxies immediately instead of after the cache TTL.
+type UserStore struct {
+	db    *sql.DB
+	redis *redis.Client
+}
+
+func NewUserStore(db *sql.DB, redisClient *redis.Client) *UserStore {
+	return &UserStore{
+		db:    db,
+		redis: redisClient,
+	}
+}
+
+const userColumns = "username, enabled, COALESCE(data_limit_bytes, 0), COALESCE(max_connections, 0), " +
+	"upload_rate_bytes, download_rate_bytes, rate_burst_bytes, billing_period, to_char(billing_anchor, 'YYYY-MM-DD'), " +
+	"COALESCE(host(egress_address), ''), COALESCE(egress_pool, ''), allowed_egress_pools, auth_methods"
+
+func scanUser(row interface{ Scan(...any) error }) (UserInfo, error) {
+	var u UserInfo
+	err := row.Scan(&u.Username, &u.Enabled, &u.DataLimitBytes, &u.MaxConnections,
+		&u.UploadRateBytes, &u.DownloadRateBytes, &u.RateBurstBytes, &u.BillingPeriod, &u.BillingAnchor,
+		&u.EgressAddress, &u.EgressPool, pq.Array(&u.AllowedEgressPools), pq.Array(&u.AuthMethods))
+	return u, err
+}
+
+func (s *UserStore) ListUsers() ([]UserInfo, error) {
+	rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Failed to close rows: %v", err)
+		}
+	}()
+
+	users := []UserInfo{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read user: %v", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *UserStore) GetUser(username string) (UserInfo, error) {
+	u, err := scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1", username))
+	if err == sql.ErrNoRows {
+		return UserInfo{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("failed to read user %s: %v", username, err)
+	}
+	return u, nil
+}
+
+func (s *UserStore) CreateUser(u UserInfo, password string) (UserInfo, error) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	created, err := scanUser(s.db.QueryRow(
+		"INSERT INTO users (username, password, enabled, data_limit_bytes, max_connections, "+
+			"upload_rate_bytes, download_rate_bytes, rate_burst_bytes, billing_period, billing_anchor) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE(NULLIF($10, '')::date, CURRENT_DATE)) RETURNING "+userColumns,
+		u.Username, hash, u.Enabled, u.DataLimitBytes, u.MaxConnections,
+		u.UploadRateBytes, u.DownloadRateBytes, u.RateBurstBytes, u.BillingPeriod, u.BillingAnchor,
+	))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return UserInfo{}, ErrUserExists
+		}
+		return UserInfo{}, fmt.Errorf("failed to create user %s: %v", u.Username, err)
+	}
+
+	s.dropCache(created.Username)
+	return created, nil
+}
+
+func (s *UserStore) DeleteUser(username string) error {
+	// The identities, tokens and addresses go with the row.
+	s.dropLogins(username)
+
+	res, err := s.db.Exec("DELETE FROM users WHERE username = $1", username)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrUserInUse
+		}
+		return fmt.Errorf("failed to delete user %s: %v", username, err)
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+
+	s.dropCache(username)
+	return nil
+}
+
+func (s *UserStore) SetEnabled(username string, enabled bool) error {
+	res, err := s.db.Exec("UPDATE users SET enabled = $1 WHERE username = $2", enabled, username)
+	if err != nil {
+		return fmt.Errorf("failed to update user %s: %v", username, err)
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+
+	// ValidateUser, UserByCertificate, UserByToken and UserByAddress fall
+	// back to Postgres on a cache miss and only accept enabled users there.
+	s.dropCredentials(username)
+	s.dropLogins(username)
+	return nil
+}
+
+func (s *UserStore) SetPassword(username, password string) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	// The hash is only cached for users who may log in with it.
+	var enabled bool
+	err = s.db.QueryRow(
+		"UPDATE users SET password = $1 WHERE username = $2 RETURNING enabled AND $3 = ANY(auth_methods)",
+		hash, username, auth.MethodBasic,
+	).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update password for %s: %v", username, err)
+	}
+
+	if !enabled {
+		s.dropCredentials(username)
+		return nil
+	}
+	// Bumping the version keeps a lookup that read the old password from
+	// caching it over the new one.
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, credentialsVersionKey(username))
+		pipe.Expire(ctx, credentialsVersionKey(username), CacheTTL())
+		pipe.Set(ctx, credentialsKey(username), hash, CacheTTL())
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to cache credentials in Redis: %v", err)
+		s.dropCredentials(username)
+	}
+	return nil
+}
+
+// SetLimits writes the data, connection and bandwidth limits of u.
+func (s *UserStore) SetLimits(u UserInfo) error {
+	res, err := s.db.Exec(
+		"UPDATE users SET data_limit_bytes = $1, max_connections = $2, "+
+			"upload_rate_bytes = $3, download_rate_bytes = $4, rate_burst_bytes = $5 WHERE username = $6",
+		u.DataLimitBytes, u.MaxConnections, u.UploadRateBytes, u.DownloadRateBytes, u.RateBurstBytes, u.Username,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update limits for %s: %v", u.Username, err)
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+
+	// The proxy reloads the whole row into user_limits:<name> on its next
+	// lookup.
+	s.del(limitsKey(u.Username))
+	return nil
+}
+
+// SetBilling changes the billing period. The proxy picks the new period up
+// with the rest of user_limits:<name> and rolls the counter over once a
+// later period starts.
+func (s *UserStore) SetBilling(username, period, anchor string) error {
+	res, err := s.db.Exec(
+		"UPDATE users SET billing_period = $1, billing_anchor = $2 WHERE username = $3",
+		period, anchor, username,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update billing period for %s: %v", username, err)
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+	s.del(limitsKey(username))
+	return nil
+}
+
+func (s *UserStore) dropCache(username string) {
+	s.dropCredentials(username)
+	s.del(limitsKey(username), aclKey(username), egressKey(username))
+}
+
+// dropCredentials removes the cached password lookup of a user and bumps
+// its version, so a ValidateUser that is still querying Postgres does not
+// cache the old answer again.
+func (s *UserStore) dropCredentials(username string) {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, credentialsKey(username))
+		pipe.Incr(ctx, credentialsVersionKey(username))
+		pipe.Expire(ctx, credentialsVersionKey(username), CacheTTL())
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to invalidate Redis cache of %s's credentials: %v", username, err)
+	}
+}
+
+// dropLogins removes the cached certificate identities, API tokens and
+// client addresses of a user.
+func (s *UserStore) dropLogins(username string) {
+	s.dropIdentities(username)
+	s.dropTokens(username)
+	s.dropAddresses(username)
+}
+
+func (s *UserStore) del(keys ...string) {
+	if err := s.redis.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Failed to invalidate Redis cache %v: %v", keys, err)
+	}
+}
+
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
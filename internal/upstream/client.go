@@ -0,0 +1,211 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// TargetError means the upstream is working but could not or would not
+// reach the target. Such errors are not retried on another upstream.
+type TargetError struct {
+	Upstream string
+	Reason   string
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("upstream %s: %s", e.Upstream, e.Reason)
+}
+
+// handshake asks the upstream on conn to connect to target.
+func handshake(conn net.Conn, u *url.URL, target string) (net.Conn, error) {
+	if u.Scheme == "socks5" {
+		return conn, socks5Handshake(conn, u, target)
+	}
+	return httpConnect(conn, u, target)
+}
+
+func httpConnect(conn net.Conn, u *url.URL, target string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		// Our credentials are wrong, which is the upstream's problem, not
+		// the target's.
+		return nil, fmt.Errorf("upstream rejected credentials")
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusGatewayTimeout:
+		// 502 and 504 are about the target, any other server error means
+		// the upstream itself is broken or overloaded.
+		return nil, fmt.Errorf("upstream failed: %s", resp.Status)
+	default:
+		return nil, &TargetError{Upstream: u.Host, Reason: resp.Status}
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns bytes the upstream sent right after its CONNECT
+// response before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+const (
+	socks5Version        = 0x05
+	socks5MethodNone     = 0x00
+	socks5MethodUserPass = 0x02
+	socks5AuthVersion    = 0x01
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+
+	socks5RepGeneralFailure = 0x01
+)
+
+var socks5Replies = map[byte]string{
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func socks5Handshake(conn net.Conn, u *url.URL, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socks5MethodNone)
+	if u.User != nil {
+		method = socks5MethodUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return errors.New("upstream refused the SOCKS5 auth method")
+	}
+
+	if method == socks5MethodUserPass {
+		username := u.User.Username()
+		password, _ := u.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("upstream credentials are too long")
+		}
+		msg := []byte{socks5AuthVersion, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("upstream rejected credentials")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return &TargetError{Upstream: u.Host, Reason: "host name too long"}
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] == socks5RepGeneralFailure {
+		// Unlike the other replies this says nothing about the target.
+		return errors.New("upstream failed: general failure")
+	}
+	if header[1] != 0x00 {
+		reason, ok := socks5Replies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply %#x", header[1])
+		}
+		return &TargetError{Upstream: u.Host, Reason: reason}
+	}
+
+	// Skip the bound address.
+	var skip int
+	switch header[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %#x in SOCKS5 reply", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
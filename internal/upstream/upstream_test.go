@@ -0,0 +1,384 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEcho starts a target that echoes what it receives.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// fakeUpstream is a minimal HTTP CONNECT or SOCKS5 proxy. status is the
+// HTTP status or the SOCKS5 reply code it answers with.
+type fakeUpstream struct {
+	addr    string
+	tunnels atomic.Int32
+	// auth is the Proxy-Authorization header of the last CONNECT.
+	auth atomic.Value
+}
+
+func startUpstream(t *testing.T, socks bool, status int) *fakeUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	u := &fakeUpstream{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var target string
+				if socks {
+					target = u.socks5(conn, byte(status))
+				} else {
+					target = u.connect(conn, status)
+				}
+				if target == "" {
+					return
+				}
+				u.tunnels.Add(1)
+				dst, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer dst.Close()
+				go func() { _, _ = io.Copy(dst, conn) }()
+				_, _ = io.Copy(conn, dst)
+			}()
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) connect(conn net.Conn, status int) string {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return ""
+	}
+	u.auth.Store(req.Header.Get("Proxy-Authorization"))
+	_, _ = conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n\r\n"))
+	if status != http.StatusOK {
+		return ""
+	}
+	return req.Host
+}
+
+func (u *fakeUpstream) socks5(conn net.Conn, reply byte) string {
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return ""
+	}
+	_, _ = conn.Write([]byte{socks5Version, socks5MethodNone})
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil {
+		return ""
+	}
+	if buf[3] != socks5AddrDomain {
+		return ""
+	}
+	host := make([]byte, buf[4])
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, host); err != nil {
+		return ""
+	}
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return ""
+	}
+	_, _ = conn.Write([]byte{socks5Version, reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	if reply != 0x00 {
+		return ""
+	}
+	return net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+// deadAddr returns an address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func newPool(t *testing.T, strategy Strategy, retries int, urls ...string) *Pool {
+	t.Helper()
+	opts := Options{Strategy: strategy, Retries: retries, FailThreshold: 1}
+	for _, u := range urls {
+		opts.Members = append(opts.Members, Member{URL: u})
+	}
+	p, err := NewPool(opts)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	return p
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through tunnel failed: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through tunnel, got %q, %v", buf, err)
+	}
+}
+
+func TestDialThroughHTTPUpstream(t *testing.T) {
+	target := startEcho(t)
+	up := startUpstream(t, false, http.StatusOK)
+	pool := newPool(t, RoundRobin, 0, "http://bob:secret@"+up.addr)
+
+	conn, err := pool.DialContext(context.Background(), target, "", "")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	if got := up.auth.Load(); got != "Basic Ym9iOnNlY3JldA==" {
+		t.Errorf("expected upstream credentials to be sent, got %v", got)
+	}
+}
+
+func TestDialThroughSOCKS5Upstream(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+	up := startUpstream(t, true, 0)
+	pool := newPool(t, RoundRobin, 0, "socks5://"+up.addr)
+
+	conn, err := pool.DialContext(context.Background(), net.JoinHostPort("localhost", port), "", "")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func TestFailoverEjectsDeadUpstream(t *testing.T) {
+	target := startEcho(t)
+	dead := deadAddr(t)
+	up := startUpstream(t, false, http.StatusOK)
+	pool := newPool(t, RoundRobin, 1, "http://"+dead, "http://"+up.addr)
+
+	for range 3 {
+		conn, err := pool.DialContext(context.Background(), target, "", "")
+		if err != nil {
+			t.Fatalf("expected failover to the working upstream, got %v", err)
+		}
+		_ = conn.Close()
+	}
+	if up.tunnels.Load() != 3 {
+		t.Errorf("expected 3 tunnels through the working upstream, got %d", up.tunnels.Load())
+	}
+	if !pool.members[0].ejected.Load() {
+		t.Error("expected the dead upstream to be ejected")
+	}
+}
+
+func TestTargetErrorIsNotRetried(t *testing.T) {
+	refusing := startUpstream(t, false, http.StatusBadGateway)
+	working := startUpstream(t, false, http.StatusOK)
+	pool := newPool(t, RoundRobin, 1, "http://"+refusing.addr, "http://"+working.addr)
+
+	_, err := pool.DialContext(context.Background(), deadAddr(t), "", "")
+	var targetErr *TargetError
+	if !errors.As(err, &targetErr) {
+		t.Fatalf("expected a TargetError, got %v", err)
+	}
+	if working.tunnels.Load() != 0 {
+		t.Error("a refused target should not be retried on another upstream")
+	}
+	if pool.members[0].ejected.Load() {
+		t.Error("an upstream refusing a target should stay in rotation")
+	}
+}
+
+func TestUpstreamFailureIsRetried(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+	target := net.JoinHostPort("localhost", port)
+
+	for _, broken := range []string{
+		"http://" + startUpstream(t, false, http.StatusServiceUnavailable).addr,
+		"socks5://" + startUpstream(t, true, socks5RepGeneralFailure).addr,
+	} {
+		working := startUpstream(t, false, http.StatusOK)
+		pool := newPool(t, RoundRobin, 1, broken, "http://"+working.addr)
+
+		conn, err := pool.DialContext(context.Background(), target, "", "")
+		if err != nil {
+			t.Fatalf("%s: expected a retry on the working upstream, got %v", broken, err)
+		}
+		_ = conn.Close()
+		if !pool.members[0].ejected.Load() {
+			t.Errorf("%s: expected the failing upstream to be ejected", broken)
+		}
+	}
+}
+
+func TestDialTriesNamedUpstreamFirst(t *testing.T) {
+	target := startEcho(t)
+	first := startUpstream(t, false, http.StatusOK)
+	pinned := startUpstream(t, false, http.StatusOK)
+	pool := newPool(t, RoundRobin, 0, "http://"+first.addr, "http://"+pinned.addr)
+
+	for range 3 {
+		conn, err := pool.DialContext(context.Background(), target, "", pinned.addr)
+		if err != nil {
+			t.Fatalf("DialContext failed: %v", err)
+		}
+		assertEcho(t, conn)
+		_ = conn.Close()
+	}
+	if pinned.tunnels.Load() != 3 || first.tunnels.Load() != 0 {
+		t.Errorf("expected every tunnel through the named upstream, got %d and %d", first.tunnels.Load(), pinned.tunnels.Load())
+	}
+
+	// An ejected upstream is passed over.
+	pool.members[1].ejected.Store(true)
+	if pool.Healthy(pinned.addr) {
+		t.Error("expected an ejected upstream not to be healthy")
+	}
+	conn, err := pool.DialContext(context.Background(), target, "", pinned.addr)
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+	if first.tunnels.Load() != 1 {
+		t.Error("expected the strategy to pick another upstream")
+	}
+}
+
+func TestStickyKeepsKeyOnUpstream(t *testing.T) {
+	pool := newPool(t, Sticky, 0, "http://127.0.0.1:1", "http://127.0.0.1:2", "http://127.0.0.1:3")
+
+	for _, key := range []string{"alice", "bob", "carol/s1"} {
+		first := pool.pick(key, nil)
+		for range 10 {
+			if got := pool.pick(key, nil); got != first {
+				t.Fatalf("key %q moved from %s to %s", key, first.name, got.name)
+			}
+		}
+	}
+
+	// Ejecting an upstream only moves the keys it had.
+	before := make(map[string]*upstream)
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		before[key] = pool.pick(key, nil)
+	}
+	pool.members[0].ejected.Store(true)
+	for _, key := range keys {
+		if before[key] != pool.members[0] && pool.pick(key, nil) != before[key] {
+			t.Errorf("key %q moved although its upstream is healthy", key)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	pool := newPool(t, LeastConnections, 0, "http://127.0.0.1:1", "http://127.0.0.1:2")
+	pool.members[0].active.Store(5)
+	pool.members[1].active.Store(2)
+
+	if got := pool.pick("", nil); got != pool.members[1] {
+		t.Errorf("expected the upstream with fewer connections, got %s", got.name)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	opts := Options{Strategy: Weighted, Members: []Member{
+		{URL: "http://127.0.0.1:1", Weight: 1},
+		{URL: "http://127.0.0.1:2", Weight: 0},
+		{URL: "http://127.0.0.1:3", Weight: 9},
+	}}
+	pool, err := NewPool(opts)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for range 1000 {
+		counts[pool.pick("", nil).name]++
+	}
+	if counts["127.0.0.1:3"] < 800 {
+		t.Errorf("expected the heaviest upstream to get most picks, got %v", counts)
+	}
+}
+
+func TestHealthCheckRestores(t *testing.T) {
+	up := startUpstream(t, false, http.StatusOK)
+	pool, err := NewPool(Options{
+		Strategy:       RoundRobin,
+		HealthInterval: 20 * time.Millisecond,
+		HealthTimeout:  time.Second,
+		FailThreshold:  1,
+		Members:        []Member{{URL: "http://" + up.addr}},
+	})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	pool.members[0].ejected.Store(true)
+
+	go pool.Start()
+	defer pool.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.members[0].ejected.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the health check to restore the upstream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	for _, raw := range []string{"http://10.0.0.5:3128", "socks5://u:p@10.0.0.6:1080"} {
+		if _, err := ParseURL(raw); err != nil {
+			t.Errorf("ParseURL(%q) failed: %v", raw, err)
+		}
+	}
+	for _, raw := range []string{"https://10.0.0.5:3128", "http://10.0.0.5", "10.0.0.5:3128"} {
+		if _, err := ParseURL(raw); err == nil {
+			t.Errorf("ParseURL(%q) should fail", raw)
+		}
+	}
+}
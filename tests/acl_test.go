@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"awesomeProject11/internal/acl"
+	"awesomeProject11/internal/proxy"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type mockPolicy struct {
+	global *acl.List
+}
+
+func (p *mockPolicy) CheckDestination(username, target string) (bool, string) {
+	d := acl.Check(nil, p.global, target)
+	return d.Allowed, d.Reason
+}
+
+func (p *mockPolicy) CheckAddress(username, target string, addr netip.Addr) (bool, string) {
+	d := acl.CheckAddr(nil, p.global, target, addr)
+	return d.Allowed, d.Reason
+}
+
+func newMockPolicy(t *testing.T, rules ...acl.Rule) *mockPolicy {
+	t.Helper()
+	l, err := acl.Compile(rules)
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+	return &mockPolicy{global: l}
+}
+
+func TestACLDeniesHTTPRequest(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer targetServer.Close()
+
+	proxyInstance := &proxy.Server{
+		Repo: &mockRepo{},
+		ACL:  newMockPolicy(t, acl.Rule{Action: acl.Deny, Pattern: "127.0.0.0/8"}),
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, targetServer.URL, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if !strings.Contains(string(body), `global rule "deny 127.0.0.0/8"`) {
+		t.Errorf("Expected the denial reason in the body, got %q", body)
+	}
+}
+
+func TestACLDeniesNameResolvingToDeniedRange(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer targetServer.Close()
+	_, port, _ := strings.Cut(targetServer.Listener.Addr().String(), ":")
+
+	proxyInstance := &proxy.Server{
+		Repo: &mockRepo{},
+		ACL: newMockPolicy(t,
+			acl.Rule{Action: acl.Deny, Pattern: "127.0.0.0/8"},
+			acl.Rule{Action: acl.Deny, Pattern: "::1/128"},
+		),
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	if status, _ := proxyGet(t, proxyServer, "http://localhost:"+port, "user"); status != http.StatusForbidden {
+		t.Errorf("Expected localhost to be denied by its address with %d, got %d", http.StatusForbidden, status)
+	}
+}
+
+func TestACLDeniesSOCKS5Connect(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer targetServer.Close()
+	target := targetServer.Listener.Addr().String()
+
+	_, port, _ := strings.Cut(target, ":")
+	proxyAddr := startSOCKS5(t, &mockRepo{}, func(s *proxy.Server) {
+		s.ACL = newMockPolicy(t, acl.Rule{Action: acl.Deny, Pattern: "*:" + port})
+	})
+
+	conn, rep := socks5Dial(t, proxyAddr, "user", "pass", target)
+	defer func() {
+		_ = conn.Close()
+	}()
+	if rep != 0x02 {
+		t.Errorf("Expected reply 0x02 (not allowed by ruleset), got %#x", rep)
+	}
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"awesomeProject11/internal/acl"
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/proxy"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type mockAudit struct {
+	mu      sync.Mutex
+	records []domain.ConnectionRecord
+}
+
+func (m *mockAudit) Record(rec domain.ConnectionRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, rec)
+}
+
+// last returns the only record, failing the test if there is not exactly one.
+func (m *mockAudit) last(t *testing.T) domain.ConnectionRecord {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.records) != 1 {
+		t.Fatalf("Expected 1 connection record, got %d", len(m.records))
+	}
+	return m.records[0]
+}
+
+// closedPort returns an address nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func TestAuditConnect(t *testing.T) {
+	connect := func(proxyInstance *proxy.Server, target string) int {
+		t.Helper()
+		proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+		defer proxyServer.Close()
+
+		req, _ := http.NewRequest(http.MethodConnect, proxyServer.URL, nil)
+		req.Host = target
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	full := &mockRepo{}
+	full.GetOrCreateUser("user").(*mockUser).activeConns = 10
+
+	tests := []struct {
+		name       string
+		server     *proxy.Server
+		target     string
+		wantStatus int
+		wantReason string
+	}{
+		{
+			name: "denied",
+			server: &proxy.Server{
+				Repo: &mockRepo{},
+				ACL:  newMockPolicy(t, acl.Rule{Action: acl.Deny, Pattern: "127.0.0.0/8"}),
+			},
+			target:     startIdleTarget(t),
+			wantStatus: http.StatusForbidden,
+			wantReason: "access_denied",
+		},
+		{
+			name:       "connection limit",
+			server:     &proxy.Server{Repo: full},
+			target:     startIdleTarget(t),
+			wantStatus: http.StatusTooManyRequests,
+			wantReason: "connection_limit",
+		},
+		{
+			name:       "dial error",
+			server:     &proxy.Server{Repo: &mockRepo{}},
+			target:     closedPort(t),
+			wantStatus: http.StatusServiceUnavailable,
+			wantReason: "dial_error",
+		},
+	}
+	for _, tt := range tests {
+		audit := &mockAudit{}
+		tt.server.Audit = audit
+		if status := connect(tt.server, tt.target); status != tt.wantStatus {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.wantStatus, status)
+		}
+
+		rec := audit.last(t)
+		if rec.StatusCode != tt.wantStatus || rec.CloseReason != tt.wantReason {
+			t.Errorf("%s: expected a record with %d %s, got %d %s", tt.name, tt.wantStatus, tt.wantReason, rec.StatusCode, rec.CloseReason)
+		}
+		if rec.Username != "user" || rec.Method != http.MethodConnect || rec.Target != tt.target || rec.ClientIP != "127.0.0.1" {
+			t.Errorf("%s: unexpected record %+v", tt.name, rec)
+		}
+	}
+}
+
+func TestAuditSOCKS5(t *testing.T) {
+	full := &mockRepo{}
+	full.GetOrCreateUser("user").(*mockUser).activeConns = 10
+
+	tests := []struct {
+		name       string
+		repository *mockRepo
+		option     func(*proxy.Server)
+		target     string
+		wantReply  byte
+		wantReason string
+	}{
+		{
+			name:       "denied",
+			repository: &mockRepo{},
+			option: func(s *proxy.Server) {
+				s.ACL = newMockPolicy(t, acl.Rule{Action: acl.Deny, Pattern: "127.0.0.0/8"})
+			},
+			target:     startIdleTarget(t),
+			wantReply:  0x02,
+			wantReason: "access_denied",
+		},
+		{
+			name:       "connection limit",
+			repository: full,
+			option:     func(s *proxy.Server) {},
+			target:     startIdleTarget(t),
+			wantReply:  0x02,
+			wantReason: "connection_limit",
+		},
+		{
+			name:       "dial error",
+			repository: &mockRepo{},
+			option:     func(s *proxy.Server) {},
+			target:     closedPort(t),
+			wantReply:  0x04,
+			wantReason: "dial_error",
+		},
+	}
+	for _, tt := range tests {
+		audit := &mockAudit{}
+		proxyAddr := startSOCKS5(t, tt.repository, tt.option, func(s *proxy.Server) { s.Audit = audit })
+
+		conn, reply := socks5Dial(t, proxyAddr, "user", "pass", tt.target)
+		_ = conn.Close()
+		if reply != tt.wantReply {
+			t.Errorf("%s: expected reply %#x, got %#x", tt.name, tt.wantReply, reply)
+		}
+
+		rec := audit.last(t)
+		if rec.StatusCode != int(tt.wantReply) || rec.CloseReason != tt.wantReason {
+			t.Errorf("%s: expected a record with %d %s, got %d %s", tt.name, tt.wantReply, tt.wantReason, rec.StatusCode, rec.CloseReason)
+		}
+		if rec.Username != "user" || rec.Method != "SOCKS5" || rec.Target != tt.target {
+			t.Errorf("%s: unexpected record %+v", tt.name, rec)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type mockTokens map[string]string
+
+func (m mockTokens) UserByToken(token string) (string, bool) {
+	username, ok := m[token]
+	return username, ok
+}
+
+type mockAddresses map[netip.Addr]string
+
+func (m mockAddresses) UserByAddress(addr netip.Addr) (string, bool) {
+	username, ok := m[addr]
+	return username, ok
+}
+
+func TestBearerTokenAuth(t *testing.T) {
+	repository := &mockRepo{}
+	proxyServer := httptest.NewServer(http.HandlerFunc((&proxy.Server{
+		Repo: repository,
+		Auth: auth.Chain{
+			&auth.Token{Users: mockTokens{"pxt_valid": "user"}},
+			&auth.Basic{Users: repository},
+		},
+	}).ProxyHandler))
+	defer proxyServer.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization was forwarded to the target")
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	get := func(header string) int {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		req, _ := http.NewRequest("GET", target.URL, nil)
+		if header != "" {
+			req.Header.Set("Proxy-Authorization", header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for header, want := range map[string]int{
+		"Bearer pxt_valid":       http.StatusOK,
+		"Bearer pxt_revoked":     http.StatusProxyAuthRequired,
+		"Basic dXNlcjpwYXNz":     http.StatusOK, // user:pass
+		"Basic dXNlcjp3cm9uZw==": http.StatusProxyAuthRequired,
+		"":                       http.StatusProxyAuthRequired,
+	} {
+		if got := get(header); got != want {
+			t.Errorf("Proxy-Authorization %q: expected %d, got %d", header, want, got)
+		}
+	}
+}
+
+func TestSOCKS5AddressAuth(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	// greet offers only "no authentication" and returns the chosen method.
+	greet := func(proxyAddr string) (net.Conn, byte) {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to dial proxy: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			t.Fatalf("Failed to write greeting: %v", err)
+		}
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil {
+			t.Fatalf("Failed to read method selection: %v", err)
+		}
+		return conn, method[1]
+	}
+
+	repository := &mockRepo{}
+	registered := startSOCKS5(t, repository, func(s *proxy.Server) {
+		s.Auth = auth.Chain{
+			&auth.ClientIP{Users: mockAddresses{netip.MustParseAddr("127.0.0.1"): "user"}},
+			&auth.Basic{Users: repository},
+		}
+	})
+	conn, method := greet(registered)
+	if method != 0x00 {
+		t.Fatalf("Expected a registered address to log in without credentials, got method %#x", method)
+	}
+	if reply := socks5Request(t, conn, 0x01, target.Listener.Addr().String()); reply[1] != 0x00 {
+		t.Errorf("Expected CONNECT to succeed, got reply %#x", reply[1])
+	}
+	_ = conn.Close()
+
+	// Credentials still work for everyone else.
+	conn, ok := socks5Login(t, registered, "user", "pass")
+	if !ok {
+		t.Error("Expected username/password login to still work")
+	}
+	_ = conn.Close()
+
+	unregistered := startSOCKS5(t, repository)
+	conn, method = greet(unregistered)
+	if method != 0xFF {
+		t.Errorf("Expected no acceptable method without a registered address, got %#x", method)
+	}
+	_ = conn.Close()
+}
+
+func TestHTTPAddressAuth(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	get := func(addresses mockAddresses) int {
+		t.Helper()
+		repository := &mockRepo{}
+		proxyServer := httptest.NewServer(http.HandlerFunc((&proxy.Server{
+			Repo: repository,
+			Auth: auth.Chain{&auth.ClientIP{Users: addresses}, &auth.Basic{Users: repository}},
+		}).ProxyHandler))
+		defer proxyServer.Close()
+
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := get(mockAddresses{netip.MustParseAddr("127.0.0.1"): "user"}); status != http.StatusOK {
+		t.Errorf("Expected a registered address to log in without credentials, got %d", status)
+	}
+	if status := get(mockAddresses{netip.MustParseAddr("10.0.0.1"): "user"}); status != http.StatusProxyAuthRequired {
+		t.Errorf("Expected %d for an unregistered address, got %d", http.StatusProxyAuthRequired, status)
+	}
+}
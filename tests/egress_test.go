@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/egress"
+	"awesomeProject11/internal/proxy"
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockEgress struct {
+	source *egress.Source
+
+	mu       sync.Mutex
+	username string
+	opts     domain.EgressOptions
+}
+
+func (m *mockEgress) EgressSource(username string, opts domain.EgressOptions) (domain.EgressSource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.username, m.opts = username, opts
+	if opts.Pool != "" && opts.Pool != "dc1" {
+		return nil, domain.ErrPoolNotAllowed
+	}
+	return m.source, nil
+}
+
+// startRemoteAddrTarget answers every request with the client address it
+// was connected from.
+func startRemoteAddrTarget(t *testing.T) *httptest.Server {
+	t.Helper()
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		_, _ = w.Write([]byte(host))
+	}))
+	t.Cleanup(targetServer.Close)
+	return targetServer
+}
+
+func newEgressProxy(t *testing.T, local string) (*httptest.Server, *mockEgress) {
+	t.Helper()
+	policy := &mockEgress{source: egress.NewSelector().Fixed(netip.MustParseAddr(local))}
+	proxyInstance := &proxy.Server{
+		Repo:   &mockRepo{},
+		Egress: policy,
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	t.Cleanup(proxyServer.Close)
+	return proxyServer, policy
+}
+
+func proxyGet(t *testing.T, proxyServer *httptest.Server, target, username string) (int, string) {
+	t.Helper()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":pass")))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode, string(body)
+}
+
+func TestEgressAddressHTTP(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	proxyServer, _ := newEgressProxy(t, "127.0.0.2")
+
+	if _, body := proxyGet(t, proxyServer, targetServer.URL, "user"); body != "127.0.0.2" {
+		t.Errorf("Expected the request to come from 127.0.0.2, target saw %q", body)
+	}
+}
+
+func TestUsernameOptions(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	proxyServer, policy := newEgressProxy(t, "127.0.0.2")
+
+	status, body := proxyGet(t, proxyServer, targetServer.URL, "user-session-abc123-ttl-60-pool-dc1")
+	if status != http.StatusOK || body != "127.0.0.2" {
+		t.Fatalf("Expected the request to pass from 127.0.0.2, got %d %q", status, body)
+	}
+
+	policy.mu.Lock()
+	username, opts := policy.username, policy.opts
+	policy.mu.Unlock()
+	want := domain.EgressOptions{Pool: "dc1", Session: "abc123", SessionTTL: time.Minute}
+	if username != "user" || opts != want {
+		t.Errorf("Expected options %+v for user, got %+v for %q", want, opts, username)
+	}
+
+	if status, _ := proxyGet(t, proxyServer, targetServer.URL, "user-pool-other"); status != http.StatusForbidden {
+		t.Errorf("Expected %d for a pool the user may not use, got %d", http.StatusForbidden, status)
+	}
+	if status, _ := proxyGet(t, proxyServer, targetServer.URL, "user-ipv-9"); status != http.StatusProxyAuthRequired {
+		t.Errorf("Expected %d for an invalid option, got %d", http.StatusProxyAuthRequired, status)
+	}
+}
+
+func TestUsernameIPVersion(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	proxyServer, _ := newEgressProxy(t, "127.0.0.2")
+
+	// The target only listens on IPv4.
+	if status, _ := proxyGet(t, proxyServer, targetServer.URL, "user-ipv-6"); status != http.StatusBadGateway {
+		t.Errorf("Expected %d for an IPv4 target over IPv6, got %d", http.StatusBadGateway, status)
+	}
+}
+
+func TestEgressAddressConnect(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	proxyServer, _ := newEgressProxy(t, "127.0.0.3")
+
+	target := targetServer.Listener.Addr().String()
+	conn := openConnectTunnel(t, proxyServer.Listener.Addr().String(), target)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target, nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "127.0.0.3" {
+		t.Errorf("Expected the tunnel to come from 127.0.0.3, target saw %q", body)
+	}
+}
+
+func TestUsernameOptionsSOCKS5(t *testing.T) {
+	target := startIdleTarget(t)
+	proxyAddr := startSOCKS5(t, &mockRepo{})
+
+	conn, rep := socks5Dial(t, proxyAddr, "user-session-abc123", "pass", target)
+	defer func() {
+		_ = conn.Close()
+	}()
+	if rep != 0x00 {
+		t.Errorf("Expected the account to authenticate with options, got reply %#x", rep)
+	}
+}
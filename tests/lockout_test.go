@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/limits"
+	"awesomeProject11/internal/proxy"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockLockout keeps failure counters in memory with the same policy the
+// Redis lockout uses.
+type mockLockout struct {
+	policy   limits.LockoutPolicy
+	mu       sync.Mutex
+	failures map[string]int64
+	until    map[string]time.Time
+}
+
+func newMockLockout(policy limits.LockoutPolicy) *mockLockout {
+	return &mockLockout{policy: policy, failures: map[string]int64{}, until: map[string]time.Time{}}
+}
+
+func (m *mockLockout) LoginLockedOut(username, clientIP string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var retryAfter time.Duration
+	for _, key := range []string{"user:" + username, "ip:" + clientIP} {
+		retryAfter = max(retryAfter, time.Until(m.until[key]))
+	}
+	return retryAfter
+}
+
+func (m *mockLockout) LoginFailed(username, clientIP string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail("user:"+username, m.policy.UserThreshold)
+	m.fail("ip:"+clientIP, m.policy.IPThreshold)
+}
+
+func (m *mockLockout) fail(key string, threshold int) {
+	m.failures[key]++
+	if delay := m.policy.Delay(m.failures[key], threshold); delay > 0 {
+		m.until[key] = time.Now().Add(delay)
+	}
+}
+
+func (m *mockLockout) LoginSucceeded(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, "user:"+username)
+}
+
+func TestLoginLockout(t *testing.T) {
+	lockout := newMockLockout(limits.LockoutPolicy{
+		UserThreshold: 3,
+		IPThreshold:   100,
+		BaseDelay:     time.Minute,
+		MaxDelay:      time.Hour,
+	})
+	proxyServer := httptest.NewServer(http.HandlerFunc((&proxy.Server{
+		Repo:    &mockRepo{},
+		Lockout: lockout,
+	}).ProxyHandler))
+	defer proxyServer.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	get := func(user *url.Userinfo) *http.Response {
+		t.Helper()
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		proxyURL.User = user
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// Clients that have not sent credentials yet are not counted.
+	for range 5 {
+		if resp := get(nil); resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("Expected %d without credentials, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+		}
+	}
+
+	// A success resets the count, so two failures either side of it do
+	// not lock out.
+	get(url.UserPassword("user", "wrong"))
+	get(url.UserPassword("user", "wrong"))
+	if resp := get(url.UserPassword("user", "pass")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a login below the threshold to work, got %d", resp.StatusCode)
+	}
+
+	for range 3 {
+		if resp := get(url.UserPassword("user", "wrong")); resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("Expected %d for a wrong password, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+		}
+	}
+
+	// Username options do not dodge the lockout of the account.
+	for _, username := range []string{"user", "user-session-abc"} {
+		resp := get(url.UserPassword(username, "pass"))
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected %s to be locked out, got %d", username, resp.StatusCode)
+		}
+		if resp.Header.Get("Retry-After") != "60" {
+			t.Errorf("Expected Retry-After: 60, got %q", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	conn, ok := socks5Login(t, startSOCKS5(t, &mockRepo{}, func(s *proxy.Server) {
+		s.Lockout = lockout
+	}), "user", "pass")
+	_ = conn.Close()
+	if ok {
+		t.Error("Expected the lockout to apply to SOCKS5 logins too")
+	}
+}
+
+func TestLockoutCountsOnlyPasswords(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	get := func(lockout *mockLockout, chain func(repository *mockRepo) auth.Chain, user *url.Userinfo) int {
+		t.Helper()
+		repository := &mockRepo{}
+		proxyServer := httptest.NewServer(http.HandlerFunc((&proxy.Server{
+			Repo:    repository,
+			Auth:    chain(repository),
+			Lockout: lockout,
+		}).ProxyHandler))
+		defer proxyServer.Close()
+
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		proxyURL.User = user
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	// The client logs in by its registered address, whatever credentials
+	// it also sends.
+	addresses := mockAddresses{netip.MustParseAddr("127.0.0.1"): "other"}
+	addressFirst := func(repository *mockRepo) auth.Chain {
+		return auth.Chain{&auth.ClientIP{Users: addresses}, &auth.Basic{Users: repository}}
+	}
+	passwordFirst := func(repository *mockRepo) auth.Chain {
+		return auth.Chain{&auth.Basic{Users: repository}, &auth.ClientIP{Users: addresses}}
+	}
+	policy := limits.LockoutPolicy{UserThreshold: 100, IPThreshold: 100, BaseDelay: time.Minute, MaxDelay: time.Hour}
+
+	// A login by address does not clear the failures of the username the
+	// client sent.
+	lockout := newMockLockout(policy)
+	lockout.failures["user:user"] = 2
+	if status := get(lockout, addressFirst, url.UserPassword("user", "pass")); status != http.StatusOK {
+		t.Fatalf("Expected the address login to work, got %d", status)
+	}
+	if lockout.failures["user:user"] != 2 {
+		t.Errorf("Expected the failures of user to stay at 2, got %d", lockout.failures["user:user"])
+	}
+
+	// A wrong password counts even though the address then logs in.
+	lockout = newMockLockout(policy)
+	if status := get(lockout, passwordFirst, url.UserPassword("user", "wrong")); status != http.StatusOK {
+		t.Fatalf("Expected the address login to work, got %d", status)
+	}
+	if lockout.failures["user:user"] != 1 {
+		t.Errorf("Expected the wrong password to count, got %d failures", lockout.failures["user:user"])
+	}
+
+	if status := get(lockout, passwordFirst, url.UserPassword("user", "pass")); status != http.StatusOK {
+		t.Fatalf("Expected the password login to work, got %d", status)
+	}
+	if _, ok := lockout.failures["user:user"]; ok {
+		t.Error("Expected a correct password to clear the failures")
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"awesomeProject11/internal/proxy"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startIdleTarget accepts TCP connections and never writes to them, so a
+// tunnel to it stays open until one side closes.
+func startIdleTarget(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func openConnectTunnel(t *testing.T, proxyAddr, target string) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+target, nil)
+	req.Host = target
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Failed to write CONNECT: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed with status %d", resp.StatusCode)
+	}
+	return conn
+}
+
+func TestShutdownForceClosesTunnels(t *testing.T) {
+	repository := &mockRepo{}
+	proxyInstance := &proxy.Server{Repo: repository}
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	target := startIdleTarget(t)
+	proxyAddr := proxyServer.Listener.Addr().String()
+
+	conns := []net.Conn{
+		openConnectTunnel(t, proxyAddr, target),
+		openConnectTunnel(t, proxyAddr, target),
+	}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := proxyInstance.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected shutdown to hit the deadline, got %v", err)
+	}
+
+	for i, conn := range conns {
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Tunnel %d is still open after shutdown", i)
+		}
+	}
+
+	user := repository.GetOrCreateUser("user").(*mockUser)
+	user.mu.Lock()
+	active := user.activeConns
+	user.mu.Unlock()
+	if active != 0 {
+		t.Errorf("Expected connection counter to be released, got %d", active)
+	}
+}
+
+func TestShutdownRejectsNewRequests(t *testing.T) {
+	proxyInstance := &proxy.Server{Repo: &mockRepo{}}
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := proxyInstance.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown with no open connections failed: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d after shutdown, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
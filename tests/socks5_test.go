@@ -0,0 +1,351 @@
+package tests
+
+import (
+	"awesomeProject11/internal/domain"
+	"awesomeProject11/internal/egress"
+	"awesomeProject11/internal/proxy"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startSOCKS5(t *testing.T, repository *mockRepo, options ...func(*proxy.Server)) string {
+	t.Helper()
+
+	proxyInstance := &proxy.Server{
+		Repo: repository,
+	}
+	for _, option := range options {
+		option(proxyInstance)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		_ = proxyInstance.ServeSOCKS5(listener)
+	}()
+	return listener.Addr().String()
+}
+
+// socks5Dial performs the greeting, username/password auth and a CONNECT
+// request, returning the connection and the reply code.
+func socks5Dial(t *testing.T, proxyAddr, username, password, target string) (net.Conn, byte) {
+	t.Helper()
+
+	conn, ok := socks5Login(t, proxyAddr, username, password)
+	if !ok {
+		return conn, 0xFF
+	}
+	reply := socks5Request(t, conn, 0x01, target)
+	return conn, reply[1]
+}
+
+// socks5Login performs the greeting and username/password auth.
+func socks5Login(t *testing.T, proxyAddr, username, password string) (net.Conn, bool) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err = conn.Write([]byte{0x05, 0x01, 0x02}); err != nil {
+		t.Fatalf("Failed to write greeting: %v", err)
+	}
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(conn, method); err != nil || method[1] != 0x02 {
+		t.Fatalf("Unexpected method selection: %v %v", method, err)
+	}
+
+	authReq := []byte{0x01, byte(len(username))}
+	authReq = append(authReq, username...)
+	authReq = append(authReq, byte(len(password)))
+	authReq = append(authReq, password...)
+	if _, err = conn.Write(authReq); err != nil {
+		t.Fatalf("Failed to write credentials: %v", err)
+	}
+	status := make([]byte, 2)
+	if _, err = io.ReadFull(conn, status); err != nil {
+		t.Fatalf("Failed to read auth status: %v", err)
+	}
+	return conn, status[1] == 0x00
+}
+
+// socks5Request sends a request for an IPv4 target and returns the raw reply.
+func socks5Request(t *testing.T, conn net.Conn, cmd byte, target string) []byte {
+	t.Helper()
+
+	req := append([]byte{0x05, cmd, 0x00}, socks5Addr(target)...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply
+}
+
+func socks5Addr(target string) []byte {
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	addr := []byte{0x01}
+	addr = append(addr, net.ParseIP(host).To4()...)
+	return binary.BigEndian.AppendUint16(addr, uint16(port))
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer targetServer.Close()
+
+	proxyAddr := startSOCKS5(t, &mockRepo{})
+	target := targetServer.Listener.Addr().String()
+
+	conn, rep := socks5Dial(t, proxyAddr, "user", "pass", target)
+	defer func() {
+		_ = conn.Close()
+	}()
+	if rep != 0x00 {
+		t.Fatalf("SOCKS5 CONNECT failed with reply %d", rep)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Unexpected response through SOCKS5: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestSOCKS5AuthFailure(t *testing.T) {
+	proxyAddr := startSOCKS5(t, &mockRepo{})
+
+	conn, rep := socks5Dial(t, proxyAddr, "user", "wrong", "127.0.0.1:1")
+	defer func() {
+		_ = conn.Close()
+	}()
+	if rep != 0xFF {
+		t.Errorf("Expected authentication failure, got reply %d", rep)
+	}
+}
+
+func TestSOCKS5SharesConnectionLimit(t *testing.T) {
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() {
+		_ = targetListener.Close()
+	}()
+	go func() {
+		for {
+			c, err := targetListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	repository := &mockRepo{}
+	proxyAddr := startSOCKS5(t, repository)
+	target := targetListener.Addr().String()
+
+	_, maxConnections := repository.GetUserLimits("user")
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	for i := int64(0); i < maxConnections; i++ {
+		conn, rep := socks5Dial(t, proxyAddr, "user", "pass", target)
+		conns = append(conns, conn)
+		if rep != 0x00 {
+			t.Fatalf("Connection %d rejected with reply %d", i, rep)
+		}
+	}
+
+	conn, rep := socks5Dial(t, proxyAddr, "user", "pass", target)
+	conns = append(conns, conn)
+	if rep != 0x02 {
+		t.Errorf("Expected connection limit rejection, got reply %d", rep)
+	}
+}
+
+// startUDPTarget answers every datagram with what reply makes of it.
+func startUDPTarget(t *testing.T, reply func(data []byte, from net.Addr) []byte) string {
+	t.Helper()
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = target.Close()
+	})
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = target.WriteTo(reply(buf[:n], from), from)
+		}
+	}()
+	return target.LocalAddr().String()
+}
+
+// socks5UDPAssociation opens a UDP association and returns a socket
+// connected to its relay.
+func socks5UDPAssociation(t *testing.T, proxyAddr string) *net.UDPConn {
+	t.Helper()
+
+	conn, ok := socks5Login(t, proxyAddr, "user", "pass")
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if !ok {
+		t.Fatalf("Authentication failed")
+	}
+	reply := socks5Request(t, conn, 0x03, "0.0.0.0:0")
+	if reply[1] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE failed with reply %d", reply[1])
+	}
+	relayAddr := &net.UDPAddr{
+		IP:   net.IP(reply[4:8]),
+		Port: int(binary.BigEndian.Uint16(reply[8:10])),
+	}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// socks5UDPSend sends payload to target through the relay client is
+// connected to.
+func socks5UDPSend(t *testing.T, client *net.UDPConn, target, payload string) {
+	t.Helper()
+	header := append([]byte{0x00, 0x00, 0x00}, socks5Addr(target)...)
+	if _, err := client.Write(append(header, payload...)); err != nil {
+		t.Fatalf("Failed to write datagram: %v", err)
+	}
+}
+
+// socks5UDPReceive reads a datagram from the relay and returns its payload.
+func socks5UDPReceive(t *testing.T, client *net.UDPConn) string {
+	t.Helper()
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	// RSV, FRAG and an IPv4 address.
+	if n < 10 || buf[3] != 0x01 {
+		t.Fatalf("Unexpected datagram through relay: %q", buf[:n])
+	}
+	return string(buf[10:n])
+}
+
+// socks5UDPExchange opens a UDP association, sends payload to target through
+// it and returns the payload of the reply.
+func socks5UDPExchange(t *testing.T, proxyAddr, target, payload string) string {
+	t.Helper()
+	client := socks5UDPAssociation(t, proxyAddr)
+	socks5UDPSend(t, client, target, payload)
+	return socks5UDPReceive(t, client)
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo := startUDPTarget(t, func(data []byte, from net.Addr) []byte { return data })
+	proxyAddr := startSOCKS5(t, &mockRepo{})
+
+	if got := socks5UDPExchange(t, proxyAddr, echo, "ping"); got != "ping" {
+		t.Errorf("Expected ping back through the relay, got %q", got)
+	}
+}
+
+func TestSOCKS5UDPEgressAddress(t *testing.T) {
+	target := startUDPTarget(t, func(data []byte, from net.Addr) []byte {
+		host, _, _ := net.SplitHostPort(from.String())
+		return []byte(host)
+	})
+	proxyAddr := startSOCKS5(t, &mockRepo{}, func(s *proxy.Server) {
+		s.Egress = &mockEgress{source: egress.NewSelector().Fixed(netip.MustParseAddr("127.0.0.2"))}
+	})
+
+	if got := socks5UDPExchange(t, proxyAddr, target, "ping"); got != "127.0.0.2" {
+		t.Errorf("Expected the datagram to come from 127.0.0.2, target saw %q", got)
+	}
+}
+
+// switchLimiter lets bytes through only while allow is set.
+type switchLimiter struct {
+	allow atomic.Bool
+}
+
+func (l *switchLimiter) WaitN(ctx context.Context, n int) error { return nil }
+func (l *switchLimiter) AllowN(n int) bool                      { return l.allow.Load() }
+
+type mockThrottler struct {
+	upload domain.RateLimiter
+}
+
+func (m *mockThrottler) RateLimiters(username string) (domain.RateLimiter, domain.RateLimiter) {
+	return m.upload, nil
+}
+
+func TestSOCKS5UDPDropsDatagramsOverRate(t *testing.T) {
+	echo := startUDPTarget(t, func(data []byte, from net.Addr) []byte { return data })
+	limiter := &switchLimiter{}
+	proxyAddr := startSOCKS5(t, &mockRepo{}, func(s *proxy.Server) {
+		s.Throttle = &mockThrottler{upload: limiter}
+	})
+	client := socks5UDPAssociation(t, proxyAddr)
+
+	// The over-rate datagram is dropped without holding up the next one.
+	socks5UDPSend(t, client, echo, "dropped")
+	time.Sleep(50 * time.Millisecond)
+	limiter.allow.Store(true)
+	socks5UDPSend(t, client, echo, "ping")
+
+	if got := socks5UDPReceive(t, client); got != "ping" {
+		t.Errorf("Expected ping back through the relay, got %q", got)
+	}
+}
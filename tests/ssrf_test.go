@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"awesomeProject11/internal/netguard"
+	"awesomeProject11/internal/proxy"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGuardBlocksHTTPRequest(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The blocked target should not be reached")
+	}))
+	defer targetServer.Close()
+
+	proxyInstance := &proxy.Server{
+		Repo:  &mockRepo{},
+		Guard: netguard.New(nil, nil),
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	// localhost is only blocked once it has been resolved.
+	_, port, _ := strings.Cut(targetServer.Listener.Addr().String(), ":")
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "not allowed") {
+		t.Errorf("Expected the refusal in the body, got %q", body)
+	}
+}
+
+func TestGuardBlocksConnect(t *testing.T) {
+	target := startIdleTarget(t)
+
+	proxyInstance := &proxy.Server{
+		Repo:  &mockRepo{},
+		Guard: netguard.New(nil, nil),
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	req, _ := http.NewRequest(http.MethodConnect, proxyServer.URL, nil)
+	req.Host = target
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestGuardBlocksSOCKS5Connect(t *testing.T) {
+	target := startIdleTarget(t)
+	proxyAddr := startSOCKS5(t, &mockRepo{}, func(s *proxy.Server) {
+		s.Guard = netguard.New(nil, nil)
+	})
+
+	conn, rep := socks5Dial(t, proxyAddr, "user", "pass", target)
+	defer func() {
+		_ = conn.Close()
+	}()
+	if rep != 0x02 {
+		t.Errorf("Expected reply 0x02 (not allowed by ruleset), got %#x", rep)
+	}
+}
@@ -0,0 +1,225 @@
+package tests
+
+import (
+	"awesomeProject11/internal/auth"
+	"awesomeProject11/internal/certs"
+	"awesomeProject11/internal/proxy"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var serial atomic.Int64
+
+// issueCert signs tmpl with parent, or self-signs it when parent is nil.
+func issueCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl.SerialNumber = big.NewInt(serial.Add(1))
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// startTLSProxy serves proxyInstance over TLS with a certificate for
+// 127.0.0.1 and returns its URL and the certificate to trust. Client
+// certificates signed by clientCAs are verified when it is not nil.
+func startTLSProxy(t *testing.T, proxyInstance *proxy.Server, clientCAs *x509.CertPool) (*url.URL, *x509.Certificate) {
+	t.Helper()
+	cert, key := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, nil, nil)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	pair := certs.Pair{CertFile: filepath.Join(dir, "proxy.crt"), KeyFile: filepath.Join(dir, "proxy.key")}
+	_ = os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600)
+	_ = os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	store, err := certs.NewStore([]certs.Pair{pair}, 0)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	tlsConfig := store.TLSConfig()
+	if clientCAs != nil {
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// StartTLS would add its own certificate, which wins over the store for
+	// clients that send no SNI name.
+	proxyServer := httptest.NewUnstartedServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	proxyServer.Listener = tls.NewListener(proxyServer.Listener, tlsConfig)
+	proxyServer.Start()
+	t.Cleanup(proxyServer.Close)
+
+	proxyURL := &url.URL{Scheme: "https", Host: proxyServer.Listener.Addr().String()}
+	return proxyURL, cert
+}
+
+func TestTLSProxy(t *testing.T) {
+	proxyURL, proxyCert := startTLSProxy(t, &proxy.Server{Repo: &mockRepo{}}, nil)
+	proxyURL.User = url.UserPassword("user", "pass")
+
+	plainTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("plain"))
+	}))
+	defer plainTarget.Close()
+	tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tunnel"))
+	}))
+	defer tlsTarget.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(proxyCert)
+	roots.AddCert(tlsTarget.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	for target, want := range map[string]string{
+		plainTarget.URL: "plain",
+		tlsTarget.URL:   "tunnel",
+	} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("Request to %s through the TLS proxy failed: %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("Expected 200 %q from %s, got %d %q", want, target, resp.StatusCode, body)
+		}
+	}
+}
+
+// mockCertAuth maps certificate identities to users.
+type mockCertAuth map[string]string
+
+func (m mockCertAuth) UserByCertificate(identities []string) (string, bool) {
+	for _, id := range identities {
+		if username, ok := m[id]; ok {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	ca, caKey := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "workload CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	repository := &mockRepo{}
+	proxyInstance := &proxy.Server{
+		Repo: repository,
+		Auth: auth.Chain{
+			&auth.MTLS{Users: mockCertAuth{"dns:billing.internal": "user"}},
+			&auth.Basic{Users: repository},
+		},
+	}
+	proxyURL, proxyCert := startTLSProxy(t, proxyInstance, clientCAs)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	// get sends clientCert even when the proxy does not list its issuer as
+	// acceptable, as a misbehaving client would.
+	get := func(clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey) (int, error) {
+		t.Helper()
+		roots := x509.NewCertPool()
+		roots.AddCert(proxyCert)
+		tlsConfig := &tls.Config{
+			RootCAs: roots,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}, nil
+			},
+		}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	clientUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	billing, billingKey := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing"},
+		DNSNames:    []string{"billing.internal"},
+		ExtKeyUsage: clientUsage,
+	}, ca, caKey)
+	if status, err := get(billing, billingKey); err != nil || status != http.StatusOK {
+		t.Errorf("Expected a registered certificate to log in, got %d, %v", status, err)
+	}
+	if !slices.Contains(mapKeys(repository), "user") {
+		t.Error("Expected the certificate login to go through the user's connection accounting")
+	}
+
+	unknown, unknownKey := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "unknown"},
+		ExtKeyUsage: clientUsage,
+	}, ca, caKey)
+	if status, err := get(unknown, unknownKey); err != nil || status != http.StatusProxyAuthRequired {
+		t.Errorf("Expected %d for an unregistered certificate, got %d, %v", http.StatusProxyAuthRequired, status, err)
+	}
+
+	// A certificate from another CA is refused, even with a registered name.
+	forged, forgedKey := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing"},
+		DNSNames:    []string{"billing.internal"},
+		ExtKeyUsage: clientUsage,
+	}, nil, nil)
+	if status, err := get(forged, forgedKey); err == nil {
+		t.Errorf("Expected the handshake with an untrusted certificate to fail, got %d", status)
+	}
+}
+
+func mapKeys(m *mockRepo) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.users {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"awesomeProject11/internal/proxy"
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHopByHopHeadersStripped(t *testing.T) {
+	var received http.Header
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Connection", "X-Origin-Hop")
+		w.Header().Set("X-Origin-Hop", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End-To-End", "kept")
+	}))
+	defer targetServer.Close()
+
+	proxyInstance := &proxy.Server{Repo: &mockRepo{}}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	// A raw request, since http.Transport would drop some of these itself.
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodGet, targetServer.URL, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "secret")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-End-To-End", "kept")
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	for _, name := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Client-Hop", "Keep-Alive", "Te", "Upgrade"} {
+		if v := received.Get(name); v != "" {
+			t.Errorf("Expected %s not to reach the origin, got %q", name, v)
+		}
+	}
+	if received.Get("X-End-To-End") != "kept" {
+		t.Error("Expected end-to-end request headers to reach the origin")
+	}
+	for _, name := range []string{"X-Origin-Hop", "Keep-Alive"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("Expected %s not to reach the client, got %q", name, v)
+		}
+	}
+	if resp.Header.Get("X-End-To-End") != "kept" {
+		t.Error("Expected end-to-end response headers to reach the client")
+	}
+}
+
+func TestOriginConnectionsReused(t *testing.T) {
+	var opened atomic.Int32
+	targetServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	targetServer.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	targetServer.Start()
+	defer targetServer.Close()
+
+	proxyInstance := &proxy.Server{Repo: &mockRepo{}}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	defer proxyServer.Close()
+
+	// A new client per request, so only the proxy can reuse connections.
+	for range 3 {
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+		req, _ := http.NewRequest(http.MethodGet, targetServer.URL, nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	if n := opened.Load(); n != 1 {
+		t.Errorf("Expected the proxy to reuse one origin connection, target saw %d", n)
+	}
+}
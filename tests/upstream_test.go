@@ -0,0 +1,334 @@
+package tests
+
+import (
+	"awesomeProject11/internal/egress"
+	"awesomeProject11/internal/netguard"
+	"awesomeProject11/internal/proxy"
+	"awesomeProject11/internal/upstream"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectUpstream is an HTTP CONNECT proxy that records the targets it was
+// asked for.
+type connectUpstream struct {
+	addr string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func startConnectUpstream(t *testing.T) *connectUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	u := &connectUpstream{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+func (u *connectUpstream) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	u.mu.Lock()
+	u.targets = append(u.targets, req.Host)
+	u.mu.Unlock()
+
+	dst, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer func() {
+		_ = dst.Close()
+	}()
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		_, _ = io.Copy(dst, conn)
+	}()
+	_, _ = io.Copy(conn, dst)
+}
+
+func (u *connectUpstream) seen() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.targets...)
+}
+
+// newUpstreamProxy starts a proxy whose first upstream is down, so every
+// connection has to fail over to up.
+func newUpstreamProxy(t *testing.T, up *connectUpstream, options ...func(*proxy.Server)) *httptest.Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	dead := ln.Addr().String()
+	_ = ln.Close()
+
+	pool, err := upstream.NewPool(upstream.Options{
+		Strategy:      upstream.RoundRobin,
+		Retries:       1,
+		FailThreshold: 3,
+		Members: []upstream.Member{
+			{URL: "http://" + dead},
+			{URL: "http://" + up.addr},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream pool: %v", err)
+	}
+
+	proxyInstance := &proxy.Server{
+		Repo:     &mockRepo{},
+		Upstream: pool,
+	}
+	for _, option := range options {
+		option(proxyInstance)
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxyInstance.ProxyHandler))
+	t.Cleanup(proxyServer.Close)
+	return proxyServer
+}
+
+func TestUpstreamHTTPRequest(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	up := startConnectUpstream(t)
+	proxyServer := newUpstreamProxy(t, up)
+
+	status, _ := proxyGet(t, proxyServer, targetServer.URL, "user")
+	if status != http.StatusOK {
+		t.Fatalf("Expected %d through the upstream, got %d", http.StatusOK, status)
+	}
+	target := targetServer.Listener.Addr().String()
+	if seen := up.seen(); len(seen) != 1 || seen[0] != target {
+		t.Errorf("Expected the upstream to tunnel to %s, got %v", target, seen)
+	}
+}
+
+func TestUpstreamConnect(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	up := startConnectUpstream(t)
+	proxyServer := newUpstreamProxy(t, up)
+
+	target := targetServer.Listener.Addr().String()
+	conn := openConnectTunnel(t, proxyServer.Listener.Addr().String(), target)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target, nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read response through the upstream: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if seen := up.seen(); len(seen) != 1 || seen[0] != target {
+		t.Errorf("Expected the upstream to tunnel to %s, got %v", target, seen)
+	}
+}
+
+func TestUpstreamGetsVettedAddress(t *testing.T) {
+	target := startIdleTarget(t)
+	up := startConnectUpstream(t)
+	proxyServer := newUpstreamProxy(t, up, func(s *proxy.Server) {
+		s.Guard = netguard.New(nil, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	})
+
+	// The upstream must dial the address the guard vetted, not resolve the
+	// name again.
+	_, port, _ := strings.Cut(target, ":")
+	conn := openConnectTunnel(t, proxyServer.Listener.Addr().String(), "localhost:"+port)
+	_ = conn.Close()
+
+	if seen := up.seen(); len(seen) != 1 || seen[0] != target {
+		t.Errorf("Expected the upstream to be asked for %s, got %v", target, seen)
+	}
+}
+
+func TestUpstreamRefusesEgressSettings(t *testing.T) {
+	targetServer := startRemoteAddrTarget(t)
+	up := startConnectUpstream(t)
+	proxyServer := newUpstreamProxy(t, up, func(s *proxy.Server) {
+		s.Egress = &mockEgress{source: egress.NewSelector().Fixed(netip.MustParseAddr("127.0.0.2"))}
+	})
+
+	if status, _ := proxyGet(t, proxyServer, targetServer.URL, "user-pool-dc1"); status != http.StatusForbidden {
+		t.Errorf("Expected %d for a pool through upstreams, got %d", http.StatusForbidden, status)
+	}
+	if status, _ := proxyGet(t, proxyServer, targetServer.URL, "user"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d for a user with an egress address, got %d", http.StatusServiceUnavailable, status)
+	}
+	if seen := up.seen(); len(seen) != 0 {
+		t.Errorf("Expected nothing to go through the upstream, got %v", seen)
+	}
+}
+
+// mockSessions pins sessions in memory.
+type mockSessions struct {
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+func (m *mockSessions) PinSession(username, session, field, candidate string, _ time.Duration, valid func(string) bool) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := username + ":" + session + ":" + field
+	if current, ok := m.pins[key]; ok && valid(current) {
+		return current
+	}
+	m.pins[key] = candidate
+	return candidate
+}
+
+func TestUpstreamSessionIsPinned(t *testing.T) {
+	target := startIdleTarget(t)
+	first := startConnectUpstream(t)
+	second := startConnectUpstream(t)
+
+	pool, err := upstream.NewPool(upstream.Options{
+		Strategy: upstream.RoundRobin,
+		Members: []upstream.Member{
+			{URL: "http://" + first.addr},
+			{URL: "http://" + second.addr},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream pool: %v", err)
+	}
+	// Another proxy instance already pinned the session to the second
+	// upstream.
+	sessions := &mockSessions{pins: map[string]string{"user:s1:upstream": second.addr}}
+	proxyAddr := startSOCKS5(t, &mockRepo{}, func(s *proxy.Server) {
+		s.Upstream = pool
+		s.Sessions = sessions
+	})
+
+	for range 3 {
+		conn, reply := socks5Dial(t, proxyAddr, "user-session-s1", "pass", target)
+		if reply != 0x00 {
+			t.Fatalf("Expected the connection to succeed, got reply %#x", reply)
+		}
+		_ = conn.Close()
+	}
+	if len(first.seen()) != 0 || len(second.seen()) != 3 {
+		t.Errorf("Expected every connection of the session through the pinned upstream, got %v and %v", first.seen(), second.seen())
+	}
+
+	// Connections without a session are left to the strategy.
+	for range 2 {
+		conn, _ := socks5Dial(t, proxyAddr, "user", "pass", target)
+		_ = conn.Close()
+	}
+	if len(first.seen()) != 1 {
+		t.Errorf("Expected connections without a session to be spread over the upstreams, got %v", first.seen())
+	}
+}
+
+// startDNS starts a DNS server answering every A query with addrs and
+// every other query with no records, and returns a resolver using it.
+func startDNS(t *testing.T, addrs ...netip.Addr) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Skip the header and the name to the end of the question.
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+
+			var answers []netip.Addr
+			if binary.BigEndian.Uint16(buf[end-4:]) == 1 {
+				answers = addrs
+			}
+			resp := append([]byte{}, buf[:2]...)
+			resp = append(resp, 0x81, 0x80, 0, 1)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+			resp = append(resp, 0, 0, 0, 0)
+			resp = append(resp, buf[12:end]...)
+			for _, addr := range answers {
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, addr.AsSlice()...)
+			}
+			_, _ = conn.WriteTo(resp, from)
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestUpstreamTriesNextAddress(t *testing.T) {
+	target := startIdleTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	up := startConnectUpstream(t)
+	proxyServer := newUpstreamProxy(t, up, func(s *proxy.Server) {
+		s.Guard = netguard.New(nil, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+		// Nothing listens on the first address, the upstream answers 502.
+		s.Guard.Resolver = startDNS(t, netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1"))
+	})
+
+	conn := openConnectTunnel(t, proxyServer.Listener.Addr().String(), net.JoinHostPort("multi.test", port))
+	_ = conn.Close()
+
+	want := []string{net.JoinHostPort("127.0.0.2", port), target}
+	if seen := up.seen(); !slices.Equal(seen, want) {
+		t.Errorf("Expected the upstream to be asked for %v, got %v", want, seen)
+	}
+}